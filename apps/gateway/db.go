@@ -1,13 +1,162 @@
 package main
 
 import (
-	"errors"
-	"github.com/chriscow/cloud-scanner-go/scan"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func dbGetSession(id string) (*scan.Session, error) {
-	return nil, errors.New("dbGetSession not implemented")
+const (
+	// lockWait is how long the store waits between attempts to take a lock
+	lockWait = 10 * time.Millisecond
+
+	// staleLock is how old a lock must be before it is taken to be left by
+	// a gateway that crashed holding it
+	staleLock = 30 * time.Second
+)
+
+// store keeps what the gateway knows about sessions in a JSON file per
+// record under a directory. Gateways sharing the directory share the records
+// and a gateway that restarts picks up where it left off.
+type store struct {
+	dir string
+}
+
+// newStore returns a store that keeps its records under dir
+func newStore(dir string) *store {
+	return &store{dir: dir}
+}
+
+func (st *store) path(kind string, id int64) string {
+	return filepath.Join(st.dir, kind, strconv.FormatInt(id, 10)+".json")
+}
+
+// load reads the record into v and returns false if there isn't one
+func (st *store) load(kind string, id int64, v interface{}) (bool, error) {
+	body, err := ioutil.ReadFile(st.path(kind, id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return false, fmt.Errorf("%s %d: %w", kind, id, err)
+	}
+	return true, nil
+}
+
+// save writes the record to a temporary file and renames it over the old one
+// so readers never see a partial record
+func (st *store) save(kind string, id int64, v interface{}) error {
+	dir := filepath.Join(st.dir, kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "record-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), st.path(kind, id))
+}
+
+// remove deletes the record. Removing a record that doesn't exist is not an
+// error.
+func (st *store) remove(kind string, id int64) error {
+	err := os.Remove(st.path(kind, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ids returns the IDs of every record of the kind
+func (st *store) ids(kind string) ([]int64, error) {
+	paths, err := filepath.Glob(filepath.Join(st.dir, kind, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0, len(paths))
+	for _, p := range paths {
+		id, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(p), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// lock takes the lock of a record, waiting while another goroutine or gateway
+// holds it, and returns the function that releases it. Reading, changing and
+// saving a record under its lock never loses another gateway's change.
+func (st *store) lock(kind string, id int64) (func(), error) {
+	dir := filepath.Join(st.dir, kind)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	name := filepath.Join(dir, strconv.FormatInt(id, 10)+".lock")
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(name)
+			continue
+		}
+
+		time.Sleep(lockWait)
+	}
+}
+
+// sessionsKind is the kind of store record that holds SessionStatus
+const sessionsKind = "sessions"
+
+// dbGetSession returns the status of the session, or nil if the store doesn't
+// have one
+func dbGetSession(st *store, id int64) (*SessionStatus, error) {
+	status := &SessionStatus{}
+	ok, err := st.load(sessionsKind, id, status)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return status, nil
 }
 
-func dbNewSession(payload SessionPayload) {
+// dbSaveSession replaces the status of the session
+func dbSaveSession(st *store, status *SessionStatus) error {
+	return st.save(sessionsKind, status.ID, status)
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+	"github.com/chriscow/cloud-scanner-go/scan"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// defaultChunkScans is the most origins a single work unit scans when the
+// request doesn't say
+const defaultChunkScans = 100000
+
+// defaultGridProcs is how many scan jobs every work unit of a grid session
+// runs when the request doesn't set MaxProcs
+const defaultGridProcs = 4
+
+// SplitType enumeration selects how the planner divides a session into work
+// units for the scanners
+type SplitType int
+
+const (
+	// SplitChunks divides the origins requested into chunks of at most
+	// ChunkScans origins around the same ZLine origin
+	SplitChunks SplitType = iota
+
+	// SplitPartition creates a work unit for every Lattice.Partition cell
+	// of the session's Radius, each scanning ScansReq origins, so together
+	// they cover the whole lattice
+	SplitPartition
+)
+
+// String returns the string representation of the SplitType enum
+func (st SplitType) String() string {
+	return [...]string{
+		"Chunks", "Partition",
+	}[st]
+}
+
+// GetSType returns a SplitType from its string representation
+func (st SplitType) GetSType(name string) (SplitType, error) {
+	switch strings.ToLower(name) {
+	case "chunks", "chunk", "":
+		return SplitChunks, nil
+	case "partition", "partitions":
+		return SplitPartition, nil
+	default:
+		return 0, errors.New("Unknown split type")
+	}
+}
+
+// plan splits the session into the work units published to the scanners.
+// Every unit is a copy of the session with its own ID, tagged with the
+// session's ID as its ParentID and its index as Chunk.
+func plan(s *scan.Session, split SplitType, chunkScans int) ([]scan.Session, error) {
+	switch split {
+	case SplitChunks:
+		return planChunks(s, chunkScans), nil
+	case SplitPartition:
+		return planPartition(s)
+	default:
+		return nil, fmt.Errorf("unknown split type %d", split)
+	}
+}
+
+// planChunks divides ScansReq into chunks of at most chunkScans origins. The
+// remainder is spread over the first chunks. The chunks of a grid session
+// share the session's grid, so they all run the MaxProcs the request asked
+// for rather than what each scanner has.
+func planChunks(s *scan.Session, chunkScans int) []scan.Session {
+	if chunkScans < 1 {
+		chunkScans = defaultChunkScans
+	}
+
+	gridProcs := s.MaxProcs
+	if gridProcs < 1 {
+		gridProcs = defaultGridProcs
+	}
+
+	chunks := (s.ScansReq + chunkScans - 1) / chunkScans
+	if chunks < 1 {
+		chunks = 1
+	}
+
+	units := make([]scan.Session, chunks)
+	for i := range units {
+		units[i] = subSession(s, i, chunks)
+		units[i].ScansReq = s.ScansReq / chunks
+		if i < s.ScansReq%chunks {
+			units[i].ScansReq++
+		}
+
+		if s.Sampler == scan.GridSampler {
+			units[i].GridScans = s.ScansReq
+			units[i].ProcCount = gridProcs
+		}
+	}
+
+	return units
+}
+
+// planPartition creates a work unit centered on every cell that partitions
+// the session's lattice with the session's Radius
+func planPartition(s *scan.Session) ([]scan.Session, error) {
+	lattice, err := geom.NewLattice(s.Lattice.LatticeType, s.Lattice.VertexType)
+	if err != nil {
+		return nil, err
+	}
+
+	origins := lattice.Partition(s.Radius)
+	if len(origins) == 0 {
+		return nil, errors.New("the lattice has no points to partition")
+	}
+
+	units := make([]scan.Session, len(origins))
+	for i, origin := range origins {
+		units[i] = subSession(s, i, len(origins))
+		units[i].ZLine.Origin = origin
+	}
+
+	return units, nil
+}
+
+// lastID is the last ID newSessionID handed out
+var lastID int64
+
+// newSessionID returns an ID for a session or work unit. IDs are the time
+// they were handed out in nanoseconds, moved past the last one so sessions
+// and the units planned for them never share one.
+func newSessionID() int64 {
+	for {
+		last := atomic.LoadInt64(&lastID)
+		id := time.Now().UnixNano()
+		if id <= last {
+			id = last + 1
+		}
+
+		if atomic.CompareAndSwapInt64(&lastID, last, id) {
+			return id
+		}
+	}
+}
+
+// subSession copies the session into work unit chunk of chunks. The unit
+// gets an ID of its own, so each one samples different origins, and is
+// grouped with the others by ParentID.
+func subSession(s *scan.Session, chunk, chunks int) scan.Session {
+	unit := *s
+	unit.ID = newSessionID()
+	unit.ParentID = s.ID
+	unit.Chunk = chunk
+	unit.Chunks = chunks
+
+	// the zero values aren't published, just the zero sets
+	unit.ZLine.Zeros = append([]geom.Zeros(nil), s.ZLine.Zeros...)
+	return unit
+}
+
+// plansKind is the kind of store record that holds planState
+const plansKind = "plans"
+
+// planState is the progress of a session that was split into work units
+type planState struct {
+	Parent  scan.Session
+	Done    map[int]bool
+	Started time.Time
+}
+
+// planTracker follows the work units of split sessions on the
+// session-complete topic and publishes the parent there once every one of
+// its units has completed. Plans are kept in the store so a gateway that
+// restarts, or any other gateway on the planner channel, carries on
+// following them.
+type planTracker struct {
+	store *store
+
+	// complete is called with the parent once all its units are done
+	complete func(parent scan.Session) error
+}
+
+func newPlanTracker(st *store, complete func(parent scan.Session) error) *planTracker {
+	return &planTracker{
+		store:    st,
+		complete: complete,
+	}
+}
+
+// track starts following the units of the parent session
+func (pt *planTracker) track(parent scan.Session) error {
+	return pt.store.save(plansKind, parent.ID, planState{
+		Parent:  parent,
+		Done:    make(map[int]bool),
+		Started: time.Now(),
+	})
+}
+
+// done records that a work unit completed and returns the parent if it was
+// the last one. The plan is removed with the last unit, under its lock, so
+// only one gateway ever completes the parent.
+func (pt *planTracker) done(unit scan.Session) (scan.Session, bool, error) {
+	unlock, err := pt.store.lock(plansKind, unit.ParentID)
+	if err != nil {
+		return scan.Session{}, false, err
+	}
+	defer unlock()
+
+	state := planState{}
+	ok, err := pt.store.load(plansKind, unit.ParentID, &state)
+	if err != nil || !ok {
+		return scan.Session{}, false, err
+	}
+
+	if state.Done[unit.Chunk] {
+		return scan.Session{}, false, nil
+	}
+
+	if state.Done == nil {
+		state.Done = make(map[int]bool)
+	}
+	state.Done[unit.Chunk] = true
+
+	// the parent scanned at the rate of all its units together and took as
+	// long as they all did
+	state.Parent.ScansPerSec += unit.ScansPerSec
+	state.Parent.ScansDone += unit.ScansDone
+	state.Parent.Cancelled = state.Parent.Cancelled || unit.Cancelled
+
+	if len(state.Done) < unit.Chunks {
+		return scan.Session{}, false, pt.store.save(plansKind, unit.ParentID, state)
+	}
+
+	state.Parent.TotalTime = time.Since(state.Started)
+	return state.Parent, true, pt.store.remove(plansKind, unit.ParentID)
+}
+
+// HandleMessage consumes completed sessions
+func (pt *planTracker) HandleMessage(msg *nsq.Message) error {
+	if len(msg.Body) == 0 {
+		return nil
+	}
+
+	unit := scan.Session{}
+	if err := json.Unmarshal(msg.Body, &unit); err != nil {
+		return err
+	}
+
+	// only work units have parents
+	if unit.ParentID == 0 {
+		return nil
+	}
+
+	parent, ok, err := pt.done(unit)
+	if err != nil || !ok {
+		return err
+	}
+
+	log.Println("[planner] all", unit.Chunks, "work units of session", parent.ID, "are done")
+	return pt.complete(parent)
+}
+
+// publishComplete publishes a parent session to the session-complete topic
+func publishComplete(parent scan.Session) error {
+	config := nsq.NewConfig()
+	producer, err := nsq.NewProducer("127.0.0.1:4150", config)
+	if err != nil {
+		return err
+	}
+	defer producer.Stop()
+
+	return scan.PublishSession(producer, scan.CompleteTopic, parent)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+	"github.com/chriscow/cloud-scanner-go/scan"
+)
+
+func plannerTestSession(scansReq int) *scan.Session {
+	return &scan.Session{
+		ID: 1000,
+		ZLine: geom.ZLine{
+			Limit: 100,
+			Zeros: []geom.Zeros{{ZeroType: geom.Primes, Scalar: 1}},
+		},
+		Radius:        1,
+		DistanceLimit: 1,
+		BucketCount:   3600,
+		ScansReq:      scansReq,
+		MinScore:      .3,
+	}
+}
+
+func TestPlanChunks(t *testing.T) {
+	s := plannerTestSession(250001)
+
+	units, err := plan(s, SplitChunks, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(units) != 3 {
+		t.Fatal("expected 3 work units but got", len(units))
+	}
+
+	total := 0
+	ids := make(map[int64]bool)
+	for i, unit := range units {
+		total += unit.ScansReq
+
+		if unit.ScansReq > 100000 {
+			t.Log("work unit", i, "scans", unit.ScansReq, "origins")
+			t.Fail()
+		}
+
+		if unit.ParentID != s.ID || unit.Chunk != i || unit.Chunks != 3 {
+			t.Log("work unit", i, "has parent", unit.ParentID, "chunk", unit.Chunk, "of", unit.Chunks)
+			t.Fail()
+		}
+
+		if unit.ID == s.ID || ids[unit.ID] {
+			t.Log("work unit", i, "does not have an ID of its own")
+			t.Fail()
+		}
+		ids[unit.ID] = true
+
+		if err := unit.Validate(); err != nil {
+			t.Log(err)
+			t.Fail()
+		}
+	}
+
+	if total != s.ScansReq {
+		t.Log("the work units scan", total, "origins but", s.ScansReq, "were requested")
+		t.Fail()
+	}
+}
+
+func TestPlanUnitIDsAreUnique(t *testing.T) {
+	ids := make(map[int64]bool)
+	for i := 0; i < 10; i++ {
+		s := plannerTestSession(500)
+		s.ID = newSessionID()
+		if ids[s.ID] {
+			t.Fatal("session", i, "has the ID of another session or unit")
+		}
+		ids[s.ID] = true
+
+		units, _ := plan(s, SplitChunks, 100)
+		for _, unit := range units {
+			if ids[unit.ID] {
+				t.Fatal("a work unit of session", i, "has the ID of another session or unit")
+			}
+			ids[unit.ID] = true
+		}
+	}
+}
+
+func TestPlanGridProcCount(t *testing.T) {
+	for _, maxProcs := range []int{0, 6} {
+		s := plannerTestSession(1001)
+		s.Sampler = scan.GridSampler
+		s.MaxProcs = maxProcs
+		if err := s.Normalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := maxProcs
+		if want == 0 {
+			want = defaultGridProcs
+		}
+
+		units, err := plan(s, SplitChunks, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, unit := range units {
+			// the scanner's own limits don't change the planned proc count
+			unit.MaxProcs = 2
+			if err := unit.Normalize(); err != nil || unit.ProcCount != want {
+				t.Fatal("work unit", i, "has", unit.ProcCount, "jobs instead of the planned", want, err)
+			}
+
+			if unit.GridScans != s.ScansReq {
+				t.Fatal("work unit", i, "has a grid of", unit.GridScans, "instead of", s.ScansReq)
+			}
+		}
+	}
+}
+
+func TestPlanSmallSession(t *testing.T) {
+	units, err := plan(plannerTestSession(10), SplitChunks, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(units) != 1 || units[0].ScansReq != 10 {
+		t.Fatal("expected a single work unit for a small session but got", len(units))
+	}
+}
+
+func TestPlanTrackerCompletesParent(t *testing.T) {
+	completed := make([]scan.Session, 0)
+	pt := newPlanTracker(newStore(t.TempDir()), func(parent scan.Session) error {
+		completed = append(completed, parent)
+		return nil
+	})
+
+	s := plannerTestSession(300)
+	units, _ := plan(s, SplitChunks, 100)
+	pt.track(*s)
+
+	for i, unit := range units {
+		unit.ScansPerSec = 10
+
+		// a unit completing twice only counts once
+		for repeat := 0; repeat < 2; repeat++ {
+			parent, done, err := pt.done(unit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if done != (i == len(units)-1 && repeat == 0) {
+				t.Fatal("unit", i, "repeat", repeat, "unexpectedly completed the parent:", done)
+			}
+
+			if done {
+				completed = append(completed, parent)
+			}
+		}
+	}
+
+	if len(completed) != 1 || completed[0].ID != s.ID {
+		t.Fatal("expected the parent to complete once but got", completed)
+	}
+
+	if completed[0].ScansPerSec != 30 {
+		t.Log("expected the parent to scan at the units' combined rate but got", completed[0].ScansPerSec)
+		t.Fail()
+	}
+
+	// units of sessions that aren't tracked are ignored
+	if _, done, _ := pt.done(units[0]); done {
+		t.Fatal("a completed parent should no longer be tracked")
+	}
+}
+
+func TestPlanTrackerCancelledUnit(t *testing.T) {
+	pt := newPlanTracker(newStore(t.TempDir()), nil)
+
+	s := plannerTestSession(200)
+	units, _ := plan(s, SplitChunks, 100)
+	pt.track(*s)
+
+	units[0].ScansDone = 100
+	units[1].ScansDone = 10
+	units[1].Cancelled = true
+
+	pt.done(units[0])
+	parent, done, _ := pt.done(units[1])
+	if !done || !parent.Cancelled || parent.ScansDone != 110 {
+		t.Fatal("expected a cancelled unit to cancel its parent but got", parent.Cancelled, parent.ScansDone)
+	}
+}
+
+func TestPlanTrackerSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	s := plannerTestSession(200)
+	units, _ := plan(s, SplitChunks, 100)
+
+	pt := newPlanTracker(newStore(dir), nil)
+	if err := pt.track(*s); err != nil {
+		t.Fatal(err)
+	}
+	pt.done(units[0])
+
+	// a restarted gateway, or another one on the planner channel, finishes
+	// following the plan
+	pt = newPlanTracker(newStore(dir), nil)
+	parent, done, err := pt.done(units[1])
+	if err != nil || !done || parent.ID != s.ID {
+		t.Fatal("expected the plan to complete after a restart but got", done, err)
+	}
+}
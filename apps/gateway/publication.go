@@ -5,9 +5,12 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/go-chi/valve"
 	"log"
 	"os"
+	"github.com/chriscow/cloud-scanner-go/scan"
+	"github.com/chriscow/cloud-scanner-go/util"
 	"github.com/nsqio/go-nsq"
 )
 
@@ -98,9 +101,35 @@ func (p *publication) HandleMessage(msg *nsq.Message) error {
 		return nil
 	}
 
-	// broadcast the message to all connected subscribers
-	if len(p.subscribers) > 0 {
-		p.broadcast <- msg.Body
+	// websocket clients only see the payload
+	env, err := util.Open(msg.Body, p.topic)
+	if err != nil {
+		log.Println("[publication]", err)
+		return nil
+	}
+	body := env.Payload
+
+	// websocket clients read JSON so binary results are relayed as the
+	// bare JSON array scanners used to publish
+	if !env.IsJSON() {
+		results, _, err := scan.UnmarshalResults(env.ContentType, body)
+		if err != nil {
+			log.Println("[publication] result decode error:", err)
+			return nil
+		}
+
+		if body, err = json.Marshal(results); err != nil {
+			log.Println("[publication] result encode error:", err)
+			return nil
+		}
+	}
+
+	// broadcast the message to all connected subscribers. The subscribers
+	// belong to run so it is left to check if there are any. Once the valve
+	// stops run no longer receives so the message is dropped.
+	select {
+	case p.broadcast <- body:
+	case <-p.valve.Stop():
 	}
 
 	return nil
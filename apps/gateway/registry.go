@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chriscow/cloud-scanner-go/scan"
+
+	"github.com/nsqio/go-nsq"
+)
+
+const (
+	// registryChannel is the channel the registry follows sessions on
+	registryChannel = "registry"
+
+	// registryTTL is how long the registry remembers sessions that are done
+	registryTTL = 24 * time.Hour
+
+	// pruneEvery is how often the registry forgets old sessions
+	pruneEvery = time.Minute
+)
+
+// SessionStatus is what the registry knows about a session
+type SessionStatus struct {
+	ID       int64
+	ParentID int64 `json:",omitempty"`
+	State    scan.SessionState
+
+	// Status is State as a string for the web client
+	Status string
+
+	// Worker is the scanner that last ran the session
+	Worker string `json:",omitempty"`
+
+	// Error is why the session failed
+	Error string `json:",omitempty"`
+
+	Queued   time.Time
+	Started  time.Time
+	Finished time.Time
+
+	// Scanned and Results are the progress the scanner last reported. A
+	// session split into work units adds up the progress of its units.
+	Scanned int
+	Results int
+	ETA     time.Duration `json:",omitempty"`
+
+	ScansReq    int
+	ScansPerSec int
+	TotalTime   time.Duration
+}
+
+// Render on SessionStatus fills in Status before it is marshalled
+func (ss *SessionStatus) Render(w http.ResponseWriter, r *http.Request) error {
+	ss.Status = ss.State.String()
+	return nil
+}
+
+// registry follows sessions through their lifecycle on the session-request,
+// session-progress and session-complete topics. What it knows is kept in the
+// store so it survives restarts and every gateway sharing the store can
+// answer for any session.
+type registry struct {
+	store *store
+
+	mut    sync.Mutex
+	pruned time.Time
+}
+
+func newRegistry(st *store) *registry {
+	return &registry{
+		store:  st,
+		pruned: time.Now(),
+	}
+}
+
+// get returns the status of the session and false if the registry doesn't
+// know it
+func (reg *registry) get(id int64) (SessionStatus, bool, error) {
+	status, err := dbGetSession(reg.store, id)
+	if err != nil || status == nil {
+		return SessionStatus{}, false, err
+	}
+	return *status, true, nil
+}
+
+// update moves the session to state at the time given and calls apply to
+// record anything else the message carried. Messages on different topics can
+// arrive in any order so states only ever move forward and a final state is
+// never left. A requeued session stays running when another scanner picks it
+// up. The session is locked while it is updated so gateways don't lose each
+// other's updates.
+func (reg *registry) update(id, parentID int64, state scan.SessionState, at time.Time, apply func(*SessionStatus)) error {
+	if err := reg.prune(at); err != nil {
+		log.Println("[registry] pruning:", err)
+	}
+
+	unlock, err := reg.store.lock(sessionsKind, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := dbGetSession(reg.store, id)
+	if err != nil {
+		return err
+	}
+
+	if status == nil {
+		status = &SessionStatus{ID: id, ParentID: parentID, State: scan.Queued}
+	}
+
+	switch {
+	case state == scan.Queued:
+		if status.Queued.IsZero() {
+			status.Queued = at
+		}
+	case state == scan.Running:
+		if status.Started.IsZero() {
+			status.Started = at
+		}
+	default:
+		if status.Finished.IsZero() {
+			status.Finished = at
+		}
+	}
+
+	if !status.State.Final() && state >= status.State {
+		status.State = state
+	}
+
+	if apply != nil {
+		apply(status)
+	}
+
+	return dbSaveSession(reg.store, status)
+}
+
+// prune forgets sessions that finished more than registryTTL ago
+func (reg *registry) prune(now time.Time) error {
+	reg.mut.Lock()
+	if now.Sub(reg.pruned) < pruneEvery {
+		reg.mut.Unlock()
+		return nil
+	}
+	reg.pruned = now
+	reg.mut.Unlock()
+
+	ids, err := reg.store.ids(sessionsKind)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		status, err := dbGetSession(reg.store, id)
+		if err != nil {
+			return err
+		}
+
+		if status != nil && status.State.Final() && now.Sub(status.Finished) > registryTTL {
+			if err := reg.store.remove(sessionsKind, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// queued records a session that was requested
+func (reg *registry) queued(s scan.Session, at time.Time) error {
+	return reg.update(s.ID, s.ParentID, scan.Queued, at, func(status *SessionStatus) {
+		status.ScansReq = s.ScansReq
+	})
+}
+
+// progress records the state and progress a scanner reported. A work unit
+// that starts running or fails does the same to the session it was split
+// from, and adds its progress to the parent's.
+func (reg *registry) progress(p scan.Progress) error {
+	scanned, results := 0, 0
+
+	err := reg.update(p.SessionID, p.ParentID, p.State, p.Updated, func(status *SessionStatus) {
+		if p.Worker != "" && (p.State == scan.Running || status.Worker == "") {
+			status.Worker = p.Worker
+		}
+
+		if status.State == scan.Failed && status.Error == "" {
+			status.Error = p.Error
+		}
+
+		// events only carry progress while the session runs
+		if p.Scanned > 0 && p.Scanned >= status.Scanned {
+			scanned, results = p.Scanned-status.Scanned, p.Results-status.Results
+			status.Scanned = p.Scanned
+			status.Results = p.Results
+			status.ETA = p.ETA
+			if p.ScansReq > 0 {
+				status.ScansReq = p.ScansReq
+			}
+		}
+	})
+
+	if err != nil || p.ParentID == 0 || (p.State != scan.Running && p.State != scan.Failed) {
+		return err
+	}
+
+	return reg.update(p.ParentID, 0, p.State, p.Updated, func(status *SessionStatus) {
+		if status.State == scan.Failed && status.Error == "" {
+			status.Error = fmt.Sprint("work unit ", p.SessionID, ": ", p.Error)
+		}
+
+		status.Scanned += scanned
+		status.Results += results
+	})
+}
+
+// completed records a session that published all of its results, or all
+// it found before it was cancelled
+func (reg *registry) completed(s scan.Session, at time.Time) error {
+	state := scan.Completed
+	if s.Cancelled {
+		state = scan.Cancelled
+	}
+
+	return reg.update(s.ID, s.ParentID, state, at, func(status *SessionStatus) {
+		if status.State != state {
+			return
+		}
+
+		status.ScansReq = s.ScansReq
+		status.ScansPerSec = s.ScansPerSec
+		status.TotalTime = s.TotalTime
+		status.ETA = 0
+		if s.ScansDone > 0 {
+			status.Scanned = s.ScansDone
+		}
+	})
+}
+
+// handleRequest consumes session requests
+func (reg *registry) handleRequest() nsq.HandlerFunc {
+	return func(msg *nsq.Message) error {
+		s := scan.Session{}
+		if !unmarshalMessage(msg, &s) {
+			return nil
+		}
+
+		return reg.queued(s, time.Unix(0, msg.Timestamp))
+	}
+}
+
+// handleProgress consumes the progress scanners report
+func (reg *registry) handleProgress() nsq.HandlerFunc {
+	return func(msg *nsq.Message) error {
+		p := scan.Progress{}
+		if !unmarshalMessage(msg, &p) {
+			return nil
+		}
+
+		if p.Updated.IsZero() {
+			p.Updated = time.Unix(0, msg.Timestamp)
+		}
+
+		return reg.progress(p)
+	}
+}
+
+// handleComplete consumes completed sessions
+func (reg *registry) handleComplete() nsq.HandlerFunc {
+	return func(msg *nsq.Message) error {
+		s := scan.Session{}
+		if !unmarshalMessage(msg, &s) {
+			return nil
+		}
+
+		return reg.completed(s, time.Unix(0, msg.Timestamp))
+	}
+}
+
+// unmarshalMessage returns false for messages that are empty or can't be
+// unmarshalled. Requeueing them wouldn't help so they are only logged.
+func unmarshalMessage(msg *nsq.Message, v interface{}) bool {
+	if len(msg.Body) == 0 {
+		return false
+	}
+
+	if err := json.Unmarshal(msg.Body, v); err != nil {
+		log.Println("[registry] dropping message:", err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chriscow/cloud-scanner-go/scan"
+)
+
+func TestRegistryLifecycle(t *testing.T) {
+	reg := newRegistry(newStore(t.TempDir()))
+	start := time.Now()
+
+	s := scan.Session{ID: 1, ScansReq: 100}
+	reg.queued(s, start)
+
+	status, ok, _ := reg.get(s.ID)
+	if !ok || status.State != scan.Queued || !status.Queued.Equal(start) {
+		t.Fatal("expected a queued session but got", status)
+	}
+
+	reg.progress(scan.Progress{SessionID: s.ID, State: scan.Running, Worker: "scanner:1", Updated: start.Add(time.Second)})
+
+	s.ScansPerSec = 50
+	s.TotalTime = 2 * time.Second
+	reg.completed(s, start.Add(3*time.Second))
+
+	status, _, _ = reg.get(s.ID)
+	if status.State != scan.Completed {
+		t.Fatal("expected a completed session but got", status.State)
+	}
+
+	if status.Worker != "scanner:1" || status.ScansPerSec != 50 || status.TotalTime != s.TotalTime {
+		t.Log("the completed session lost what was reported:", status)
+		t.Fail()
+	}
+
+	if !status.Started.Equal(start.Add(time.Second)) || !status.Finished.Equal(start.Add(3*time.Second)) {
+		t.Log("unexpected timestamps", status.Started, status.Finished)
+		t.Fail()
+	}
+}
+
+func TestRegistryOutOfOrder(t *testing.T) {
+	reg := newRegistry(newStore(t.TempDir()))
+	start := time.Now()
+
+	// the scanner reports before the registry sees the request
+	reg.progress(scan.Progress{SessionID: 1, State: scan.Running, Worker: "scanner:1", Updated: start.Add(time.Second)})
+	reg.queued(scan.Session{ID: 1, ScansReq: 100}, start)
+
+	status, _, _ := reg.get(1)
+	if status.State != scan.Running || !status.Queued.Equal(start) || status.ScansReq != 100 {
+		t.Fatal("a late request should not move the session back to queued:", status)
+	}
+
+	// a final state is never left
+	reg.progress(scan.Progress{SessionID: 1, State: scan.Failed, Error: "boom", Updated: start.Add(2 * time.Second)})
+	reg.completed(scan.Session{ID: 1}, start.Add(3*time.Second))
+	reg.progress(scan.Progress{SessionID: 1, State: scan.Running, Worker: "scanner:2", Updated: start.Add(4 * time.Second)})
+
+	status, _, _ = reg.get(1)
+	if status.State != scan.Failed || status.Error != "boom" || !status.Finished.Equal(start.Add(2*time.Second)) {
+		t.Fatal("expected the session to stay failed but got", status)
+	}
+}
+
+func TestRegistryWorkUnits(t *testing.T) {
+	reg := newRegistry(newStore(t.TempDir()))
+	now := time.Now()
+
+	reg.queued(scan.Session{ID: 10, ScansReq: 200}, now)
+	reg.progress(scan.Progress{SessionID: 11, ParentID: 10, State: scan.Running, Updated: now})
+
+	if status, _, _ := reg.get(10); status.State != scan.Running {
+		t.Fatal("a running work unit should run its parent but the parent is", status.State)
+	}
+
+	reg.progress(scan.Progress{SessionID: 12, ParentID: 10, State: scan.Failed, Error: "boom", Updated: now})
+
+	status, _, _ := reg.get(10)
+	if status.State != scan.Failed || status.Error == "" {
+		t.Fatal("a failed work unit should fail its parent but the parent is", status.State)
+	}
+}
+
+func TestRegistryPrunes(t *testing.T) {
+	reg := newRegistry(newStore(t.TempDir()))
+	then := time.Now().Add(-2 * registryTTL)
+
+	reg.completed(scan.Session{ID: 1}, then)
+	reg.queued(scan.Session{ID: 2}, then)
+
+	reg.queued(scan.Session{ID: 3}, time.Now().Add(pruneEvery))
+
+	if _, ok, _ := reg.get(1); ok {
+		t.Log("expected an old completed session to be forgotten")
+		t.Fail()
+	}
+
+	if _, ok, _ := reg.get(2); !ok {
+		t.Log("expected a session still queued to be remembered")
+		t.Fail()
+	}
+}
+
+func TestRegistryCancelled(t *testing.T) {
+	reg := newRegistry(newStore(t.TempDir()))
+	now := time.Now()
+
+	reg.queued(scan.Session{ID: 1, ScansReq: 100}, now)
+	reg.completed(scan.Session{ID: 1, ScansReq: 100, ScansDone: 40, Cancelled: true}, now)
+
+	status, _, _ := reg.get(1)
+	if status.State != scan.Cancelled || !status.Finished.Equal(now) {
+		t.Fatal("expected a cancelled session but got", status)
+	}
+}
+
+func TestRegistryProgress(t *testing.T) {
+	reg := newRegistry(newStore(t.TempDir()))
+	now := time.Now()
+
+	reg.queued(scan.Session{ID: 10, ScansReq: 200}, now)
+	for _, id := range []int64{11, 12} {
+		reg.progress(scan.Progress{SessionID: id, ParentID: 10, State: scan.Running, Worker: "scanner:1", Updated: now})
+	}
+
+	// progress events don't carry the worker
+	reg.progress(scan.Progress{SessionID: 11, ParentID: 10, State: scan.Running, Scanned: 50, ScansReq: 100, Results: 5, Updated: now})
+	reg.progress(scan.Progress{SessionID: 11, ParentID: 10, State: scan.Running, Scanned: 80, ScansReq: 100, Results: 7, Updated: now})
+	reg.progress(scan.Progress{SessionID: 12, ParentID: 10, State: scan.Running, Scanned: 20, ScansReq: 100, Results: 1, Updated: now})
+
+	unit, _, _ := reg.get(11)
+	if unit.Scanned != 80 || unit.Results != 7 || unit.Worker != "scanner:1" {
+		t.Fatal("unexpected work unit progress", unit)
+	}
+
+	parent, _, _ := reg.get(10)
+	if parent.Scanned != 100 || parent.Results != 8 || parent.ScansReq != 200 {
+		t.Fatal("expected the parent to add up its units' progress but got", parent.Scanned, parent.Results, parent.ScansReq)
+	}
+}
+
+func TestRegistrySharesStore(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	// two gateways on the registry channel each see some of the messages
+	a := newRegistry(newStore(dir))
+	b := newRegistry(newStore(dir))
+
+	a.queued(scan.Session{ID: 1, ScansReq: 100}, now)
+	b.progress(scan.Progress{SessionID: 1, State: scan.Running, Worker: "scanner:1", Updated: now.Add(time.Second)})
+	a.completed(scan.Session{ID: 1, ScansReq: 100, ScansDone: 100}, now.Add(2*time.Second))
+
+	// and a gateway that restarts still knows the session
+	status, ok, err := newRegistry(newStore(dir)).get(1)
+	if err != nil || !ok {
+		t.Fatal("expected the session to be remembered but got", ok, err)
+	}
+
+	if status.State != scan.Completed || status.Worker != "scanner:1" || !status.Queued.Equal(now) {
+		t.Fatal("expected the updates of both gateways but got", status)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chriscow/cloud-scanner-go/scan"
+	"github.com/chriscow/cloud-scanner-go/util"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/jwtauth"
 
@@ -25,6 +27,9 @@ import (
 
 const appCtxDataKey = "app_ctx_data"
 
+// plannerChannel is the channel the gateway follows completed sessions on
+const plannerChannel = "planner"
+
 type server struct {
 	cfg          config
 	appCtx       appContext
@@ -34,6 +39,9 @@ type server struct {
 	valve        *valve.Valve
 	view         *goview.ViewEngine
 	auth         *jwtauth.JWTAuth
+	store        *store
+	plans        *planTracker
+	registry     *registry
 }
 
 func newServer(cfg config) *server {
@@ -50,8 +58,12 @@ func newServer(cfg config) *server {
 		publications: make(map[string]*publication),
 		valve:        valve.New(),
 		view:         goview.New(viewCfg),
+		store:        newStore(path.Join(os.Getenv("APP_DATA"), "gateway")),
 	}
 
+	s.plans = newPlanTracker(s.store, publishComplete)
+	s.registry = newRegistry(s.store)
+
 	s.configure()
 
 	// For debugging/example purposes, we generate and print
@@ -86,6 +98,14 @@ func (s *server) configure() {
 	s.context()
 	s.middleware()
 	s.routes()
+
+	// follow the work units of split sessions
+	go util.StartConsumer(s.valve.Context(), scan.CompleteTopic, plannerChannel, s.plans)
+
+	// follow every session through its lifecycle
+	go util.StartConsumer(s.valve.Context(), scan.SessionTopic, registryChannel, s.registry.handleRequest())
+	go util.StartConsumer(s.valve.Context(), scan.ProgressTopic, registryChannel, s.registry.handleProgress())
+	go util.StartConsumer(s.valve.Context(), scan.CompleteTopic, registryChannel, s.registry.handleComplete())
 }
 
 func (s *server) context() error {
@@ -168,12 +188,15 @@ func (s *server) routes() {
 			r.Use(middleware.AllowContentType("application/json"))
 
 			r.Route("/session", func(r chi.Router) {
-				// get a session by it's ID from the database or return a "default" session
+				// get the status of a session by it's ID or return a "default" session
 				r.Get("/", getDefaultSession)
-				r.Get("/{sessionID}", getSession)
+				r.Get("/{sessionID}", s.handleGetSession())
+
+				// stop a queued or running session
+				r.Delete("/{sessionID}", s.handleCancelSession())
 
 				// queue a scan using the parameters of the session
-				r.Post("/", startSession)
+				r.Post("/", s.handleStartSession())
 			})
 		})
 	})
@@ -205,7 +228,9 @@ func (s *server) staticRoute(staticPath string) {
 	})
 }
 
-// handleSubscribe handles websocket requests to subscribe to an NSQ topic
+// handleSubscribe handles websocket requests to subscribe to an NSQ topic.
+// Subscribing to scan.ProgressTopic relays the progress of every running
+// session, which the client tells apart by SessionID.
 func (s *server) handleSubscribe() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -227,14 +252,16 @@ func (s *server) handleSubscribe() http.HandlerFunc {
 	}
 }
 
+// getPublication returns the publication of the topic, starting it the first
+// time the topic is subscribed to
 func (s *server) getPublication(topic string) *publication {
-	var pub *publication
-	if pub, ok := s.publications[topic]; !ok {
-		pub = newPublication(s.valve, topic)
+	s.mut.Lock()
+	defer s.mut.Unlock()
 
-		s.mut.Lock()
+	pub, ok := s.publications[topic]
+	if !ok {
+		pub = newPublication(s.valve, topic)
 		s.publications[topic] = pub
-		s.mut.Unlock()
 
 		go pub.run()
 	}
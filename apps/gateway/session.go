@@ -3,12 +3,18 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/chriscow/cloud-scanner-go/geom"
 	"github.com/chriscow/cloud-scanner-go/scan"
+	"github.com/chriscow/cloud-scanner-go/util"
 
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 	"github.com/nsqio/go-nsq"
 )
@@ -16,6 +22,11 @@ import (
 // SessionPayload ...
 type SessionPayload struct {
 	*scan.Session
+
+	// Split selects how the session is divided into work units and
+	// ChunkScans is the most origins a chunk scans
+	Split      SplitType `json:",omitempty"`
+	ChunkScans int       `json:",omitempty"`
 }
 
 // Bind on SessionPayload allows post-processing after unmarshalling
@@ -25,10 +36,10 @@ func (s *SessionPayload) Bind(r *http.Request) error {
 	}
 
 	if s.Session.ID == 0 {
-		s.Session.ID = time.Now().UnixNano()
+		s.Session.ID = newSessionID()
 	}
 
-	return nil
+	return s.Session.Normalize()
 }
 
 // Render on SessionPayload allows pre-processing before a response is marshalled
@@ -54,6 +65,7 @@ func getDefaultSession(w http.ResponseWriter, r *http.Request) {
 		BucketCount:   3600,
 		ScansReq:      5000,
 		MinScore:      .3, // 30% of zeros were hit. Cannot be zero
+		Sampler:       scan.RandomSampler,
 	}
 
 	payload := SessionPayload{Session: session}
@@ -61,36 +73,140 @@ func getDefaultSession(w http.ResponseWriter, r *http.Request) {
 	render.Render(w, r, &payload)
 }
 
-func startSession(w http.ResponseWriter, r *http.Request) {
-	payload := &SessionPayload{}
-	if err := render.Bind(r, payload); err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
-		return
-	}
+// handleStartSession plans the work units of the session and publishes them
+// for the scanners
+func (s *server) handleStartSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload := &SessionPayload{}
+		if err := render.Bind(r, payload); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
 
-	config := nsq.NewConfig()
-	producer, err := nsq.NewProducer("127.0.0.1:4150", config)
-	if err != nil {
-		render.Render(w, r, ErrServerError("NewProducer", err))
-	}
-	defer producer.Stop()
+		// the request ID traces the session through the scanners
+		if payload.Session.TraceID == "" {
+			payload.Session.TraceID = middleware.GetReqID(r.Context())
+		}
 
-	body, err := json.Marshal(*payload.Session)
-	if err != nil {
-		render.Render(w, r, ErrServerError("Marshal", err))
-	}
+		units, err := plan(payload.Session, payload.Split, payload.ChunkScans)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
 
-	err = producer.Publish(scan.SessionTopic, body)
-	if err != nil {
-		render.Render(w, r, ErrServerError("Publish", err))
-		return
+		config := nsq.NewConfig()
+		producer, err := nsq.NewProducer("127.0.0.1:4150", config)
+		if err != nil {
+			render.Render(w, r, ErrServerError("NewProducer", err))
+			return
+		}
+		defer producer.Stop()
+
+		bodies := make([][]byte, len(units))
+		for i := range units {
+			body, err := json.Marshal(units[i])
+			if err != nil {
+				render.Render(w, r, ErrServerError("Marshal", err))
+				return
+			}
+
+			bodies[i], err = util.Wrap(scan.SessionTopic, body, units[i].TraceID)
+			if err != nil {
+				render.Render(w, r, ErrServerError("Wrap", err))
+				return
+			}
+		}
+
+		// track before publishing so no unit can complete untracked
+		if err := s.plans.track(*payload.Session); err != nil {
+			render.Render(w, r, ErrServerError("Track", err))
+			return
+		}
+		if err := s.registry.queued(*payload.Session, time.Now()); err != nil {
+			render.Render(w, r, ErrServerError("Register", err))
+			return
+		}
+
+		err = producer.MultiPublish(scan.SessionTopic, bodies)
+		if err != nil {
+			render.Render(w, r, ErrServerError("Publish", err))
+			return
+		}
+
+		log.Println("[gateway] published session", payload.Session.ID, "as", len(units), "work units")
+
+		render.Status(r, http.StatusCreated)
+		render.Render(w, r, payload)
 	}
+}
+
+// handleCancelSession publishes a cancel for the session. Scanners running
+// it, or any of its work units, stop and report it cancelled.
+func (s *server) handleCancelSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "sessionID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
+		status, ok, err := s.registry.get(id)
+		if err != nil {
+			render.Render(w, r, ErrServerError("Registry", err))
+			return
+		}
+
+		if ok && status.State.Final() {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("session %d is already %v", id, status.State)))
+			return
+		}
+
+		config := nsq.NewConfig()
+		producer, err := nsq.NewProducer("127.0.0.1:4150", config)
+		if err != nil {
+			render.Render(w, r, ErrServerError("NewProducer", err))
+			return
+		}
+		defer producer.Stop()
+
+		body, err := json.Marshal(scan.Cancel{SessionID: id})
+		if err != nil {
+			render.Render(w, r, ErrServerError("Marshal", err))
+			return
+		}
+
+		if err := util.Publish(producer, scan.CancelTopic, body, middleware.GetReqID(r.Context())); err != nil {
+			render.Render(w, r, ErrServerError("Publish", err))
+			return
+		}
 
-	render.Status(r, http.StatusCreated)
-	render.Render(w, r, payload)
+		log.Println("[gateway] cancelling session", id)
+		w.WriteHeader(http.StatusAccepted)
+	}
 }
 
-func getSession(w http.ResponseWriter, r *http.Request) {
+// handleGetSession returns the status of the session from the registry
+func (s *server) handleGetSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "sessionID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
+		status, ok, err := s.registry.get(id)
+		if err != nil {
+			render.Render(w, r, ErrServerError("Registry", err))
+			return
+		}
+
+		if !ok {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+
+		render.Render(w, r, &status)
+	}
 }
 
 // scanLatticeCmd generates scan-radius sessions and publishes them to the
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+	"github.com/urfave/cli/v2"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+func main() {
+	app := &cli.App{
+		Name:  "lattice",
+		Usage: "import and export lattices in common geometry formats",
+		Before: func(*cli.Context) error {
+			godotenv.Load()
+			return nil
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "import",
+				Usage:     "validate a lattice file and save it in the binary format the scanners load first",
+				ArgsUsage: "<file>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "format", Usage: "csv, geojson, msgpack or binary (default from the file extension)"},
+					&cli.StringFlag{Name: "lattice", Usage: "lattice type of files that don't record it"},
+					&cli.StringFlag{Name: "vertex", Usage: "vertex type of files that don't record it"},
+					&cli.BoolFlag{Name: "force", Usage: "replace a lattice that already exists"},
+				},
+				Action: importCmd,
+			},
+			{
+				Name:      "export",
+				Usage:     "write a lattice, loading or generating it as the scanners would",
+				ArgsUsage: "<lattice> [vertices|centers]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "format", Usage: "csv, geojson, svg, msgpack or binary (default from the --out extension)"},
+					&cli.StringFlag{Name: "out", Usage: "file to write instead of stdout"},
+				},
+				Action: exportCmd,
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// format returns the format named by the format flag, or else the format of
+// the file
+func format(c *cli.Context, filename string) (geom.Format, error) {
+	if name := c.String("format"); name != "" {
+		var f geom.Format
+		return f.GetFormat(name)
+	}
+
+	if filename == "" {
+		return 0, errors.New("--format is required when writing to stdout")
+	}
+	return geom.FormatOf(filename)
+}
+
+func importCmd(c *cli.Context) error {
+	filename := c.Args().First()
+	if filename == "" {
+		return errors.New("the file to import is required")
+	}
+
+	f, err := format(c, filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	l, err := geom.ReadLattice(file, f)
+	typed := err == nil
+	if err != nil && !errors.Is(err, geom.ErrUntypedLattice) {
+		return err
+	}
+
+	// the flags name the types of untyped files and must agree with typed ones
+	if c.String("lattice") != "" || c.String("vertex") != "" {
+		var named geom.Lattice
+		if named.LatticeType, err = named.LatticeType.GetLType(c.String("lattice")); err != nil {
+			return err
+		}
+		if named.VertexType, err = named.VertexType.GetVType(c.String("vertex")); err != nil {
+			return err
+		}
+
+		if typed && (named.LatticeType != l.LatticeType || named.VertexType != l.VertexType) {
+			return fmt.Errorf("%s is a %v %v lattice", filename, l.LatticeType, l.VertexType)
+		}
+
+		l.LatticeType, l.VertexType = named.LatticeType, named.VertexType
+	} else if !typed {
+		return fmt.Errorf("%w: name them with --lattice and --vertex", geom.ErrUntypedLattice)
+	}
+
+	dest := geom.LatticePath(l.LatticeType, l.VertexType)
+	if _, err := os.Stat(dest); err == nil && !c.Bool("force") {
+		return fmt.Errorf("%s already exists, use --force to replace it", dest)
+	}
+
+	if err := geom.SaveLattice(l); err != nil {
+		return err
+	}
+
+	log.Println("[lattice] imported", len(l.Points), l.LatticeType, l.VertexType, "points to", dest)
+	return nil
+}
+
+func exportCmd(c *cli.Context) error {
+	var lt geom.LatticeType
+	lt, err := lt.GetLType(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	var vt geom.VertexType
+	if c.Args().Len() > 1 {
+		if vt, err = vt.GetVType(c.Args().Get(1)); err != nil {
+			return err
+		}
+	}
+
+	out := c.String("out")
+	f, err := format(c, out)
+	if err != nil {
+		return err
+	}
+
+	l, err := geom.NewLattice(lt, vt)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		file, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if err := geom.WriteLattice(w, l, f); err != nil {
+		return err
+	}
+
+	if out != "" {
+		log.Println("[lattice] exported", len(l.Points), lt, vt, "points to", out)
+	}
+	return nil
+}
@@ -22,29 +22,29 @@ import (
 )
 
 var (
-	db badger.DB
+	db *badger.DB
 )
 
 const (
 	myChannel = "persist"
 )
 
-type resultHandler struct{}
-
-func (h resultHandler) HandleMessage(msg *nsq.Message) error {
-	if len(msg.Body) == 0 {
-		// Returning nil will automatically send a FIN command to NSQ to mark the message as processed.
-		// In this case, a message with an empty body is simply ignored/discarded.
-		return nil
-	}
-
-	res := scan.Result{}
-	if err := json.Unmarshal(msg.Body, &res); err != nil {
-		return err
-	}
-
+// handleResults keeps each result of a batch under its slug in the encoding
+// it arrived in, which is the entry's user meta
+func handleResults(msg *nsq.Message, results []scan.Result, enc scan.Encoding) error {
 	err := db.Update(func(tx *badger.Txn) error {
-		return tx.Set([]byte(res.Slug), msg.Body)
+		for _, res := range results {
+			body, err := scan.MarshalResults(enc, []scan.Result{res})
+			if err != nil {
+				return err
+			}
+
+			entry := badger.NewEntry([]byte(res.Slug), body).WithMeta(byte(enc))
+			if err := tx.SetEntry(entry); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 
 	if err != nil {
@@ -85,13 +85,14 @@ func main() {
 
 	appData := path.Join(os.Getenv("APP_DATA"), "badger")
 
-	db, err := badger.Open(badger.DefaultOptions(appData))
+	var err error
+	db, err = badger.Open(badger.DefaultOptions(appData))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	rh := resultHandler{}
+	rh := util.NewRouter(nil).Handle(scan.ResultTopic, scan.ResultsHandler(handleResults))
 	go util.StartConsumer(ctx, scan.ResultTopic, myChannel, rh)
 
 	<-sigChan
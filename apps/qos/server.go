@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 	"os"
 	"github.com/chriscow/cloud-scanner-go/scan"
+	"github.com/chriscow/cloud-scanner-go/util"
 	"time"
 
 	"github.com/go-chi/valve"
@@ -23,7 +23,7 @@ type server struct {
 func newServer(topic string) *server {
 	v := valve.New()
 	pub := make(chan []scan.Result)
-	sr := scan.NewScoredResults(v.Context(), 100, pub)
+	sr := scan.NewScoredResults(v.Context(), 100, 10, time.Second, pub)
 
 	s := &server{
 		topic:   topic,
@@ -31,9 +31,23 @@ func newServer(topic string) *server {
 		valve:   v,
 	}
 
+	go s.report(pub)
+
 	return s
 }
 
+// report logs the best results as they are flushed
+func (s *server) report(pub <-chan []scan.Result) {
+	for {
+		select {
+		case res := <-pub:
+			log.Println("[qos] flushed", len(res), "results, best:", res[0])
+		case <-s.valve.Stop():
+			return
+		}
+	}
+}
+
 func (s *server) start() error {
 	config := nsq.NewConfig()
 	consumer, err := nsq.NewConsumer(s.topic, channel, config)
@@ -41,7 +55,7 @@ func (s *server) start() error {
 		return err
 	}
 
-	consumer.AddHandler(s)
+	consumer.AddHandler(util.NewRouter(nil).Handle(s.topic, scan.ResultsHandler(s.handleResults)).ForTopic(s.topic))
 
 	// Use nsqlookupd to discover nsqd instances.
 	// See also ConnectToNSQD, ConnectToNSQDs, ConnectToNSQLookupds.
@@ -61,18 +75,11 @@ func (s *server) stop() {
 	s.valve.Shutdown(5 * time.Second)
 }
 
-func (s *server) HandleMessage(msg *nsq.Message) error {
-	if len(msg.Body) == 0 {
-		return nil
+// handleResults scores the batch of results a scanner published
+func (s *server) handleResults(msg *nsq.Message, results []scan.Result, e scan.Encoding) error {
+	for _, r := range results {
+		s.results.Add(r)
 	}
 
-	var r scan.Result
-	if err := json.Unmarshal(msg.Body, &r); err != nil {
-		log.Println("JSON error:", err)
-		return nil // don't requeue
-	}
-
-	s.results.Add(r)
-
 	return nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+
+	"github.com/chriscow/cloud-scanner-go/scan"
+)
+
+// cancelTTL is how long a scanner remembers a cancel for sessions it hasn't
+// started yet
+const cancelTTL = time.Hour
+
+// cancelChannel returns the channel this scanner consumes cancels on. Every
+// scanner needs a channel of its own to see every cancel, and NSQ deletes
+// ephemeral channels when the scanner goes away.
+func cancelChannel() string {
+	return fmt.Sprint("scanner-", time.Now().UnixNano(), "#ephemeral")
+}
+
+// cancellations knows the sessions this scanner is running so it can stop
+// them when a cancel arrives on the session-cancel topic
+type cancellations struct {
+	mut       sync.Mutex
+	running   map[int64]runningSession
+	cancelled map[int64]time.Time
+}
+
+type runningSession struct {
+	parentID int64
+	cancel   context.CancelFunc
+}
+
+func newCancellations() *cancellations {
+	return &cancellations{
+		running:   make(map[int64]runningSession),
+		cancelled: make(map[int64]time.Time),
+	}
+}
+
+// start registers the session as running until finish is called. It returns
+// false if the session was cancelled before it started.
+func (c *cancellations) start(s *scan.Session, cancel context.CancelFunc) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for _, id := range []int64{s.ID, s.ParentID} {
+		if _, ok := c.cancelled[id]; ok && id != 0 {
+			return false
+		}
+	}
+
+	c.running[s.ID] = runningSession{parentID: s.ParentID, cancel: cancel}
+	return true
+}
+
+// finish forgets a session once it has stopped
+func (c *cancellations) finish(id int64) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	delete(c.running, id)
+}
+
+// cancel stops the running sessions the cancel applies to and remembers it
+// for the ones still queued
+func (c *cancellations) cancel(req scan.Cancel) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	now := time.Now()
+	for id, at := range c.cancelled {
+		if now.Sub(at) > cancelTTL {
+			delete(c.cancelled, id)
+		}
+	}
+	c.cancelled[req.SessionID] = now
+
+	for id, rs := range c.running {
+		if req.Cancels(&scan.Session{ID: id, ParentID: rs.parentID}) {
+			log.Println("[scanner] cancelling session", id)
+			rs.cancel()
+		}
+	}
+}
+
+// handleCancel consumes cancels
+func (c *cancellations) handleCancel(msg *nsq.Message, req scan.Cancel) error {
+	c.cancel(req)
+	return nil
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -11,7 +12,9 @@ import (
 
 	"github.com/joho/godotenv"
 	"github.com/nsqio/go-nsq"
+	"github.com/urfave/cli/v2"
 
+	"github.com/chriscow/cloud-scanner-go/geom"
 	"github.com/chriscow/cloud-scanner-go/scan"
 	"github.com/chriscow/cloud-scanner-go/util"
 )
@@ -21,38 +24,64 @@ const (
 	touchSec       = 30        // touch the message every so often
 )
 
-type scanRadiusHandler struct{}
+// worker identifies this scanner in the progress it reports
+var worker = workerName()
 
-func (h scanRadiusHandler) HandleMessage(msg *nsq.Message) error {
-	if len(msg.Body) == 0 {
-		// Returning nil will automatically send a FIN command to NSQ to mark the message as processed.
-		// In this case, a message with an empty body is simply ignored/discarded.
-		return nil
-	}
+type scanRadiusHandler struct {
+	cancels *cancellations
+
+	// maxProcs caps the scan jobs of sessions that don't set their own
+	// MaxProcs
+	maxProcs int
+}
 
+// HandleEnvelope scans the session in the message. Sessions that can never be
+// scanned are dead-lettered straight away. Any other error is returned so NSQ
+// requeues the message with backoff until it runs out of attempts, at which
+// point LogFailedEnvelope dead-letters it.
+func (h scanRadiusHandler) HandleEnvelope(msg *nsq.Message, env *util.Envelope) error {
 	log.Println("auto response:", msg.IsAutoResponseDisabled(), "has responded:", msg.HasResponded())
 
-	s := scan.Session{}
-	if err := json.Unmarshal(msg.Body, &s); err != nil {
-		return err
+	s, err := scan.DecodeSession(env)
+	if err != nil {
+		return deadLetter(env, &scan.InvalidSessionError{Problems: []string{err.Error()}})
+	}
+
+	if s.MaxProcs == 0 {
+		s.MaxProcs = h.maxProcs
+	}
+
+	// a cancel stops the session any time from here on
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if !h.cancels.start(&s, cancel) {
+		log.Println("[scanner] session", s.ID, "was cancelled before it started")
+		s.Cancelled = true
+		return complete(s)
 	}
+	defer h.cancels.finish(s.ID)
 
+	// an invalid session is dead-lettered but failing to load the lattice or
+	// zeros might just be this scanner
 	if err := scan.Restore(&s); err != nil {
-		return err
+		return failed(env, &s, err)
 	}
+	log.Println("[scanner] lattice and zeros cache:", geom.CacheInfo())
 
 	log.Println("[scanner] Received scan session request", s.ID, "for", s.ScansReq, "scans at", s.ZLine.Origin, "keeping the best", s.MinScore*100, "%")
 
-	// BUGBUG: what is cancel() for here? we never really cancel early
-	cctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if err := sessionProgress(&s, scan.Running, nil); err != nil {
+		log.Println("[scanner] failed to publish progress of session", s.ID, err)
+	}
 
 	done, err := scan.Run(cctx, scan.ResultTopic, &s)
 	if err != nil {
-		log.Fatal(err)
+		return failed(env, &s, err)
 	}
 
 	ticker := time.NewTicker(touchSec * time.Second)
+	defer ticker.Stop()
 
 loop:
 	for {
@@ -60,16 +89,72 @@ loop:
 		case <-ticker.C:
 			log.Println("[scanner] touching session message")
 			msg.Touch()
-		case <-done:
+		case err = <-done:
 			log.Println("[scanner] done signaled")
-			ticker.Stop()
 			cancel()
 			break loop
-		default:
 		}
 	}
 
-	sessionComplete(s)
+	// a cancelled session published what it found and completes early
+	if err != nil && !errors.Is(err, scan.ErrCancelled) {
+		return failed(env, &s, err)
+	}
+
+	return complete(s)
+}
+
+// complete publishes the session to the completed topic and finishes the
+// message
+func complete(s scan.Session) error {
+	if err := sessionComplete(s); err != nil {
+		// the results are already published so rescanning won't help
+		log.Println("[scanner] failed to publish completed session", s.ID, err)
+	}
+	return nil // auto-ack the msg
+}
+
+// LogFailedEnvelope is called when a message has used up its attempts
+func (h scanRadiusHandler) LogFailedEnvelope(msg *nsq.Message, env *util.Envelope) {
+	log.Println("[scanner] giving up on message after", msg.Attempts, "attempts")
+	reason := errors.New("too many attempts")
+	deadLetter(env, reason)
+
+	if s, err := scan.DecodeSession(env); err == nil {
+		sessionProgress(&s, scan.Failed, reason)
+	}
+}
+
+// failed decides what happens to a message whose session failed to scan
+func failed(env *util.Envelope, s *scan.Session, err error) error {
+	if !scan.Retryable(err) {
+		if perr := sessionProgress(s, scan.Failed, err); perr != nil {
+			log.Println("[scanner] failed to publish progress of session", s.ID, perr)
+		}
+		return deadLetter(env, err)
+	}
+
+	log.Println("[scanner] session failed, requeueing:", err)
+	return err
+}
+
+// deadLetter publishes the session to the dead letter topic so it can be
+// inspected later and finishes its message. If the dead letter can't be
+// published the message is requeued instead of being lost.
+func deadLetter(env *util.Envelope, reason error) error {
+	log.Println("[scanner] dead-lettering session:", reason)
+
+	config := nsq.NewConfig()
+	producer, err := nsq.NewProducer("127.0.0.1:4150", config)
+	if err != nil {
+		return err
+	}
+	defer producer.Stop()
+
+	if err := util.Publish(producer, scan.DeadLetterTopic, env.Payload, env.TraceID); err != nil {
+		return err
+	}
+
 	return nil // auto-ack the msg
 }
 
@@ -82,37 +167,125 @@ func sessionComplete(s scan.Session) error {
 	}
 	defer producer.Stop()
 
-	body, err := json.Marshal(s)
+	log.Println("[scanner] publishing completed session")
+	return scan.PublishSession(producer, scan.CompleteTopic, s)
+}
+
+// sessionProgress tells the session registry what happened to the session
+func sessionProgress(s *scan.Session, state scan.SessionState, reason error) error {
+	config := nsq.NewConfig()
+	producer, err := nsq.NewProducer("127.0.0.1:4150", config)
 	if err != nil {
 		return err
 	}
+	defer producer.Stop()
 
-	log.Println("[scanner] publishing completed session")
-	return producer.Publish(scan.CompleteTopic, body)
+	p := scan.Progress{
+		SessionID: s.ID,
+		ParentID:  s.ParentID,
+		State:     state,
+		Worker:    worker,
+		TraceID:   s.TraceID,
+	}
+
+	if reason != nil {
+		p.Error = reason.Error()
+	}
+
+	return scan.PublishProgress(producer, p)
 }
 
-func checkEnv() {
-	godotenv.Load()
+// workerName is the host name and process ID of the scanner
+func workerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprint(host, ":", os.Getpid())
+}
 
+func checkEnv() {
 	if os.Getenv("NSQ_LOOKUP") == "" {
 		log.Fatal("NSQ_LOOKUP environment variable not set")
 	}
 }
 
 func main() {
+	app := &cli.App{
+		Name:  "scanner",
+		Usage: "scan sessions from the message bus",
+		Before: func(*cli.Context) error {
+			godotenv.Load()
+			return nil
+		},
+		Flags: []cli.Flag{
+			&cli.IntFlag{Name: "workers", Value: 1, EnvVars: []string{"SCANNER_WORKERS"}, Usage: "sessions to scan at once"},
+			&cli.IntFlag{Name: "procs", EnvVars: []string{"SCANNER_PROCS"}, Usage: "scan jobs running at once across all sessions (default GOMAXPROCS)"},
+			&cli.IntFlag{Name: "max-procs", EnvVars: []string{"SCANNER_MAX_PROCS"}, Usage: "scan jobs per session when the session doesn't say"},
+			&cli.StringFlag{Name: "encoding", Value: "json", EnvVars: []string{"SCANNER_ENCODING"}, Usage: "result encoding: json, or once every consumer reads content types msgpack or protobuf"},
+			&cli.IntFlag{Name: "cache-mb", Value: geom.DefaultCacheBytes >> 20, EnvVars: []string{"SCANNER_CACHE_MB"}, Usage: "memory for lattices and zeros shared between sessions"},
+		},
+		Action:   watchCmd,
+		Commands: []*cli.Command{scan.ReplayCommand, scan.CalibrateCommand},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// watchCmd consumes session requests until the process is signaled. Up to
+// workers sessions are scanned at once, sharing the procs between them.
+func watchCmd(c *cli.Context) error {
 	checkEnv()
 
+	var enc scan.Encoding
+	enc, err := enc.GetEncoding(c.String("encoding"))
+	if err != nil {
+		return err
+	}
+	scan.ResultEncoding = enc
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	handler := scanRadiusHandler{}
+	// checkpoints let a restarted scanner resume a session part way through
+	if dir := os.Getenv("CHECKPOINT_DIR"); dir != "" {
+		log.Println("Checkpointing sessions to", dir)
+		scan.Checkpoints = scan.NewFileStore(dir)
+	}
+
+	// calibrations are shared by every session scanning the same lattice and
+	// zeros
+	if dir := os.Getenv("CALIBRATION_DIR"); dir != "" {
+		log.Println("Calibrations in", dir)
+		scan.Calibrations = scan.NewCalibrationFileStore(dir)
+	}
+
+	// sessions on the same lattice and zeros share them instead of loading
+	// their own
+	geom.SetCacheCapacity(int64(c.Int("cache-mb")) << 20)
+
+	if procs := c.Int("procs"); procs > 0 {
+		scan.SetProcs(procs)
+	}
+
+	handler := scanRadiusHandler{
+		cancels:  newCancellations(),
+		maxProcs: c.Int("max-procs"),
+	}
 
-	log.Println("Watching for sessions on", scan.SessionTopic, "publishing to", scan.ResultTopic)
-	go util.StartConsumer(ctx, scan.SessionTopic, scannerChannel, handler)
+	workers := c.Int("workers")
+	log.Println("Watching for sessions on", scan.SessionTopic, "publishing to", scan.ResultTopic, "with", workers, "workers")
+	sessions := util.NewRouter(nil).Handle(scan.SessionTopic, handler)
+	cancels := util.NewRouter(nil).Handle(scan.CancelTopic, scan.CancelHandler(handler.cancels.handleCancel))
+	go util.StartConcurrentConsumer(ctx, scan.SessionTopic, scannerChannel, sessions, workers)
+	go util.StartConsumer(ctx, scan.CancelTopic, cancelChannel(), cancels)
 
 	<-sigChan
 	cancel()
 	log.Println("\nUser cancelled")
+	return nil
 }
@@ -0,0 +1,272 @@
+package geom
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DefaultCacheBytes is the memory the process-wide cache of lattices and
+// zeros may use before it evicts the least recently used
+const DefaultCacheBytes = 1 << 30
+
+// cache holds every lattice loaded by NewLattice and every set of zeros
+// loaded by LoadZeros in this process
+var cache = NewCache(DefaultCacheBytes)
+
+// latticeKey identifies a lattice in the cache. The stamps of its files are
+// part of the key so a lattice another process saves, like the lattice CLI,
+// is loaded again rather than served from the cache.
+type latticeKey struct {
+	LatticeType LatticeType
+	VertexType  VertexType
+	Binary      fileStamp
+	Msgpack     fileStamp
+}
+
+// fileStamp tells versions of a file apart by its size and modification
+// time. A file that doesn't exist has the zero stamp.
+type fileStamp struct {
+	Size    int64
+	ModTime int64
+}
+
+func stampOf(p string) fileStamp {
+	info, err := os.Stat(p)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+var (
+	latticeKeysMut sync.Mutex
+
+	// latticeKeys holds the key each lattice was last loaded under, keyed
+	// by its types alone, so older versions are dropped from the cache
+	latticeKeys = make(map[latticeKey]latticeKey)
+)
+
+// currentLatticeKey stats the lattice's files and returns the key of the
+// version they hold, dropping any other version from the cache
+func currentLatticeKey(ltype LatticeType, vtype VertexType) latticeKey {
+	id := latticeKey{LatticeType: ltype, VertexType: vtype}
+	key := id
+	key.Binary = stampOf(LatticePath(ltype, vtype))
+	key.Msgpack = stampOf(latticePath(ltype, vtype, ".msgpack"))
+
+	latticeKeysMut.Lock()
+	defer latticeKeysMut.Unlock()
+
+	if old, ok := latticeKeys[id]; ok && old != key {
+		cache.Remove(old)
+	}
+	latticeKeys[id] = key
+	return key
+}
+
+// forgetLattice drops the lattice from the cache whichever version it is.
+// Files rewritten within the resolution of their modification time keep
+// their stamp so SaveLattice doesn't rely on it.
+func forgetLattice(ltype LatticeType, vtype VertexType) {
+	id := latticeKey{LatticeType: ltype, VertexType: vtype}
+
+	latticeKeysMut.Lock()
+	defer latticeKeysMut.Unlock()
+
+	if old, ok := latticeKeys[id]; ok {
+		cache.Remove(old)
+		delete(latticeKeys, id)
+	}
+}
+
+// zerosKey identifies a set of zeros in the cache
+type zerosKey struct {
+	ZeroType  ZeroType
+	Limit     float64
+	Scalar    float64
+	Negatives bool
+}
+
+// Cache is a concurrency-safe LRU cache bounded by the bytes its values use.
+// Values are shared by everyone who gets them so they must never be
+// modified once loaded.
+type Cache struct {
+	mut      sync.Mutex
+	capacity int64
+	used     int64
+
+	// lru holds *cacheEntry with the most recently used at the front
+	lru     *list.List
+	entries map[interface{}]*list.Element
+
+	// loading holds the loads in progress so a value is only loaded once
+	// however many goroutines ask for it
+	loading map[interface{}]*cacheLoad
+
+	hits, misses, evictions int64
+}
+
+type cacheEntry struct {
+	key   interface{}
+	value interface{}
+	size  int64
+}
+
+type cacheLoad struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// CacheStats describe what is in a Cache and how well it is doing
+type CacheStats struct {
+	Entries   int
+	Bytes     int64
+	Capacity  int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("%d entries using %.1f of %.1f MB, %d hits, %d misses, %d evictions",
+		s.Entries, float64(s.Bytes)/(1<<20), float64(s.Capacity)/(1<<20), s.Hits, s.Misses, s.Evictions)
+}
+
+// NewCache returns an empty cache that holds up to capacity bytes
+func NewCache(capacity int64) *Cache {
+	return &Cache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[interface{}]*list.Element),
+		loading:  make(map[interface{}]*cacheLoad),
+	}
+}
+
+// Get returns the value cached under key, calling load to load it and its
+// size in bytes if it isn't cached. Errors are returned but not cached.
+// Values bigger than the whole cache are returned without being cached.
+func (c *Cache) Get(key interface{}, load func() (interface{}, int64, error)) (interface{}, error) {
+	c.mut.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		c.mut.Unlock()
+		return e.Value.(*cacheEntry).value, nil
+	}
+
+	if l, ok := c.loading[key]; ok {
+		c.hits++
+		c.mut.Unlock()
+		<-l.done
+		return l.value, l.err
+	}
+
+	l := &cacheLoad{done: make(chan struct{})}
+	c.loading[key] = l
+	c.misses++
+	c.mut.Unlock()
+
+	var size int64
+	l.value, size, l.err = load()
+
+	c.mut.Lock()
+	delete(c.loading, key)
+	if l.err == nil && size <= c.capacity {
+		c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: l.value, size: size})
+		c.used += size
+		c.evict()
+	}
+	c.mut.Unlock()
+
+	close(l.done)
+	return l.value, l.err
+}
+
+// Remove drops the value cached under key so the next Get loads it again
+func (c *Cache) Remove(key interface{}) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// SetCapacity changes the bytes the cache may use, evicting values until it
+// fits
+func (c *Cache) SetCapacity(capacity int64) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.capacity = capacity
+	c.evict()
+}
+
+// Purge drops every cached value
+func (c *Cache) Purge() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Stats returns what is in the cache and how well it is doing
+func (c *Cache) Stats() CacheStats {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	return CacheStats{
+		Entries:   c.lru.Len(),
+		Bytes:     c.used,
+		Capacity:  c.capacity,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// evict drops the least recently used values until the cache fits. The lock
+// must be held.
+func (c *Cache) evict() {
+	for c.used > c.capacity && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *Cache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+}
+
+// SetCacheCapacity changes the bytes the process-wide cache of lattices and
+// zeros may use
+func SetCacheCapacity(capacity int64) {
+	cache.SetCapacity(capacity)
+}
+
+// PurgeCache drops every lattice and set of zeros this process has loaded
+func PurgeCache() {
+	cache.Purge()
+}
+
+// CacheInfo describes the process-wide cache of lattices and zeros
+func CacheInfo() CacheStats {
+	return cache.Stats()
+}
+
+// memSize is roughly the bytes a lattice uses: its points and the copy of
+// them in its index, unless the index shares them
+func (l *Lattice) memSize() int64 {
+	size := int64(len(l.Points)) * 16
+	if l.index != nil && (len(l.Points) == 0 || &l.index.points[0] != &l.Points[0]) {
+		size += int64(l.index.Len()) * 16
+	}
+	return size
+}
@@ -0,0 +1,226 @@
+package geom
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func sized(v interface{}, size int64) func() (interface{}, int64, error) {
+	return func() (interface{}, int64, error) { return v, size, nil }
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCache(100)
+	c.Get("a", sized("a", 40))
+	c.Get("b", sized("b", 40))
+	c.Get("a", sized("reloaded", 40)) // a is now the most recently used
+	c.Get("c", sized("c", 40))
+
+	if v, _ := c.Get("a", sized("reloaded", 40)); v != "a" {
+		t.Log("expected a to stay cached but it was", v)
+		t.Fail()
+	}
+
+	if v, _ := c.Get("b", sized("reloaded", 40)); v != "reloaded" {
+		t.Log("expected b to be evicted but it was", v)
+		t.Fail()
+	}
+
+	stats := c.Stats()
+	if stats.Bytes > stats.Capacity || stats.Evictions == 0 {
+		t.Log("expected the cache to fit its capacity:", stats)
+		t.Fail()
+	}
+
+	// values bigger than the cache are returned but not kept
+	c.Get("big", sized("big", 1000))
+	if v, _ := c.Get("big", sized("reloaded", 1000)); v != "reloaded" {
+		t.Log("expected a value bigger than the cache not to be cached")
+		t.Fail()
+	}
+
+	c.SetCapacity(0)
+	if stats := c.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Log("expected shrinking the cache to evict everything:", stats)
+		t.Fail()
+	}
+}
+
+func TestCacheLoadsOnce(t *testing.T) {
+	c := NewCache(100)
+	var loads int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get("key", func() (interface{}, int64, error) {
+				atomic.AddInt32(&loads, 1)
+				<-release
+				return 42, 8, nil
+			})
+			if err != nil || v != 42 {
+				t.Log("unexpected value", v, err)
+				t.Fail()
+			}
+		}()
+	}
+
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Log("expected one load but there were", loads)
+		t.Fail()
+	}
+}
+
+func TestCacheDoesNotCacheErrors(t *testing.T) {
+	c := NewCache(100)
+	failed := errors.New("failed")
+
+	if _, err := c.Get("key", func() (interface{}, int64, error) { return nil, 0, failed }); err != failed {
+		t.Log("expected the load's error but got", err)
+		t.Fail()
+	}
+
+	if v, err := c.Get("key", sized("loaded", 1)); err != nil || v != "loaded" {
+		t.Log("expected the key to load again after an error but got", v, err)
+		t.Fail()
+	}
+}
+
+func TestNewLatticeIsShared(t *testing.T) {
+	appData := os.Getenv("APP_DATA")
+	defer os.Setenv("APP_DATA", appData)
+	os.Setenv("APP_DATA", t.TempDir())
+	PurgeCache()
+	defer PurgeCache()
+
+	a, err := NewLattice(Grid, Centers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewLattice(Grid, Centers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if &a.Points[0] != &b.Points[0] || a.index != b.index {
+		t.Log("expected the second lattice to share the first one's points")
+		t.Fail()
+	}
+
+	if stats := CacheInfo(); stats.Hits != 1 || stats.Bytes != a.memSize() {
+		t.Log("expected one hit on one lattice:", stats)
+		t.Fail()
+	}
+}
+
+func TestBinaryLatticeTakesPrecedence(t *testing.T) {
+	appData := os.Getenv("APP_DATA")
+	defer os.Setenv("APP_DATA", appData)
+	os.Setenv("APP_DATA", t.TempDir())
+	PurgeCache()
+	defer PurgeCache()
+
+	generated, err := NewLattice(Grid, Vertices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Lattice{LatticeType: Grid, VertexType: Vertices, Points: []Vector2{{X: 1, Y: 2}, {X: 3, Y: 4}}}
+	if err := SaveLattice(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// saving replaces the cached lattice
+	l, err := NewLattice(Grid, Vertices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(generated.Points) == len(saved.Points) || !samePoints(append([]Vector2(nil), l.Points...), saved.Points) {
+		t.Log("expected the saved lattice but got", len(l.Points), "points")
+		t.Fail()
+	}
+}
+
+func TestLoadZerosIsShared(t *testing.T) {
+	PurgeCache()
+	defer PurgeCache()
+
+	a := Zeros{ZeroType: Primes, Scalar: 2, Negatives: true}
+	if err := LoadZeros(&a, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	b := Zeros{ZeroType: Primes, Scalar: 2, Negatives: true}
+	if err := LoadZeros(&b, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Count != b.Count || &a.Values[0] != &b.Values[0] {
+		t.Log("expected the same zeros to share their values")
+		t.Fail()
+	}
+
+	c := Zeros{ZeroType: Primes, Scalar: 2}
+	if err := LoadZeros(&c, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Count*2 != a.Count {
+		t.Log("expected zeros without negatives to be cached apart:", c.Count, a.Count)
+		t.Fail()
+	}
+}
+
+func TestNewLatticeSeesFilesSavedElsewhere(t *testing.T) {
+	appData := os.Getenv("APP_DATA")
+	defer os.Setenv("APP_DATA", appData)
+	os.Setenv("APP_DATA", t.TempDir())
+	PurgeCache()
+	defer PurgeCache()
+
+	first := Lattice{LatticeType: Grid, VertexType: Vertices, Points: []Vector2{{X: 1, Y: 2}, {X: 3, Y: 4}}}
+	if err := SaveLattice(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLattice(Grid, Vertices); err != nil {
+		t.Fatal(err)
+	}
+
+	// another process, like the lattice CLI, replaces the file without
+	// touching this process's cache
+	second := Lattice{LatticeType: Grid, VertexType: Vertices, Points: []Vector2{{X: 5, Y: 6}, {X: 7, Y: 8}, {X: 9, Y: 10}}}
+	f, err := os.Create(LatticePath(Grid, Vertices))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLattice(f, second, BinaryFormat); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err := NewLattice(Grid, Vertices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !samePoints(append([]Vector2(nil), l.Points...), second.Points) {
+		t.Fatal("expected the lattice saved elsewhere but got", len(l.Points), "points")
+	}
+
+	if stats := CacheInfo(); stats.Entries != 1 {
+		t.Log("expected the old version to be dropped from the cache:", stats)
+		t.Fail()
+	}
+}
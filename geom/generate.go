@@ -0,0 +1,371 @@
+package geom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// GridParameters describe a square or hexagonal grid centered on the origin
+type GridParameters struct {
+	// Spacing is the distance between neighboring vertices
+	Spacing float64
+
+	// Hex makes a honeycomb of hexagons instead of a grid of squares
+	Hex bool
+
+	// Size is half the width of the square area the grid covers
+	Size float64
+}
+
+// FibonacciParameters describe a sunflower spiral of seeds around the origin
+type FibonacciParameters struct {
+	// Count is the number of seeds
+	Count int
+
+	// Spacing scales the spiral so seeds are about Spacing apart
+	Spacing float64
+}
+
+// PenroseParameters describe a Penrose rhombus (P3) tiling built from a de
+// Bruijn pentagrid
+type PenroseParameters struct {
+	// Lines is the number of pentagrid lines on each side of the origin in
+	// each of the five directions
+	Lines int
+
+	// Scale is the edge length of the rhombi
+	Scale float64
+
+	// Offsets shift the five grids. They must sum to an integer for the
+	// tiling to be a Penrose tiling and should be generic so no three lines
+	// meet at a point.
+	Offsets [5]float64
+}
+
+// PinwheelParameters describe a pinwheel tiling made by substituting a 1x2
+// rectangle of two triangles Depth times
+type PinwheelParameters struct {
+	Depth int
+
+	// Scale is the short leg of the smallest triangles
+	Scale float64
+}
+
+// DefaultParameters returns the parameters NewLattice generates a lattice
+// type with when there is no lattice file for it
+func DefaultParameters(ltype LatticeType) interface{} {
+	switch ltype {
+	case Pinwheel:
+		return PinwheelParameters{Depth: 6, Scale: 1}
+	case Fibonacci:
+		return FibonacciParameters{Count: 100000, Spacing: 1}
+	case Grid:
+		return GridParameters{Spacing: 1, Size: 150}
+	case Penrose:
+		return PenroseParameters{Lines: 40, Scale: 1, Offsets: [5]float64{.1, .27, .13, .32, .18}}
+	default:
+		return nil
+	}
+}
+
+// GenerateLattice generates the Points of a lattice from its parameters, or
+// from DefaultParameters when params is nil. The same parameters always give
+// the same Points in the same order.
+func GenerateLattice(ltype LatticeType, vtype VertexType, params interface{}) (Lattice, error) {
+	if params == nil {
+		params = DefaultParameters(ltype)
+	}
+
+	if vtype != Vertices && vtype != Centers {
+		return Lattice{}, errors.New("Unknown vertex type")
+	}
+
+	if fmt.Sprintf("%T", params) != fmt.Sprintf("%T", DefaultParameters(ltype)) {
+		return Lattice{}, fmt.Errorf("%T parameters do not describe a %v lattice", params, ltype)
+	}
+
+	var points []Vector2
+	var err error
+
+	switch p := params.(type) {
+	case GridParameters:
+		points, err = generateGrid(p, vtype)
+	case FibonacciParameters:
+		points, err = generateFibonacci(p, vtype)
+	case PenroseParameters:
+		points, err = generatePenrose(p, vtype)
+	case PinwheelParameters:
+		points, err = generatePinwheel(p, vtype)
+	default:
+		err = fmt.Errorf("no generator for %T parameters", params)
+	}
+
+	if err != nil {
+		return Lattice{}, err
+	}
+
+	l := Lattice{
+		LatticeType: ltype,
+		VertexType:  vtype,
+		Parameters:  params,
+		Points:      points,
+	}
+	l.index = NewKDTree(l.Points)
+
+	return l, nil
+}
+
+// pointSet collects points, dropping any that land on one already collected
+// because they were reached from a neighboring cell or tile
+type pointSet struct {
+	quantum float64
+	seen    map[[2]int64]bool
+	points  []Vector2
+}
+
+func newPointSet(scale float64) *pointSet {
+	return &pointSet{quantum: scale * 1e-6, seen: make(map[[2]int64]bool)}
+}
+
+func (s *pointSet) add(p Vector2) {
+	key := [2]int64{int64(math.Round(p.X / s.quantum)), int64(math.Round(p.Y / s.quantum))}
+	if s.seen[key] {
+		return
+	}
+	s.seen[key] = true
+	s.points = append(s.points, p)
+}
+
+// generateGrid makes the vertices, or cell centers, of a grid of squares or
+// hexagons inside the square of half width Size
+func generateGrid(p GridParameters, vtype VertexType) ([]Vector2, error) {
+	if p.Spacing <= 0 || p.Size < p.Spacing {
+		return nil, errors.New("grid needs a positive spacing no larger than its size")
+	}
+
+	inside := func(v Vector2) bool {
+		return math.Abs(v.X) <= p.Size+p.Spacing*1e-9 && math.Abs(v.Y) <= p.Size+p.Spacing*1e-9
+	}
+
+	set := newPointSet(p.Spacing)
+
+	if !p.Hex {
+		n := int(math.Floor(p.Size / p.Spacing))
+		offset := 0.0
+		if vtype == Centers {
+			offset = p.Spacing / 2
+		}
+
+		for j := -n; j <= n; j++ {
+			for i := -n; i <= n; i++ {
+				v := Vector2{X: float64(i)*p.Spacing + offset, Y: float64(j)*p.Spacing + offset}
+				if inside(v) {
+					set.add(v)
+				}
+			}
+		}
+		return set.points, nil
+	}
+
+	// pointy topped hexagons with edges Spacing long, whose centers form a
+	// triangular lattice
+	width := math.Sqrt(3) * p.Spacing
+	rowHeight := 1.5 * p.Spacing
+	rows := int(math.Ceil(p.Size/rowHeight)) + 1
+	cols := int(math.Ceil(p.Size/width)) + 1
+
+	for j := -rows; j <= rows; j++ {
+		for i := -cols; i <= cols; i++ {
+			center := Vector2{X: float64(i) * width, Y: float64(j) * rowHeight}
+			if j%2 != 0 {
+				center.X += width / 2
+			}
+
+			if vtype == Centers {
+				if inside(center) {
+					set.add(center)
+				}
+				continue
+			}
+
+			for k := 0; k < 6; k++ {
+				a := math.Pi/6 + float64(k)*math.Pi/3
+				v := center.Add(Vector2{X: math.Cos(a), Y: math.Sin(a)}.Scale(p.Spacing))
+				if inside(v) {
+					set.add(v)
+				}
+			}
+		}
+	}
+
+	return set.points, nil
+}
+
+// goldenAngle is the angle between successive seeds of a sunflower
+var goldenAngle = math.Pi * (3 - math.Sqrt(5))
+
+// generateFibonacci makes Vogel's sunflower spiral. Its centers are the
+// points half way along the spiral between consecutive seeds.
+func generateFibonacci(p FibonacciParameters, vtype VertexType) ([]Vector2, error) {
+	if p.Count <= 0 || p.Spacing <= 0 {
+		return nil, errors.New("fibonacci spiral needs a positive count and spacing")
+	}
+
+	offset, count := 0.0, p.Count
+	if vtype == Centers {
+		offset, count = .5, p.Count-1
+	}
+
+	points := make([]Vector2, 0, count)
+	for i := 0; i < count; i++ {
+		n := float64(i) + offset
+		r := p.Spacing * math.Sqrt(n)
+		a := n * goldenAngle
+		points = append(points, Vector2{X: r * math.Cos(a), Y: r * math.Sin(a)})
+	}
+
+	return points, nil
+}
+
+// generatePenrose makes a P3 tiling with de Bruijn's pentagrid method. Every
+// crossing of two grid lines is a rhombus whose corners come from the grid
+// cells around the crossing. Only crossings well inside the pentagrid are
+// kept, so the tiling has no holes.
+func generatePenrose(p PenroseParameters, vtype VertexType) ([]Vector2, error) {
+	if p.Lines < 2 || p.Scale <= 0 {
+		return nil, errors.New("penrose tiling needs at least 2 lines and a positive scale")
+	}
+
+	var e [5]Vector2
+	for i := range e {
+		a := 2 * math.Pi * float64(i) / 5
+		e[i] = Vector2{X: math.Cos(a), Y: math.Sin(a)}
+	}
+
+	limit := float64(p.Lines - 1)
+	set := newPointSet(p.Scale)
+
+	for r := 0; r < 5; r++ {
+		for s := r + 1; s < 5; s++ {
+			det := e[r].X*e[s].Y - e[r].Y*e[s].X
+
+			for kr := -p.Lines; kr <= p.Lines; kr++ {
+				for ks := -p.Lines; ks <= p.Lines; ks++ {
+					// the crossing of x·e[r] + Offsets[r] = kr and
+					// x·e[s] + Offsets[s] = ks
+					cr := float64(kr) - p.Offsets[r]
+					cs := float64(ks) - p.Offsets[s]
+					x := Vector2{
+						X: (cr*e[s].Y - cs*e[r].Y) / det,
+						Y: (cs*e[r].X - cr*e[s].X) / det,
+					}
+
+					if x.Length() > limit {
+						continue
+					}
+
+					var k [5]float64
+					for i := range k {
+						k[i] = math.Ceil(x.Dot(e[i]) + p.Offsets[i])
+					}
+
+					corners := [4][2]float64{
+						{float64(kr), float64(ks)},
+						{float64(kr + 1), float64(ks)},
+						{float64(kr + 1), float64(ks + 1)},
+						{float64(kr), float64(ks + 1)},
+					}
+
+					center := Vector2{}
+					for _, c := range corners {
+						k[r], k[s] = c[0], c[1]
+
+						v := Vector2{}
+						for i := range k {
+							v = v.Add(e[i].Scale(k[i] * p.Scale))
+						}
+
+						if vtype == Vertices {
+							set.add(v)
+						}
+						center = center.Add(v)
+					}
+
+					if vtype == Centers {
+						set.add(center.Div(4))
+					}
+				}
+			}
+		}
+	}
+
+	return set.points, nil
+}
+
+// pinwheelTile is a right triangle with legs in the ratio 1:2
+type pinwheelTile struct {
+	right Vector2 // corner with the right angle
+	long  Vector2 // far end of the long leg
+	short Vector2 // far end of the short leg
+}
+
+// subdivide splits the tile into the five tiles of the pinwheel
+// substitution, each smaller by a factor of √5. The altitude to the
+// hypotenuse cuts off one of them and a tile twice their size, which splits
+// into four at the midpoints of its sides.
+func (t pinwheelTile) subdivide(dst []pinwheelTile) []pinwheelTile {
+	foot := t.long.Add(t.short.Sub(t.long).Scale(.8))
+
+	dst = append(dst, pinwheelTile{right: foot, long: t.right, short: t.short})
+
+	r, l, s := foot, t.long, t.right
+	rl := r.Add(l).Scale(.5)
+	rs := r.Add(s).Scale(.5)
+	ls := l.Add(s).Scale(.5)
+
+	return append(dst,
+		pinwheelTile{right: r, long: rl, short: rs},
+		pinwheelTile{right: rl, long: l, short: ls},
+		pinwheelTile{right: rs, long: ls, short: s},
+		pinwheelTile{right: ls, long: rs, short: rl},
+	)
+}
+
+// generatePinwheel substitutes a rectangle made of two tiles Depth times.
+// The centers are the centroids of the tiles.
+func generatePinwheel(p PinwheelParameters, vtype VertexType) ([]Vector2, error) {
+	if p.Depth < 0 || p.Depth > 10 || p.Scale <= 0 {
+		return nil, errors.New("pinwheel tiling needs a depth from 0 to 10 and a positive scale")
+	}
+
+	// size the rectangle so the last tiles have a short leg of Scale, and
+	// center it on the origin
+	side := p.Scale * math.Pow(math.Sqrt(5), float64(p.Depth))
+	a := Vector2{X: -side, Y: -side / 2}
+	b := Vector2{X: side, Y: -side / 2}
+	c := Vector2{X: side, Y: side / 2}
+	d := Vector2{X: -side, Y: side / 2}
+
+	tiles := []pinwheelTile{{right: a, long: b, short: d}, {right: c, long: d, short: b}}
+	for i := 0; i < p.Depth; i++ {
+		next := make([]pinwheelTile, 0, len(tiles)*5)
+		for _, t := range tiles {
+			next = t.subdivide(next)
+		}
+		tiles = next
+	}
+
+	set := newPointSet(p.Scale)
+	for _, t := range tiles {
+		if vtype == Centers {
+			set.add(t.right.Add(t.long).Add(t.short).Div(3))
+			continue
+		}
+		set.add(t.right)
+		set.add(t.long)
+		set.add(t.short)
+	}
+
+	return set.points, nil
+}
@@ -0,0 +1,145 @@
+package geom
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func testGenerators() map[LatticeType]interface{} {
+	return map[LatticeType]interface{}{
+		Pinwheel:  PinwheelParameters{Depth: 3, Scale: 1},
+		Fibonacci: FibonacciParameters{Count: 500, Spacing: 1},
+		Grid:      GridParameters{Spacing: 2, Size: 10},
+		Penrose:   DefaultParameters(Penrose).(PenroseParameters),
+	}
+}
+
+func TestGeneratorsAreDeterministic(t *testing.T) {
+	for ltype, params := range testGenerators() {
+		for _, vtype := range VertexTypes {
+			a, err := GenerateLattice(ltype, vtype, params)
+			if err != nil {
+				t.Fatal(ltype, vtype, err)
+			}
+
+			b, err := GenerateLattice(ltype, vtype, params)
+			if err != nil {
+				t.Fatal(ltype, vtype, err)
+			}
+
+			if len(a.Points) == 0 || !reflect.DeepEqual(a.Points, b.Points) {
+				t.Log(ltype, vtype, "generated different points from the same parameters")
+				t.Fail()
+			}
+
+			if a.LatticeType != ltype || a.VertexType != vtype || a.Parameters != params {
+				t.Log(ltype, vtype, "lattice does not describe how it was generated")
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestGeneratorsMakeDistinctPoints(t *testing.T) {
+	for ltype, params := range testGenerators() {
+		for _, vtype := range VertexTypes {
+			l, err := GenerateLattice(ltype, vtype, params)
+			if err != nil {
+				t.Fatal(ltype, vtype, err)
+			}
+
+			for _, p := range l.Points {
+				if near := l.Index().Radius(p, 1e-3, nil); len(near) != 1 {
+					t.Log(ltype, vtype, "has", len(near), "points at", p)
+					t.Fail()
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestGenerateGrid(t *testing.T) {
+	l, err := GenerateLattice(Grid, Vertices, GridParameters{Spacing: 2, Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Points) != 11*11 {
+		t.Log("expected 121 grid vertices but got", len(l.Points))
+		t.Fail()
+	}
+
+	l, err = GenerateLattice(Grid, Centers, GridParameters{Spacing: 2, Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Points) != 10*10 {
+		t.Log("expected 100 grid centers but got", len(l.Points))
+		t.Fail()
+	}
+
+	// every honeycomb vertex has a neighbor one edge away
+	l, err = GenerateLattice(Grid, Vertices, GridParameters{Spacing: 1, Hex: true, Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range l.Points {
+		if near := l.Index().Radius(p, 1.01, nil); len(near) < 2 {
+			t.Log("hex vertex", p, "has no neighbors")
+			t.Fail()
+			break
+		}
+	}
+}
+
+func TestGeneratePinwheel(t *testing.T) {
+	l, err := GenerateLattice(Pinwheel, Centers, PinwheelParameters{Depth: 3, Scale: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l.Points) != 2*125 {
+		t.Log("expected a center for each of 250 tiles but got", len(l.Points))
+		t.Fail()
+	}
+
+	// the tiles still cover the starting rectangle
+	side := math.Pow(math.Sqrt(5), 3)
+	for _, p := range l.Points {
+		if math.Abs(p.X) > side || math.Abs(p.Y) > side/2 {
+			t.Log("pinwheel center", p, "escaped the rectangle")
+			t.Fail()
+			break
+		}
+	}
+}
+
+func TestGeneratePenrose(t *testing.T) {
+	l, err := GenerateLattice(Penrose, Vertices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no two vertices are closer than the short diagonal of a thin rhombus
+	short := 2 * math.Sin(math.Pi/10)
+	for _, p := range l.Points {
+		if near := l.Index().Radius(p, short*.99, nil); len(near) != 1 {
+			t.Log("penrose vertex", p, "is too close to another")
+			t.Fail()
+			break
+		}
+	}
+}
+
+func TestGenerateRejectsMismatchedParameters(t *testing.T) {
+	if _, err := GenerateLattice(Penrose, Vertices, GridParameters{Spacing: 1, Size: 10}); err == nil {
+		t.Log("expected an error generating a penrose lattice from grid parameters")
+		t.Fail()
+	}
+
+	if _, err := GenerateLattice(Grid, Vertices, GridParameters{}); err == nil {
+		t.Log("expected an error generating a grid without a spacing")
+		t.Fail()
+	}
+}
@@ -1,13 +1,21 @@
 package geom
 
-import "sort"
+import (
+	"math"
+	"sort"
+)
 
+// makeHull returns the convex hull of the points. It sorts a copy because
+// lattice points are shared and must not be reordered.
 func makeHull(points []Vector2) []Vector2 {
-	sort.Slice(points, func(a, b int) bool {
-		return points[a].X > points[b].X || points[a].Y > points[a].Y
+	sorted := make([]Vector2, len(points))
+	copy(sorted, points)
+
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].X < sorted[b].X || (sorted[a].X == sorted[b].X && sorted[a].Y < sorted[b].Y)
 	})
 
-	return makeHullPresorted(points)
+	return makeHullPresorted(sorted)
 }
 
 func sequenceEq(a, b []Vector2) bool {
@@ -78,13 +86,17 @@ func makeHullPresorted(points []Vector2) []Vector2 {
 	return upperHull
 }
 
-// line defined by two Points
-// pnt - the Vector2 to find nearest Vector2 on line for
+// line segment defined by two Points
+// pnt - the Vector2 to find nearest Vector2 on the segment for
 func nearestPointOnLine(linePnt, linep2, pnt Vector2) Vector2 {
-	lineDir := linep2.Sub(linePnt).Normalize() // needs to be unit vec
-	v := pnt.Sub(linePnt)
-	d := v.Dot(lineDir)
-	return linePnt.Add(lineDir).Scale(d)
+	line := linep2.Sub(linePnt)
+	lengthSq := line.Dot(line)
+	if lengthSq == 0 {
+		return linePnt
+	}
+
+	d := math.Max(0, math.Min(1, pnt.Sub(linePnt).Dot(line)/lengthSq))
+	return linePnt.Add(line.Scale(d))
 }
 
 func pointInPolygon(pts []Vector2, p Vector2) bool {
@@ -0,0 +1,204 @@
+package geom
+
+import "math"
+
+// KDTree is a static 2-d tree over a set of points. It is built once and then
+// answers radius and bounding box queries without visiting every point.
+//
+// The tree is stored implicitly: the points are reordered so the median of
+// every range [lo, hi) sits at (lo+hi)/2, split on X at even depths and on Y
+// at odd depths. No node pointers are allocated.
+type KDTree struct {
+	points []Vector2
+}
+
+// NewKDTree builds a tree over a copy of the given points. The original slice
+// is left untouched.
+func NewKDTree(points []Vector2) *KDTree {
+	t := &KDTree{points: make([]Vector2, len(points))}
+	copy(t.points, points)
+	t.build(0, len(t.points), 0)
+	return t
+}
+
+// Len returns the number of points in the tree
+func (t *KDTree) Len() int {
+	return len(t.points)
+}
+
+func (t *KDTree) build(lo, hi, depth int) {
+	if hi-lo <= 1 {
+		return
+	}
+
+	mid := (lo + hi) / 2
+	selectNth(t.points[lo:hi], mid-lo, depth%2 == 0)
+
+	t.build(lo, mid, depth+1)
+	t.build(mid+1, hi, depth+1)
+}
+
+// selectNth partially orders pts so that pts[n] is the element that would be
+// there if pts were fully sorted on the chosen axis, with everything before it
+// less than or equal and everything after it greater than or equal.
+func selectNth(pts []Vector2, n int, xAxis bool) {
+	key := func(i int) float64 {
+		if xAxis {
+			return pts[i].X
+		}
+		return pts[i].Y
+	}
+
+	lo, hi := 0, len(pts)-1
+	for lo < hi {
+		// median of three pivot keeps already sorted lattices from going
+		// quadratic
+		mid := (lo + hi) / 2
+		if key(mid) < key(lo) {
+			pts[mid], pts[lo] = pts[lo], pts[mid]
+		}
+		if key(hi) < key(lo) {
+			pts[hi], pts[lo] = pts[lo], pts[hi]
+		}
+		if key(hi) < key(mid) {
+			pts[hi], pts[mid] = pts[mid], pts[hi]
+		}
+		pivot := key(mid)
+
+		i, j := lo, hi
+		for i <= j {
+			for key(i) < pivot {
+				i++
+			}
+			for key(j) > pivot {
+				j--
+			}
+			if i <= j {
+				pts[i], pts[j] = pts[j], pts[i]
+				i++
+				j--
+			}
+		}
+
+		switch {
+		case n <= j:
+			hi = j
+		case n >= i:
+			lo = i
+		default:
+			return
+		}
+	}
+}
+
+// Radius appends to dst every point whose distance from center is at most
+// radius and returns the extended slice.
+func (t *KDTree) Radius(center Vector2, radius float64, dst []Vector2) []Vector2 {
+	return t.radius(0, len(t.points), 0, center, radius, dst)
+}
+
+func (t *KDTree) radius(lo, hi, depth int, center Vector2, r float64, dst []Vector2) []Vector2 {
+	if lo >= hi {
+		return dst
+	}
+
+	mid := (lo + hi) / 2
+	pt := t.points[mid]
+
+	// same test Lattice.Filter has always used so the indexed and linear
+	// versions agree on points that sit right on the boundary
+	distance := math.Sqrt((pt.X-center.X)*(pt.X-center.X) + (pt.Y-center.Y)*(pt.Y-center.Y))
+	if distance <= r {
+		dst = append(dst, pt)
+	}
+
+	var delta float64
+	if depth%2 == 0 {
+		delta = center.X - pt.X
+	} else {
+		delta = center.Y - pt.Y
+	}
+
+	if delta <= r {
+		dst = t.radius(lo, mid, depth+1, center, r, dst)
+	}
+	if delta >= -r {
+		dst = t.radius(mid+1, hi, depth+1, center, r, dst)
+	}
+
+	return dst
+}
+
+// Box appends to dst every point inside the axis aligned box [min, max]
+// (inclusive) and returns the extended slice.
+func (t *KDTree) Box(min, max Vector2, dst []Vector2) []Vector2 {
+	return t.box(0, len(t.points), 0, min, max, dst)
+}
+
+func (t *KDTree) box(lo, hi, depth int, min, max Vector2, dst []Vector2) []Vector2 {
+	if lo >= hi {
+		return dst
+	}
+
+	mid := (lo + hi) / 2
+	pt := t.points[mid]
+
+	if pt.X >= min.X && pt.X <= max.X && pt.Y >= min.Y && pt.Y <= max.Y {
+		dst = append(dst, pt)
+	}
+
+	var split, kmin, kmax float64
+	if depth%2 == 0 {
+		split, kmin, kmax = pt.X, min.X, max.X
+	} else {
+		split, kmin, kmax = pt.Y, min.Y, max.Y
+	}
+
+	if kmin <= split {
+		dst = t.box(lo, mid, depth+1, min, max, dst)
+	}
+	if kmax >= split {
+		dst = t.box(mid+1, hi, depth+1, min, max, dst)
+	}
+
+	return dst
+}
+
+// AnyWithin reports whether at least one point lies within radius of center.
+// It stops at the first point found.
+func (t *KDTree) AnyWithin(center Vector2, radius float64) bool {
+	return t.anyWithin(0, len(t.points), 0, center, radius)
+}
+
+func (t *KDTree) anyWithin(lo, hi, depth int, center Vector2, r float64) bool {
+	if lo >= hi {
+		return false
+	}
+
+	mid := (lo + hi) / 2
+	pt := t.points[mid]
+
+	if (pt.X-center.X)*(pt.X-center.X)+(pt.Y-center.Y)*(pt.Y-center.Y) <= r*r {
+		return true
+	}
+
+	var delta float64
+	if depth%2 == 0 {
+		delta = center.X - pt.X
+	} else {
+		delta = center.Y - pt.Y
+	}
+
+	// search the side the center is on first
+	if delta <= 0 {
+		if t.anyWithin(lo, mid, depth+1, center, r) {
+			return true
+		}
+		return delta >= -r && t.anyWithin(mid+1, hi, depth+1, center, r)
+	}
+
+	if t.anyWithin(mid+1, hi, depth+1, center, r) {
+		return true
+	}
+	return delta <= r && t.anyWithin(lo, mid, depth+1, center, r)
+}
@@ -0,0 +1,174 @@
+package geom
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// filterLinear is the original brute force Lattice.Filter. It is kept here as
+// the reference the index is checked and benchmarked against.
+func filterLinear(l *Lattice, origin Vector2, radius float64, maxZero float64, distanceLimit float64) []Vector2 {
+	points := make([]Vector2, 0, len(l.Points))
+	r := math.Sqrt((radius+maxZero)*(radius+maxZero) + distanceLimit*distanceLimit)
+
+	for _, pt := range l.Points {
+		distance := math.Sqrt((pt.X-origin.X)*(pt.X-origin.X) + (pt.Y-origin.Y)*(pt.Y-origin.Y))
+		if math.Abs(distance) <= r {
+			points = append(points, pt)
+		}
+	}
+
+	return points
+}
+
+func randPoints(n int, extent float64) []Vector2 {
+	rnd := rand.New(rand.NewSource(42))
+	pts := make([]Vector2, n)
+	for i := range pts {
+		pts[i] = Vector2{
+			X: (rnd.Float64()*2 - 1) * extent,
+			Y: (rnd.Float64()*2 - 1) * extent,
+		}
+	}
+
+	// a few duplicates and points on a line to exercise equal keys
+	for i := 0; i < n/10; i++ {
+		pts[i] = Vector2{X: float64(i % 7), Y: 1}
+	}
+
+	return pts
+}
+
+func sortPoints(pts []Vector2) {
+	sort.Slice(pts, func(a, b int) bool {
+		if pts[a].X != pts[b].X {
+			return pts[a].X < pts[b].X
+		}
+		return pts[a].Y < pts[b].Y
+	})
+}
+
+func samePoints(a, b []Vector2) bool {
+	sortPoints(a)
+	sortPoints(b)
+	return sequenceEq(a, b)
+}
+
+func TestKDTreeEmpty(t *testing.T) {
+	tree := NewKDTree(nil)
+
+	if pts := tree.Radius(Vector2{}, 10, nil); len(pts) != 0 {
+		t.Log("expected no points from an empty tree but got", len(pts))
+		t.Fail()
+	}
+
+	if tree.AnyWithin(Vector2{}, 10) {
+		t.Log("expected AnyWithin to be false on an empty tree")
+		t.Fail()
+	}
+}
+
+func TestKDTreeRadiusMatchesLinear(t *testing.T) {
+	l := Lattice{Points: randPoints(5000, 50)}
+
+	for _, r := range []float64{0, .5, 3, 17, 200} {
+		for _, origin := range []Vector2{{}, {X: 3, Y: 1}, {X: -49, Y: 49}, {X: 80, Y: 0}} {
+			expected := filterLinear(&l, origin, r, 0, 0)
+			actual := l.Filter(origin, r, 0, 0)
+
+			if !samePoints(expected, actual) {
+				t.Log("radius", r, "origin", origin, "expected", len(expected), "points but got", len(actual))
+				t.Fail()
+			}
+
+			if l.Index().AnyWithin(origin, r) != (len(expected) > 0) {
+				t.Log("AnyWithin disagrees with linear scan at radius", r, "origin", origin)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestKDTreeBox(t *testing.T) {
+	pts := randPoints(5000, 50)
+	tree := NewKDTree(pts)
+
+	min := Vector2{X: -10, Y: 0}
+	max := Vector2{X: 25, Y: 4}
+
+	expected := make([]Vector2, 0)
+	for _, pt := range pts {
+		if pt.X >= min.X && pt.X <= max.X && pt.Y >= min.Y && pt.Y <= max.Y {
+			expected = append(expected, pt)
+		}
+	}
+
+	actual := tree.Box(min, max, nil)
+	if !samePoints(expected, actual) {
+		t.Log("expected", len(expected), "points in the box but got", len(actual))
+		t.Fail()
+	}
+}
+
+func TestNewKDTreeDoesNotReorderInput(t *testing.T) {
+	pts := randPoints(100, 10)
+	orig := make([]Vector2, len(pts))
+	copy(orig, pts)
+
+	NewKDTree(pts)
+
+	if !sequenceEq(pts, orig) {
+		t.Log("NewKDTree modified the caller's slice")
+		t.Fail()
+	}
+}
+
+func BenchmarkFilterLinear(b *testing.B) {
+	lattice, err := loadLattice(Pinwheel, Vertices)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filterLinear(&lattice, Vector2{}, 1, 100, 1)
+	}
+}
+
+func BenchmarkFilterIndexed(b *testing.B) {
+	lattice, err := loadLattice(Pinwheel, Vertices)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lattice.Filter(Vector2{}, 1, 100, 1)
+	}
+}
+
+func BenchmarkBuildKDTree(b *testing.B) {
+	lattice, err := loadLattice(Pinwheel, Vertices)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewKDTree(lattice.Points)
+	}
+}
+
+func BenchmarkPartition(b *testing.B) {
+	lattice, err := loadLattice(Pinwheel, Vertices)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lattice.Partition(50)
+	}
+}
@@ -18,6 +18,10 @@ type Lattice struct {
 	Parameters  interface{}
 
 	Points []Vector2 `json:"-"`
+
+	// index answers spatial queries over Points. It is built when the
+	// lattice is loaded and is never serialized.
+	index *KDTree
 }
 
 // LatticeType enumeration
@@ -40,6 +44,9 @@ const (
 	Penrose
 )
 
+// LatticeTypes is a convenience for enumerating all LatticeTypes
+var LatticeTypes = []LatticeType{Pinwheel, Fibonacci, Grid, Penrose}
+
 // String returns the stringified version of a LatticeType
 func (lt LatticeType) String() string {
 	return [...]string{
@@ -71,26 +78,73 @@ const (
 	Centers
 )
 
+// VertexTypes is a convenience for enumerating all VertexTypes
+var VertexTypes = []VertexType{Vertices, Centers}
+
 func (vt VertexType) String() string {
 	return [...]string{
 		"Vertices", "Centers",
 	}[vt]
 }
 
+// GetVType returns the vertex type from its string representation
+func (vt VertexType) GetVType(name string) (VertexType, error) {
+	switch strings.ToLower(name) {
+	case "vertices", "vertex":
+		return Vertices, nil
+	case "centers", "center":
+		return Centers, nil
+	default:
+		return 0, errors.New("Unknown vertex type")
+	}
+}
+
 // NewLattice loads or generates lattice Points. If the lattice is generated,
-// the default lattice parameters are used
+// the default lattice parameters are used. Lattices are cached for the whole
+// process so the Points are shared and must not be modified. A lattice file
+// that changes, even in another process, is loaded again.
 func NewLattice(ltype LatticeType, vtype VertexType) (Lattice, error) {
-	// we will eventually generate lattices but the current set are loaded
-	// from files
-	return loadLattice(ltype, vtype)
+	v, err := cache.Get(currentLatticeKey(ltype, vtype), func() (interface{}, int64, error) {
+		l, err := findLattice(ltype, vtype)
+		return l, l.memSize(), err
+	})
+	if err != nil {
+		return Lattice{}, err
+	}
+	return v.(Lattice), nil
 }
 
-func loadLattice(ltype LatticeType, vtype VertexType) (Lattice, error) {
+// findLattice loads the lattice from the binary file SaveLattice writes, or
+// else from the msgpack file, or generates it when there is neither
+func findLattice(ltype LatticeType, vtype VertexType) (Lattice, error) {
+	l, err := loadBinaryLattice(LatticePath(ltype, vtype))
+	if !os.IsNotExist(err) {
+		return l, err
+	}
+
+	// lattice files take precedence so existing scans keep their Points
+	l, err = loadLattice(ltype, vtype)
+	if os.IsNotExist(err) {
+		return GenerateLattice(ltype, vtype, nil)
+	}
+	return l, err
+}
+
+// LatticePath is the binary file SaveLattice writes and NewLattice loads
+// first
+func LatticePath(ltype LatticeType, vtype VertexType) string {
+	return latticePath(ltype, vtype, ".lattice")
+}
+
+func latticePath(ltype LatticeType, vtype VertexType, ext string) string {
 	lstr := strings.ToLower(ltype.String())
 	vstr := strings.ToLower(vtype.String())
+	return path.Join(os.Getenv("APP_DATA"), "lattices", lstr+"."+vstr+ext)
+}
 
+func loadLattice(ltype LatticeType, vtype VertexType) (Lattice, error) {
 	var err error
-	p := path.Join(os.Getenv("APP_DATA"), "lattices", lstr+"."+vstr+".msgpack")
+	p := latticePath(ltype, vtype, ".msgpack")
 	l := Lattice{}
 
 	b, err := ioutil.ReadFile(p)
@@ -102,27 +156,30 @@ func loadLattice(ltype LatticeType, vtype VertexType) (Lattice, error) {
 		return l, err
 	}
 
+	l.index = NewKDTree(l.Points)
+
 	return l, nil
 }
 
+// Index returns the spatial index over the lattice Points, building it first
+// if the lattice was not created by NewLattice. Building is not safe to do
+// concurrently so lattices shared between goroutines should come from
+// NewLattice.
+func (l *Lattice) Index() *KDTree {
+	if l.index == nil || l.index.Len() != len(l.Points) {
+		l.index = NewKDTree(l.Points)
+	}
+	return l.index
+}
+
 // Filter filters out Points that are not candidates for scanning
 func (l *Lattice) Filter(origin Vector2, radius float64, maxZero float64, distanceLimit float64) []Vector2 {
 
-	Points := make([]Vector2, 0, len(l.Points))
-
 	// Calculate the radius based on ZLines selected and DistanceLimit
 	// Double it because the origin can be at the edge of this
 	r := math.Sqrt((radius+maxZero)*(radius+maxZero) + distanceLimit*distanceLimit)
 
-	for _, pt := range l.Points {
-		// if its in the radius, copy the Vector2 and move the index
-		distance := math.Sqrt((pt.X-origin.X)*(pt.X-origin.X) + (pt.Y-origin.Y)*(pt.Y-origin.Y))
-		if math.Abs(distance) <= r {
-			Points = append(Points, pt)
-		}
-	}
-
-	return Points
+	return l.Index().Radius(origin, r, make([]Vector2, 0, 256))
 }
 
 func (l *Lattice) Bounds() BoundingBox {
@@ -130,12 +187,14 @@ func (l *Lattice) Bounds() BoundingBox {
 }
 
 // Partition finds all origins that with the given radius, will cover
-// the entire lattice.
+// the entire lattice. Circles that miss the convex hull of the lattice are
+// dropped.
 // We are doing the hexogonal tiling with circles over the lattice:
 // from https://stackoverflow.com/questions/7716460/fully-cover-a-rectangle-with-minimum-amount-of-fixed-radius-circles
 func (l *Lattice) Partition(radius float64) []Vector2 {
 
 	diameter := radius * 2
+	index := l.Index()
 	hull := makeHull(l.Points)
 	bounds := l.Bounds()
 	bmax := bounds.Max()
@@ -146,8 +205,9 @@ func (l *Lattice) Partition(radius float64) []Vector2 {
 	point := bounds.Min()
 
 	for point.Y <= bmax.Y+radius {
-		intersects := circleIntersectsPolygon(hull, point, radius)
-		if intersects {
+		// a circle holding a lattice point meets the hull, so the index
+		// answers most circles without testing every edge of the hull
+		if index.AnyWithin(point, radius) || circleIntersectsPolygon(hull, point, radius) {
 			origins = append(origins, point)
 		}
 
@@ -1,7 +1,7 @@
 package geom
 
 import (
-	"os"
+	"reflect"
 	"testing"
 )
 
@@ -26,3 +26,61 @@ func TestCanLoadPinwheelVertices(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPartitionCoversLattice(t *testing.T) {
+	l, err := GenerateLattice(Fibonacci, Vertices, FibonacciParameters{Count: 2000, Spacing: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := append([]Vector2(nil), l.Points...)
+
+	radius := 5.0
+	origins := l.Partition(radius)
+	hull := makeHull(l.Points)
+
+	for _, o := range origins {
+		if !circleIntersectsPolygon(hull, o, radius) {
+			t.Log("origin", o, "misses the hull of the lattice")
+			t.Fail()
+			break
+		}
+	}
+
+	covered := NewKDTree(origins)
+	for _, p := range l.Points {
+		if !covered.AnyWithin(p, radius) {
+			t.Log("lattice point", p, "is not covered by any origin")
+			t.Fail()
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(points, l.Points) {
+		t.Log("partitioning reordered the lattice points")
+		t.Fail()
+	}
+}
+
+func TestCircleIntersectsHull(t *testing.T) {
+	hull := makeHull([]Vector2{{X: 0, Y: 0}, {X: 10, Y: 0}, {X: 10, Y: 10}, {X: 0, Y: 10}, {X: 5, Y: 5}})
+	if len(hull) != 4 {
+		t.Log("expected a square hull but got", hull)
+		t.Fail()
+	}
+
+	for _, c := range []struct {
+		center Vector2
+		want   bool
+	}{
+		{Vector2{X: 5, Y: 5}, true},   // inside
+		{Vector2{X: 12, Y: 5}, true},  // reaches an edge
+		{Vector2{X: 12, Y: 12}, true}, // reaches a corner
+		{Vector2{X: 14, Y: 5}, false},
+		{Vector2{X: 30, Y: 1}, false}, // beside the line of an edge but past its end
+	} {
+		if got := circleIntersectsPolygon(hull, c.center, 3); got != c.want {
+			t.Log("circle at", c.center, "expected intersects", c.want, "got", got)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package geom
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shamaton/msgpack"
+)
+
+// Format enumeration selects how a lattice is written to a file
+type Format int
+
+const (
+	// CSVFormat is a list of x,y rows after a comment recording the types
+	CSVFormat Format = iota
+
+	// GeoJSONFormat is a Feature with a MultiPoint geometry and the types in
+	// its properties
+	GeoJSONFormat
+
+	// SVGFormat draws the points for a quick look. It can't be read back.
+	SVGFormat
+
+	// MsgpackFormat is the format of the lattice files NewLattice has always
+	// loaded
+	MsgpackFormat
+
+	// BinaryFormat is the format SaveLattice writes. The points are stored
+	// as they are in memory, in the order of their KDTree so it needn't be
+	// built again, and at a fixed offset so the file can be mapped straight
+	// into memory. Large lattices load in milliseconds.
+	//
+	//	magic "LATB" | version uint32 | LatticeType uint32 | VertexType uint32 |
+	//	point count uint64 | parameters length uint64 | flags uint32 | unused uint32 |
+	//	points as little endian float64 x, y pairs | parameters as JSON
+	BinaryFormat
+)
+
+// binaryMagic starts every file in BinaryFormat
+var binaryMagic = [4]byte{'L', 'A', 'T', 'B'}
+
+// binaryVersion is the version of the BinaryFormat layout
+const binaryVersion = 1
+
+// binaryIndexed flags files whose points are in KDTree order
+const binaryIndexed = 1
+
+// binaryHeader is the fixed size start of a file in BinaryFormat
+type binaryHeader struct {
+	Magic       [4]byte
+	Version     uint32
+	LatticeType uint32
+	VertexType  uint32
+	Count       uint64
+	ParamsLen   uint64
+	Flags       uint32
+	Unused      uint32
+}
+
+// ErrUntypedLattice is returned, along with the points, by ReadLattice for
+// files that don't record their LatticeType and VertexType
+var ErrUntypedLattice = errors.New("lattice file does not record its lattice and vertex types")
+
+// String returns the string representation of the Format enum
+func (f Format) String() string {
+	return [...]string{
+		"CSV", "GeoJSON", "SVG", "Msgpack", "Binary",
+	}[f]
+}
+
+// GetFormat returns a Format from its string representation
+func (f Format) GetFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "csv":
+		return CSVFormat, nil
+	case "geojson", "json":
+		return GeoJSONFormat, nil
+	case "svg":
+		return SVGFormat, nil
+	case "msgpack":
+		return MsgpackFormat, nil
+	case "binary", "lattice":
+		return BinaryFormat, nil
+	default:
+		return 0, errors.New("Unknown lattice format")
+	}
+}
+
+// FormatOf returns the Format of a file from its extension
+func FormatOf(filename string) (Format, error) {
+	var f Format
+	return f.GetFormat(strings.TrimPrefix(filepath.Ext(filename), "."))
+}
+
+// latticeProperties record what a lattice is in formats that only hold points
+type latticeProperties struct {
+	LatticeType string      `json:"lattice"`
+	VertexType  string      `json:"vertex"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+// geoJSON is the part of a GeoJSON object lattices are read from and written
+// to
+type geoJSON struct {
+	Type        string             `json:"type"`
+	Geometry    *geoJSON           `json:"geometry,omitempty"`
+	Coordinates json.RawMessage    `json:"coordinates,omitempty"`
+	Features    []geoJSON          `json:"features,omitempty"`
+	Properties  *latticeProperties `json:"properties,omitempty"`
+}
+
+// WriteLattice writes the lattice in the format
+func WriteLattice(w io.Writer, l Lattice, f Format) error {
+	switch f {
+	case CSVFormat:
+		return writeCSV(w, l)
+	case GeoJSONFormat:
+		return writeGeoJSON(w, l)
+	case SVGFormat:
+		return writeSVG(w, l)
+	case MsgpackFormat:
+		b, err := msgpack.Encode(l)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	case BinaryFormat:
+		return writeBinary(w, l)
+	default:
+		return fmt.Errorf("unknown lattice format %d", f)
+	}
+}
+
+// ReadLattice reads a lattice written by WriteLattice, or a plain list of
+// points in the same format, and validates its points. Points from files
+// that don't record their types come back with ErrUntypedLattice so the
+// caller can say what they are.
+func ReadLattice(r io.Reader, f Format) (Lattice, error) {
+	var l Lattice
+	var typed bool
+	var err error
+
+	switch f {
+	case CSVFormat:
+		l, typed, err = readCSV(r)
+	case GeoJSONFormat:
+		l, typed, err = readGeoJSON(r)
+	case MsgpackFormat:
+		var b []byte
+		if b, err = ioutil.ReadAll(r); err == nil {
+			err = msgpack.Decode(b, &l)
+		}
+		typed = true
+	case BinaryFormat:
+		var b []byte
+		if b, err = ioutil.ReadAll(r); err == nil {
+			l, err = decodeBinary(b)
+		}
+		typed = true
+	case SVGFormat:
+		err = errors.New("SVG lattices can only be exported")
+	default:
+		err = fmt.Errorf("unknown lattice format %d", f)
+	}
+
+	if err != nil {
+		return Lattice{}, err
+	}
+
+	if err := ValidatePoints(l.Points); err != nil {
+		return Lattice{}, err
+	}
+
+	l.index = NewKDTree(l.Points)
+
+	if !typed {
+		return l, ErrUntypedLattice
+	}
+	return l, nil
+}
+
+// ValidatePoints returns an error describing any points that aren't finite
+// or that repeat an earlier point
+func ValidatePoints(points []Vector2) error {
+	if len(points) == 0 {
+		return errors.New("lattice has no points")
+	}
+
+	problems := make([]string, 0)
+	seen := make(map[Vector2]int, len(points))
+
+	for i, p := range points {
+		if math.IsNaN(p.X) || math.IsNaN(p.Y) || math.IsInf(p.X, 0) || math.IsInf(p.Y, 0) {
+			problems = append(problems, fmt.Sprint("point ", i, " is not finite: ", p))
+			continue
+		}
+
+		// -0 and 0 are the same point
+		key := Vector2{X: p.X + 0, Y: p.Y + 0}
+		if first, ok := seen[key]; ok {
+			problems = append(problems, fmt.Sprint("point ", i, " duplicates point ", first, ": ", p))
+			continue
+		}
+		seen[key] = i
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if len(problems) > 5 {
+		problems = append(problems[:5], fmt.Sprint("and ", len(problems)-5, " more"))
+	}
+	return errors.New("invalid lattice points: " + strings.Join(problems, "; "))
+}
+
+// SaveLattice writes the lattice to LatticePath so NewLattice loads it
+// instead of any msgpack file or generating one
+func SaveLattice(l Lattice) error {
+	p := LatticePath(l.LatticeType, l.VertexType)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(p), ".lattice-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := WriteLattice(tmp, l, BinaryFormat); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// a scanner loading the lattice never sees half a file
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+
+	forgetLattice(l.LatticeType, l.VertexType)
+	return nil
+}
+
+// parseTypes sets the lattice's types from their names
+func (l *Lattice) parseTypes(lattice, vertex string) error {
+	var err error
+	if l.LatticeType, err = l.LatticeType.GetLType(lattice); err != nil {
+		return err
+	}
+	l.VertexType, err = l.VertexType.GetVType(vertex)
+	return err
+}
+
+func writeCSV(w io.Writer, l Lattice) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# lattice=%v vertex=%v\n", l.LatticeType, l.VertexType)
+
+	cw := csv.NewWriter(bw)
+	cw.Write([]string{"x", "y"})
+	for _, p := range l.Points {
+		cw.Write([]string{strconv.FormatFloat(p.X, 'g', -1, 64), strconv.FormatFloat(p.Y, 'g', -1, 64)})
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func readCSV(r io.Reader) (Lattice, bool, error) {
+	l := Lattice{}
+	typed := false
+	br := bufio.NewReader(r)
+
+	// the types are recorded in a comment before the points
+	if first, err := br.Peek(1); err == nil && first[0] == '#' {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return l, false, err
+		}
+
+		fields := make(map[string]string)
+		for _, f := range strings.Fields(strings.TrimPrefix(line, "#")) {
+			if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+				fields[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+
+		if fields["lattice"] != "" && fields["vertex"] != "" {
+			if err := l.parseTypes(fields["lattice"], fields["vertex"]); err != nil {
+				return l, false, err
+			}
+			typed = true
+		}
+	}
+
+	cr := csv.NewReader(br)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	for row := 1; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return l, false, err
+		}
+
+		if len(record) < 2 {
+			return l, false, fmt.Errorf("csv row %d has %d columns but needs x and y", row, len(record))
+		}
+
+		x, xerr := strconv.ParseFloat(record[0], 64)
+		y, yerr := strconv.ParseFloat(record[1], 64)
+		if xerr != nil || yerr != nil {
+			// the first row may be a header
+			if row == 1 {
+				continue
+			}
+			return l, false, fmt.Errorf("csv row %d is not a point: %v", row, record)
+		}
+
+		l.Points = append(l.Points, Vector2{X: x, Y: y})
+	}
+
+	return l, typed, nil
+}
+
+func writeGeoJSON(w io.Writer, l Lattice) error {
+	coords := make([][2]float64, len(l.Points))
+	for i, p := range l.Points {
+		coords[i] = [2]float64{p.X, p.Y}
+	}
+
+	b, err := json.Marshal(coords)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(geoJSON{
+		Type:     "Feature",
+		Geometry: &geoJSON{Type: "MultiPoint", Coordinates: b},
+		Properties: &latticeProperties{
+			LatticeType: l.LatticeType.String(),
+			VertexType:  l.VertexType.String(),
+			Parameters:  l.Parameters,
+		},
+	})
+}
+
+// readGeoJSON reads the points of a MultiPoint or Point geometry, a Feature
+// of one, or a FeatureCollection of them. The types come from the properties
+// of the Feature or of the first Feature of a collection.
+func readGeoJSON(r io.Reader) (Lattice, bool, error) {
+	l := Lattice{}
+	obj := geoJSON{}
+	if err := json.NewDecoder(r).Decode(&obj); err != nil {
+		return l, false, err
+	}
+
+	features := []geoJSON{obj}
+	if obj.Type == "FeatureCollection" {
+		features = obj.Features
+	}
+
+	typed := false
+	for i, f := range features {
+		if i == 0 && f.Properties != nil && f.Properties.LatticeType != "" && f.Properties.VertexType != "" {
+			if err := l.parseTypes(f.Properties.LatticeType, f.Properties.VertexType); err != nil {
+				return l, false, err
+			}
+			l.Parameters = f.Properties.Parameters
+			typed = true
+		}
+
+		geometry := f
+		if f.Type == "Feature" {
+			if f.Geometry == nil {
+				continue
+			}
+			geometry = *f.Geometry
+		}
+
+		var positions [][]float64
+		switch geometry.Type {
+		case "MultiPoint":
+			if err := json.Unmarshal(geometry.Coordinates, &positions); err != nil {
+				return l, false, err
+			}
+		case "Point":
+			var position []float64
+			if err := json.Unmarshal(geometry.Coordinates, &position); err != nil {
+				return l, false, err
+			}
+			positions = [][]float64{position}
+		default:
+			return l, false, fmt.Errorf("GeoJSON %s geometry is not points", geometry.Type)
+		}
+
+		for _, pos := range positions {
+			if len(pos) < 2 {
+				return l, false, fmt.Errorf("GeoJSON position %v needs x and y", pos)
+			}
+			l.Points = append(l.Points, Vector2{X: pos[0], Y: pos[1]})
+		}
+	}
+
+	return l, typed, nil
+}
+
+// writeSVG draws each point as a dot with y pointing up
+func writeSVG(w io.Writer, l Lattice) error {
+	if len(l.Points) == 0 {
+		return errors.New("lattice has no points to draw")
+	}
+
+	min, max := l.Points[0], l.Points[0]
+	for _, p := range l.Points {
+		min, max = Min(min, p), Max(max, p)
+	}
+
+	size := max.Sub(min)
+	extent := math.Max(math.Max(size.X, size.Y), 1e-9)
+	r := extent / 1000
+	margin := r * 4
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"%g %g %g %g\">\n",
+		min.X-margin, -max.Y-margin, size.X+2*margin, size.Y+2*margin)
+	fmt.Fprintf(bw, "<title>%v %v</title>\n", l.LatticeType, l.VertexType)
+	fmt.Fprintf(bw, "<g fill=\"black\" transform=\"scale(1,-1)\">\n")
+	for _, p := range l.Points {
+		fmt.Fprintf(bw, "<circle cx=\"%g\" cy=\"%g\" r=\"%g\"/>\n", p.X, p.Y, r)
+	}
+	fmt.Fprintf(bw, "</g>\n</svg>\n")
+
+	return bw.Flush()
+}
+
+func writeBinary(w io.Writer, l Lattice) error {
+	params := []byte{}
+	if l.Parameters != nil {
+		var err error
+		if params, err = json.Marshal(l.Parameters); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	err := binary.Write(bw, binary.LittleEndian, binaryHeader{
+		Magic:       binaryMagic,
+		Version:     binaryVersion,
+		LatticeType: uint32(l.LatticeType),
+		VertexType:  uint32(l.VertexType),
+		Count:       uint64(len(l.Points)),
+		ParamsLen:   uint64(len(params)),
+		Flags:       binaryIndexed,
+	})
+	if err != nil {
+		return err
+	}
+
+	var point [16]byte
+	for _, p := range l.Index().points {
+		binary.LittleEndian.PutUint64(point[:8], math.Float64bits(p.X))
+		binary.LittleEndian.PutUint64(point[8:], math.Float64bits(p.Y))
+		bw.Write(point[:])
+	}
+
+	bw.Write(params)
+	return bw.Flush()
+}
+
+// decodeBinary decodes a lattice in BinaryFormat and indexes it. The points
+// are trusted, as SaveLattice validated them on the way in.
+func decodeBinary(b []byte) (Lattice, error) {
+	l := Lattice{}
+	header := binaryHeader{}
+	size := binary.Size(header)
+
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &header); err != nil || header.Magic != binaryMagic {
+		return l, errors.New("not a binary lattice file")
+	}
+
+	if header.Version != binaryVersion {
+		return l, fmt.Errorf("unsupported binary lattice version %d", header.Version)
+	}
+
+	end := uint64(size) + header.Count*16
+	if header.Count > uint64(len(b))/16 || uint64(len(b)) != end+header.ParamsLen {
+		return l, errors.New("binary lattice file is truncated")
+	}
+
+	l.LatticeType = LatticeType(header.LatticeType)
+	l.VertexType = VertexType(header.VertexType)
+	if int(l.LatticeType) >= len(LatticeTypes) || int(l.VertexType) >= len(VertexTypes) {
+		return l, errors.New("binary lattice file has an unknown lattice or vertex type")
+	}
+
+	l.Points = make([]Vector2, header.Count)
+	points := b[size:end]
+	for i := range l.Points {
+		l.Points[i] = Vector2{
+			X: math.Float64frombits(binary.LittleEndian.Uint64(points[i*16:])),
+			Y: math.Float64frombits(binary.LittleEndian.Uint64(points[i*16+8:])),
+		}
+	}
+
+	if header.ParamsLen > 0 {
+		if err := json.Unmarshal(b[end:], &l.Parameters); err != nil {
+			return l, err
+		}
+	}
+
+	if header.Flags&binaryIndexed != 0 {
+		l.index = &KDTree{points: l.Points}
+	} else {
+		l.index = NewKDTree(l.Points)
+	}
+	return l, nil
+}
+
+// loadBinaryLattice reads a lattice file written by SaveLattice
+func loadBinaryLattice(p string) (Lattice, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return Lattice{}, err
+	}
+	return decodeBinary(b)
+}
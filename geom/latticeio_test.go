@@ -0,0 +1,190 @@
+package geom
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testLattice(t *testing.T) Lattice {
+	l, err := GenerateLattice(Penrose, Centers, PenroseParameters{Lines: 4, Scale: 1, Offsets: [5]float64{.1, .27, .13, .32, .18}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLatticeFormatsRoundTrip(t *testing.T) {
+	want := testLattice(t)
+
+	for _, f := range []Format{CSVFormat, GeoJSONFormat, MsgpackFormat, BinaryFormat} {
+		var buf bytes.Buffer
+		if err := WriteLattice(&buf, want, f); err != nil {
+			t.Fatal(f, err)
+		}
+
+		got, err := ReadLattice(&buf, f)
+		if err != nil {
+			t.Fatal(f, err)
+		}
+
+		if got.LatticeType != want.LatticeType || got.VertexType != want.VertexType {
+			t.Log(f, "expected", want.LatticeType, want.VertexType, "got", got.LatticeType, got.VertexType)
+			t.Fail()
+		}
+
+		if !samePoints(got.Points, append([]Vector2(nil), want.Points...)) {
+			t.Log(f, "points changed on the way through")
+			t.Fail()
+		}
+	}
+}
+
+func TestBinaryLatticeKeepsItsIndex(t *testing.T) {
+	want := testLattice(t)
+
+	var buf bytes.Buffer
+	if err := WriteLattice(&buf, want, BinaryFormat); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decodeBinary(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if &got.index.points[0] != &got.Points[0] {
+		t.Log("expected the index to share the points in KDTree order")
+		t.Fail()
+	}
+
+	origin := Vector2{X: 1, Y: -2}
+	if !samePoints(got.Index().Radius(origin, 3, nil), want.Index().Radius(origin, 3, nil)) {
+		t.Log("expected the loaded index to find the same points")
+		t.Fail()
+	}
+}
+
+func TestReadBinaryRejectsBadFiles(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteLattice(&buf, testLattice(t), BinaryFormat); err != nil {
+		t.Fatal(err)
+	}
+	body := buf.Bytes()
+
+	future := append([]byte(nil), body...)
+	future[4] = binaryVersion + 1
+
+	for name, bad := range map[string][]byte{
+		"truncated header": body[:10],
+		"truncated points": body[:len(body)-20],
+		"future version":   future,
+		"not binary":       []byte("# lattice=Grid vertex=Vertices\n1,2\n"),
+	} {
+		if _, err := ReadLattice(bytes.NewReader(bad), BinaryFormat); err == nil {
+			t.Log("expected an error reading a", name, "file")
+			t.Fail()
+		}
+	}
+}
+
+func TestReadUntypedLattices(t *testing.T) {
+	for f, body := range map[Format]string{
+		CSVFormat:     "x,y\n1,2\n3,4\n",
+		GeoJSONFormat: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]}},{"type":"Feature","geometry":{"type":"Point","coordinates":[3,4,5]}}]}`,
+	} {
+		l, err := ReadLattice(strings.NewReader(body), f)
+		if !errors.Is(err, ErrUntypedLattice) {
+			t.Log(f, "expected ErrUntypedLattice but got", err)
+			t.Fail()
+		}
+
+		if !reflect.DeepEqual(l.Points, []Vector2{{X: 1, Y: 2}, {X: 3, Y: 4}}) {
+			t.Log(f, "unexpected points", l.Points)
+			t.Fail()
+		}
+	}
+}
+
+func TestReadLatticeValidates(t *testing.T) {
+	for name, body := range map[string]string{
+		"duplicate":               "# lattice=Grid vertex=Vertices\n1,2\n3,4\n1,2\n",
+		"negative zero duplicate": "# lattice=Grid vertex=Vertices\n0,2\n-0,2\n",
+		"NaN":                     "# lattice=Grid vertex=Vertices\n1,2\nNaN,4\n",
+		"infinite":                "# lattice=Grid vertex=Vertices\n1,+Inf\n",
+		"empty":                   "# lattice=Grid vertex=Vertices\nx,y\n",
+		"not a point":             "# lattice=Grid vertex=Vertices\n1,2\na,b\n",
+		"bad type":                "# lattice=Hexagon vertex=Vertices\n1,2\n",
+	} {
+		if _, err := ReadLattice(strings.NewReader(body), CSVFormat); err == nil || errors.Is(err, ErrUntypedLattice) {
+			t.Log("expected an error reading a", name, "lattice but got", err)
+			t.Fail()
+		}
+	}
+
+	if err := ValidatePoints([]Vector2{{X: math.NaN()}, {X: 1}, {X: 1}}); err == nil {
+		t.Log("expected NaN and duplicate points to be invalid")
+		t.Fail()
+	}
+}
+
+func TestWriteSVG(t *testing.T) {
+	l := testLattice(t)
+
+	var buf bytes.Buffer
+	if err := WriteLattice(&buf, l, SVGFormat); err != nil {
+		t.Fatal(err)
+	}
+
+	svg := buf.String()
+	if strings.Count(svg, "<circle") != len(l.Points) || !strings.Contains(svg, "<title>Penrose Centers</title>") {
+		t.Log("expected a titled circle for each of", len(l.Points), "points")
+		t.Fail()
+	}
+
+	if _, err := ReadLattice(&buf, SVGFormat); err == nil {
+		t.Log("expected SVG to be export only")
+		t.Fail()
+	}
+}
+
+func TestSaveLatticeIsLoaded(t *testing.T) {
+	appData := os.Getenv("APP_DATA")
+	defer os.Setenv("APP_DATA", appData)
+	os.Setenv("APP_DATA", t.TempDir())
+
+	want := testLattice(t)
+	if err := SaveLattice(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := NewLattice(want.LatticeType, want.VertexType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !samePoints(append([]Vector2(nil), got.Points...), want.Points) {
+		t.Log("expected NewLattice to load the saved lattice")
+		t.Fail()
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for name, want := range map[string]Format{
+		"a.csv": CSVFormat, "b.geojson": GeoJSONFormat, "c.SVG": SVGFormat, "d.msgpack": MsgpackFormat, "e.lattice": BinaryFormat,
+	} {
+		if f, err := FormatOf(name); err != nil || f != want {
+			t.Log("expected", name, "to be", want, "but got", f, err)
+			t.Fail()
+		}
+	}
+
+	if _, err := FormatOf("e.txt"); err == nil {
+		t.Log("expected an error for an unknown extension")
+		t.Fail()
+	}
+}
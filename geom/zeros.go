@@ -79,8 +79,32 @@ func (z ZeroType) GetZType(name string) (ZeroType, error) {
 
 // LoadZeros loads the numeric values from a data file and returns the indicated
 // numeric type up to the maxValue, scaled by the scale value.
-// The maxValue is the maximum value loaded before scaling.
+// The maxValue is the maximum value loaded before scaling. Values are cached
+// for the whole process so they are shared and must not be modified.
 func LoadZeros(zeros *Zeros, maxValue float64) error {
+	key := zerosKey{
+		ZeroType:  zeros.ZeroType,
+		Limit:     maxValue,
+		Scalar:    zeros.Scalar,
+		Negatives: zeros.Negatives,
+	}
+
+	v, err := cache.Get(key, func() (interface{}, int64, error) {
+		values, err := readZeros(zeros, maxValue)
+		return values, int64(len(values)) * 8, err
+	})
+	if err != nil {
+		return err
+	}
+
+	values := v.([]float64)
+	zeros.Count = len(values)
+	zeros.Values = values
+	return nil
+}
+
+// readZeros reads the values LoadZeros caches from the data file
+func readZeros(zeros *Zeros, maxValue float64) ([]float64, error) {
 
 	var err error
 	dataPath := os.Getenv("APP_DATA")
@@ -90,12 +114,12 @@ func LoadZeros(zeros *Zeros, maxValue float64) error {
 	p := path.Join(dataPath, "zeros", zeros.ZeroType.String()+".x1.0000")
 	b, err := ioutil.ReadFile(p)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	data := make([]float64, 0, 256)
 	if err := json.Unmarshal(b, &data); err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, value := range data {
@@ -110,9 +134,7 @@ func LoadZeros(zeros *Zeros, maxValue float64) error {
 		}
 	}
 
-	zeros.Count = len(values)
-	zeros.Values = values
-	return nil
+	return values, nil
 }
 
 func max(vals []float64) float64 {
@@ -1,9 +1,6 @@
 package geom
 
-import (
-	"os"
-	"testing"
-)
+import "testing"
 
 func TestLoadLoad(t *testing.T) {
 	const maxval = 100
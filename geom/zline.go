@@ -1,5 +1,7 @@
 package geom
 
+import "math"
+
 // ZLine is a number line in space starting at the specified origin and rotated
 // about the origin by the specified angle in degrees
 type ZLine struct {
@@ -35,12 +37,13 @@ func NewZLine(origin Vector2, zeros []ZeroType, limit, scale float64, neg bool,
 	return zline, nil
 }
 
-// MaxZeroVal returns the largest zero value on the ZLine
+// MaxZeroVal returns the magnitude of the zero value farthest from the ZLine
+// origin. Negative zeros and negative scalars count by their absolute value.
 func (z ZLine) MaxZeroVal() float64 {
 	var maxZero float64
 	for _, zero := range z.Zeros {
-		if zero.Values[len(zero.Values)-1] > maxZero {
-			maxZero = zero.Values[len(zero.Values)-1]
+		for _, value := range zero.Values {
+			maxZero = math.Max(maxZero, math.Abs(value))
 		}
 	}
 	return maxZero
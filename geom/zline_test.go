@@ -1,9 +1,6 @@
 package geom
 
-import (
-	"os"
-	"testing"
-)
+import "testing"
 
 func TestNewZLineSingle(t *testing.T) {
 	origin := Vector2{}
@@ -37,3 +34,15 @@ func TestNewZLineSingle(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxZeroValNegatives(t *testing.T) {
+	zline := ZLine{Zeros: []Zeros{
+		{Values: []float64{2, -2, 3, -3}},
+		{Values: []float64{-1.5, -7.5}}, // negative scalar
+	}}
+
+	if max := zline.MaxZeroVal(); max != 7.5 {
+		t.Log("expected max zero value to be 7.5 but was", max)
+		t.Fail()
+	}
+}
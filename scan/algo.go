@@ -1,25 +1,34 @@
 package scan
 
 import (
-	"log"
 	"math"
-	"math/rand"
 	"github.com/chriscow/cloud-scanner-go/geom"
 )
 
-func randOrigins(min, max float64, center geom.Vector2, count int) []geom.Vector2 {
-	origins := make([]geom.Vector2, count)
-	for i := range origins {
-		origins[i] = geom.Vector2{
-			X: min + rand.Float64()*(max-min) + center.X,
-			Y: min + rand.Float64()*(max-min) + center.Y,
-		}
+// jobSeed mixes the session seed, session id and job id into the seed of a
+// job's PRNG (splitmix64 finalizer) so neighbouring ids give unrelated streams
+func jobSeed(seed, sessionID int64, procid int) int64 {
+	x := uint64(seed)
+	for _, v := range []uint64{uint64(sessionID), uint64(procid)} {
+		x += v + 0x9e3779b97f4a7c15
+		x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+		x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+		x ^= x >> 31
 	}
-	return origins
+	return int64(x)
 }
 
+const rad2deg = 180 / math.Pi
+
+// wrapDegrees wraps deg into [0, 360). NaN and infinite angles come back as
+// NaN.
 func wrapDegrees(deg float64) float64 {
-	for deg > 360 {
+	if deg >= 720 || deg < -360 {
+		// don't loop forever on huge angles
+		deg = math.Mod(deg, 360)
+	}
+
+	for deg >= 360 {
 		deg -= 360
 	}
 
@@ -27,6 +36,11 @@ func wrapDegrees(deg float64) float64 {
 		deg += 360
 	}
 
+	// a tiny negative angle rounds up to exactly 360 when wrapped
+	if deg >= 360 {
+		return 0
+	}
+
 	return deg
 }
 
@@ -41,15 +55,37 @@ func allAngles(lattice, origin geom.Vector2, zero, limit float64) (theta1, theta
 		return math.NaN(), math.NaN()
 	}
 
-	rad2deg := 180 / math.Pi
-	theta1 = wrapDegrees(rad2deg * 2 * math.Atan2(lattice.Y-origin.Y+distance, lattice.X-origin.X+zero))
-	theta2 = wrapDegrees(rad2deg * 2 * math.Atan2(lattice.Y-origin.Y-distance, lattice.X-origin.X+zero))
+	dx, dy := lattice.X-origin.X, lattice.Y-origin.Y
+	theta1 = lineAngle(dx, dy, zero, distance, 1)
+	theta2 = lineAngle(dx, dy, zero, distance, -1)
 
 	return
 }
 
-// calculate a single result
-func calculate(origin geom.Vector2, lattice []geom.Vector2, zeros []float64, latticeParams interface{}, limit float64, bucketCount int) [][]int {
+// lineAngle returns the angle in degrees of a line through the origin on
+// which the lattice point at offset (dx, dy) projects to the (signed) zero,
+// leaving the point dist away on the side given by sign (1 or -1). A negative
+// zero is the same as its positive on the line turned half way round.
+//
+// It uses the half angle form 2*atan2(dy + dist, dx + zero), which is 0/0
+// when the point sits on the negative side of the line. Then the equivalent
+// sin / (1 + cos) form is used instead, and if that is 0/0 too the line points
+// straight away from the lattice point.
+func lineAngle(dx, dy, zero, dist, sign float64) float64 {
+	y, x := dy+sign*dist, dx+zero
+
+	if y == 0 && x == 0 {
+		y, x = zero*dy+sign*dist*dx, dx*dx+dy*dy+zero*dx-sign*dist*dy
+		if y == 0 && x == 0 {
+			return 180
+		}
+	}
+
+	return wrapDegrees(rad2deg * 2 * math.Atan2(y, x))
+}
+
+// calculate a single result. Angles are measured from the ZLine's angle.
+func calculate(origin geom.Vector2, lattice []geom.Vector2, zeros []float64, latticeParams interface{}, limit, angle float64, bucketCount int) ([][]int, error) {
 	buckets := make([][]int, bucketCount)
 	for i := range buckets {
 		buckets[i] = make([]int, len(zeros))
@@ -65,13 +101,20 @@ func calculate(origin geom.Vector2, lattice []geom.Vector2, zeros []float64, lat
 				continue
 			}
 
+			theta1 = wrapDegrees(theta1 - angle)
+			theta2 = wrapDegrees(theta2 - angle)
+
 			b1 := int(math.Floor(theta1 / degPerBucket))
 			b2 := int(math.Floor(theta2 / degPerBucket))
 			// log.Println(theta1, theta2, b1, b2)
 
-			if b1 >= len(buckets) || b2 >= len(buckets) || b1 < 0 || b2 < 0 {
-				log.Fatalln("bucket", b1, "out of range:", len(buckets), lattice, origin, zero, theta1, theta2)
+			if err := checkBucket(b1, len(buckets), origin, zero, theta1); err != nil {
+				return nil, err
+			}
+			if err := checkBucket(b2, len(buckets), origin, zero, theta2); err != nil {
+				return nil, err
 			}
+
 			buckets[b1][i] = 1
 			if b1 != b2 {
 				buckets[b2][i] = 1
@@ -79,10 +122,26 @@ func calculate(origin geom.Vector2, lattice []geom.Vector2, zeros []float64, lat
 		}
 	}
 
-	return buckets
+	return buckets, nil
+}
+
+// checkBucket returns a NumericFaultError if theta is NaN or bucket b is out
+// of range
+func checkBucket(b, bucketCount int, origin geom.Vector2, zero, theta float64) error {
+	if math.IsNaN(theta) || b < 0 || b >= bucketCount {
+		return &NumericFaultError{
+			Origin:      origin,
+			Zero:        zero,
+			Theta:       theta,
+			Bucket:      b,
+			BucketCount: bucketCount,
+		}
+	}
+
+	return nil
 }
 
-func calculateTest(origin geom.Vector2, lattice []geom.Vector2, zeros geom.Zeros, latticeParams interface{}, limit float64, bucketCount int) [][]int {
+func calculateTest(origin geom.Vector2, lattice []geom.Vector2, zeros geom.Zeros, latticeParams interface{}, limit float64, bucketCount int) ([][]int, error) {
 	buckets := make([][]int, bucketCount)
 	for i := range buckets {
 		buckets[i] = make([]int, zeros.Count)
@@ -102,9 +161,13 @@ func calculateTest(origin geom.Vector2, lattice []geom.Vector2, zeros geom.Zeros
 			b2 := int(math.Floor(theta2 / degPerBucket))
 			// log.Println(theta1, theta2, b1, b2)
 
-			if b1 >= len(buckets) || b2 >= len(buckets) || b1 < 0 || b2 < 0 {
-				log.Fatalln("bucket", b1, "out of range:", len(buckets), lattice, origin, zero, theta1, theta2)
+			if err := checkBucket(b1, len(buckets), origin, zero, theta1); err != nil {
+				return nil, err
 			}
+			if err := checkBucket(b2, len(buckets), origin, zero, theta2); err != nil {
+				return nil, err
+			}
+
 			buckets[b1][i] = 1
 			if b1 != b2 {
 				buckets[b2][i] = 1
@@ -112,5 +175,5 @@ func calculateTest(origin geom.Vector2, lattice []geom.Vector2, zeros geom.Zeros
 		}
 	}
 
-	return buckets
+	return buckets, nil
 }
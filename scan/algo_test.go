@@ -3,7 +3,6 @@ package scan
 import (
 	"log"
 	"math"
-	"os"
 	"github.com/chriscow/cloud-scanner-go/geom"
 	"testing"
 )
@@ -48,7 +47,7 @@ func TestCalc(t *testing.T) {
 	log.Println(len(zeros.Values), "zeros", zeros.Values[0], zeros.Values[len(zeros.Values)-1])
 
 	buckets := 3600
-	result := calculate(origin, lattice.Points, zeros.Values, nil, 1, buckets)
+	result := mustCalculate(t, origin, lattice.Points, zeros.Values, nil, 1, 0, buckets)
 	if len(result) != buckets {
 		t.Log("length of result should match bucket count", buckets, len(result))
 		t.Fail()
@@ -0,0 +1,177 @@
+package scan
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// bucketCounts is the number of zeros hit in every bucket
+func bucketCounts(buckets [][]int) []int {
+	counts := make([]int, len(buckets))
+	for i, bucket := range buckets {
+		for _, hit := range bucket {
+			counts[i] += hit
+		}
+	}
+	return counts
+}
+
+// countMismatches counts buckets that differ between a and b, with b shifted
+// by the given number of buckets
+func countMismatches(a, b []int, shift int) int {
+	mismatches := 0
+	for i := range a {
+		if a[i] != b[(i+shift)%len(b)] {
+			mismatches++
+		}
+	}
+	return mismatches
+}
+
+func rotate(p geom.Vector2, deg float64) geom.Vector2 {
+	sin, cos := math.Sincos(deg / rad2deg)
+	return geom.Vector2{X: p.X*cos - p.Y*sin, Y: p.X*sin + p.Y*cos}
+}
+
+// angleTestZeros are scaled primes with their negatives, laid out the way
+// LoadZeros does it
+func angleTestZeros(scalar float64) []float64 {
+	zeros := make([]float64, 0, len(kernelTestPrimes)*2)
+	for _, p := range kernelTestPrimes {
+		zeros = append(zeros, p*scalar, -p*scalar)
+	}
+	return zeros
+}
+
+// Rotating the lattice, the scan origin and the ZLine together by the same
+// angle must not change which zeros land in which bucket.
+func TestRotationInvariance(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	lattice := kernelTestLattice(3000, 60)
+	origin := geom.Vector2{X: .3, Y: -.6}
+	zeros := angleTestZeros(.7)
+	const bucketCount = 3600
+
+	base := bucketCounts(mustCalculate(t, origin, lattice, zeros, nil, 2, 0, bucketCount))
+
+	angles := []float64{90, 180, 270, -90}
+	for i := 0; i < 8; i++ {
+		angles = append(angles, rnd.Float64()*720-360)
+	}
+
+	for _, angle := range angles {
+		rotated := make([]geom.Vector2, len(lattice))
+		for i, pt := range lattice {
+			rotated[i] = rotate(pt, angle)
+		}
+
+		counts := bucketCounts(mustCalculate(t, rotate(origin, angle), rotated, zeros, nil, 2, angle, bucketCount))
+
+		// rotating isn't exact in floating point so an angle that sits within
+		// rounding of a bucket edge may land in the neighbouring bucket. That
+		// should be vanishingly rare.
+		if n := countMismatches(base, counts, 0); n > 2 {
+			t.Log("rotating by", angle, "changed the hit counts of", n, "buckets")
+			t.Fail()
+		}
+	}
+}
+
+// Scaling everything by a power of two is exact so the hits must be identical
+func TestScaleInvariance(t *testing.T) {
+	lattice := kernelTestLattice(3000, 60)
+	origin := geom.Vector2{X: .3, Y: -.6}
+
+	base := bucketCounts(mustCalculate(t, origin, lattice, angleTestZeros(1), nil, 2, 15, 3600))
+
+	scaled := make([]geom.Vector2, len(lattice))
+	for i, pt := range lattice {
+		scaled[i] = pt.Scale(4)
+	}
+
+	counts := bucketCounts(mustCalculate(t, origin.Scale(4), scaled, angleTestZeros(4), nil, 8, 15, 3600))
+	if n := countMismatches(base, counts, 0); n != 0 {
+		t.Log("scaling changed the hit counts of", n, "buckets")
+		t.Fail()
+	}
+}
+
+// A negative zero is its positive on the ZLine turned half way round
+func TestNegativeZerosAreHalfTurn(t *testing.T) {
+	lattice := kernelTestLattice(3000, 60)
+	origin := geom.Vector2{X: -.2, Y: .9}
+	const bucketCount = 3600
+
+	positive := make([]float64, len(kernelTestPrimes))
+	negative := make([]float64, len(kernelTestPrimes))
+	for i, p := range kernelTestPrimes {
+		positive[i] = p
+		negative[i] = -p
+	}
+
+	pos := bucketCounts(mustCalculate(t, origin, lattice, positive, nil, 2, 0, bucketCount))
+	neg := bucketCounts(mustCalculate(t, origin, lattice, negative, nil, 2, 0, bucketCount))
+
+	if n := countMismatches(pos, neg, bucketCount/2); n > 2 {
+		t.Log("negative zeros differ from the half turned positives in", n, "buckets")
+		t.Fail()
+	}
+
+	// and with Negatives set both halves are counted
+	both := bucketCounts(mustCalculate(t, origin, lattice, angleTestZeros(1), nil, 2, 0, bucketCount))
+	for i := range both {
+		if both[i] != pos[i]+neg[i] {
+			t.Fatal("bucket", i, "has", both[i], "hits but positive and negative zeros have", pos[i], "+", neg[i])
+		}
+	}
+}
+
+// lineAngle must return a line the lattice point projects onto at the zero,
+// including the spots where the half angle formula is 0/0
+func TestLineAngleProjectsToZero(t *testing.T) {
+	type tc struct{ dx, dy, zero float64 }
+	cases := []tc{
+		{-3, 0, 3},  // on the line, behind the origin
+		{3, 0, -3},  // negative zero in front of the origin
+		{-3, -4, 3}, // 0/0 in the upper root only
+		{-3, 4, 3},  // 0/0 in the lower root only
+	}
+
+	rnd := rand.New(rand.NewSource(5))
+	for i := 0; i < 1000; i++ {
+		cases = append(cases, tc{rnd.Float64()*20 - 10, rnd.Float64()*20 - 10, rnd.Float64()*10 - 5})
+	}
+
+	for _, c := range cases {
+		rsq := c.dx*c.dx + c.dy*c.dy
+		if rsq < c.zero*c.zero {
+			continue
+		}
+		dist := math.Sqrt(rsq - c.zero*c.zero)
+
+		for _, sign := range []float64{1, -1} {
+			sin, cos := math.Sincos(lineAngle(c.dx, c.dy, c.zero, dist, sign) / rad2deg)
+
+			along := c.dx*cos + c.dy*sin
+			across := c.dy*cos - c.dx*sin
+
+			if math.Abs(along-c.zero) > 1e-9 || math.Abs(across+sign*dist) > 1e-9 {
+				t.Log(c, "sign", sign, "projects to", along, across, "expected", c.zero, -sign*dist)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestWrapDegrees(t *testing.T) {
+	for _, deg := range []float64{0, 360, 720, -360, -1e-14, 359.999, 1080.5} {
+		w := wrapDegrees(deg)
+		if w < 0 || w >= 360 {
+			t.Log("wrapDegrees(", deg, ") =", w, "which is outside [0, 360)")
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package scan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	g "github.com/chriscow/cloud-scanner-go/geom"
+
+	"github.com/urfave/cli/v2"
+)
+
+// calibrationProc is the proc id calibration origins are drawn for so they
+// never repeat the origins of a scan job
+const calibrationProc = -2
+
+// calibrationOrigins is how many random origins a session scans to calibrate
+// each of its zero sets
+var calibrationOrigins = 4096
+
+// CalibrateCommand scans random origins of a session's lattice and stores the
+// distribution of their scores for each of its zero sets
+var CalibrateCommand = &cli.Command{
+	Name:  "calibrate",
+	Usage: "store the score distribution of random origins for a session's lattice and zeros",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "session", Usage: "session JSON to calibrate", Required: true},
+		&cli.StringFlag{Name: "dir", Usage: "directory to store the calibrations in", EnvVars: []string{"CALIBRATION_DIR"}, Required: true},
+		&cli.IntFlag{Name: "origins", Usage: "random origins to scan", Value: calibrationOrigins},
+	},
+	Action: calibrateCmd,
+}
+
+// CalibrationKey is what a score distribution depends on. Where the origins
+// are in the lattice is assumed not to matter. Refine only moves BestTheta so
+// it isn't part of the key.
+type CalibrationKey struct {
+	LatticeType   g.LatticeType
+	VertexType    g.VertexType
+	ZeroType      g.ZeroType
+	ZeroCount     int
+	Scalar        float64
+	Negatives     bool
+	Combined      bool
+	Angle         float64
+	BucketCount   int
+	DistanceLimit float64
+	Window        int
+	Scorer        ScorerType
+}
+
+// String returns the key as a file name friendly string
+func (k CalibrationKey) String() string {
+	zeros := k.ZeroType.String()
+	if k.Combined {
+		zeros = "Combined"
+	}
+	if k.Negatives {
+		zeros += "Negatives"
+	}
+
+	return fmt.Sprintf("%v-%v-%s-%d-%g-%g-%d-%g-%d-%v",
+		k.LatticeType, k.VertexType, zeros, k.ZeroCount, k.Scalar, k.Angle,
+		k.BucketCount, k.DistanceLimit, k.Window, k.Scorer)
+}
+
+// Calibration is the empirical distribution of the best scores of random
+// origins
+type Calibration struct {
+	Key     CalibrationKey
+	Origins int
+
+	// Scores are the best score of every origin in ascending order
+	Scores []float64
+	Mean   float64
+	StdDev float64
+
+	Created time.Time
+}
+
+// PValue returns the fraction of random origins that scored at least score,
+// counting score itself as one of them so it is never 0
+func (c *Calibration) PValue(score float64) float64 {
+	below := sort.SearchFloat64s(c.Scores, score)
+	return float64(len(c.Scores)-below+1) / float64(len(c.Scores)+1)
+}
+
+// ZScore returns how many standard deviations score is above the mean
+func (c *Calibration) ZScore(score float64) float64 {
+	if c.StdDev == 0 {
+		return 0
+	}
+	return (score - c.Mean) / c.StdDev
+}
+
+// Threshold returns the lowest score at or above the percentile of the
+// random origins
+func (c *Calibration) Threshold(percentile float64) float64 {
+	if len(c.Scores) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(percentile / 100 * float64(len(c.Scores))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(c.Scores) {
+		rank = len(c.Scores)
+	}
+
+	return c.Scores[rank-1]
+}
+
+// add records the score of an origin
+func (c *Calibration) add(score float64) {
+	c.Scores = append(c.Scores, score)
+}
+
+// finish sorts the scores and works out their mean and standard deviation
+func (c *Calibration) finish() {
+	sort.Float64s(c.Scores)
+
+	sum, sumSq := 0.0, 0.0
+	for _, score := range c.Scores {
+		sum += score
+		sumSq += score * score
+	}
+
+	n := float64(len(c.Scores))
+	if n > 0 {
+		c.Mean = sum / n
+		c.StdDev = math.Sqrt(math.Max(0, sumSq/n-c.Mean*c.Mean))
+	}
+	c.Created = time.Now()
+}
+
+// CalibrationStore saves and loads calibrations
+type CalibrationStore interface {
+	// Save replaces the calibration with the same key
+	Save(c *Calibration) error
+
+	// Load returns the calibration of the key, or nil if there isn't one
+	Load(key CalibrationKey) (*Calibration, error)
+}
+
+// Calibrations is where sessions look for the calibrations of their zero
+// sets and save the ones they had to make. When it is nil sessions only
+// calibrate when they need to, and keep the calibration to themselves.
+var Calibrations CalibrationStore
+
+// CalibrationFileStore is a CalibrationStore that keeps each calibration in
+// a JSON file named after its key
+type CalibrationFileStore struct {
+	Dir string
+}
+
+// NewCalibrationFileStore returns a CalibrationFileStore that keeps its
+// calibrations in dir
+func NewCalibrationFileStore(dir string) *CalibrationFileStore {
+	return &CalibrationFileStore{Dir: dir}
+}
+
+func (fs *CalibrationFileStore) path(key CalibrationKey) string {
+	return filepath.Join(fs.Dir, key.String()+".json")
+}
+
+// Save writes the calibration to a temporary file and renames it over the old
+// one so a crash never leaves a partial calibration behind
+func (fs *CalibrationFileStore) Save(c *Calibration) error {
+	if err := os.MkdirAll(fs.Dir, 0755); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(fs.Dir, "calibration-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fs.path(c.Key))
+}
+
+// Load reads the calibration of the key
+func (fs *CalibrationFileStore) Load(key CalibrationKey) (*Calibration, error) {
+	body, err := ioutil.ReadFile(fs.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Calibration{}
+	if err := json.Unmarshal(body, c); err != nil {
+		return nil, fmt.Errorf("calibration %s: %w", key, err)
+	}
+
+	return c, nil
+}
+
+// calibrationKey returns the key of the session's zero set index
+func (s *Session) calibrationKey(index int, zeros g.Zeros) CalibrationKey {
+	return CalibrationKey{
+		LatticeType:   s.Lattice.LatticeType,
+		VertexType:    s.Lattice.VertexType,
+		ZeroType:      zeros.ZeroType,
+		ZeroCount:     zeros.Count,
+		Scalar:        zeros.Scalar,
+		Negatives:     zeros.Negatives,
+		Combined:      index == len(s.ZLine.Zeros),
+		Angle:         s.ZLine.Angle,
+		BucketCount:   s.BucketCount,
+		DistanceLimit: s.DistanceLimit,
+		Window:        s.Window,
+		Scorer:        s.Scorer,
+	}
+}
+
+// calibrationKeys returns the key of each zero set zeroSets would return
+func (s *Session) calibrationKeys() []CalibrationKey {
+	keys := make([]CalibrationKey, 0, len(s.ZLine.Zeros)+1)
+	for i, zeros := range s.ZLine.Zeros {
+		keys = append(keys, s.calibrationKey(i, zeros))
+	}
+
+	if s.Combined && len(s.ZLine.Zeros) > 1 {
+		keys = append(keys, s.calibrationKey(len(s.ZLine.Zeros), unionZeros(s.ZLine.Zeros)))
+	}
+
+	return keys
+}
+
+// Calibrate scans origins random origins around the session's origin with
+// the session's settings, exactly as calculate would score them, and returns
+// the distribution of their best scores for each of the session's zero sets.
+// The origins only depend on the session's Seed and ID.
+func Calibrate(s *Session, origins int) ([]*Calibration, error) {
+	maxZero := s.ZLine.MaxZeroVal()
+	filtered := s.Lattice.Filter(s.ZLine.Origin, s.Radius, maxZero, s.DistanceLimit)
+	baselines, err := s.baselines(filtered)
+	if err != nil {
+		return nil, err
+	}
+	sets := s.zeroSets(filtered, baselines)
+
+	// refining doesn't change the score so the random origins aren't refined
+	unrefined := *s
+	unrefined.Refine = false
+
+	cals := make([]*Calibration, len(sets))
+	for i, set := range sets {
+		cals[i] = &Calibration{
+			Key:     s.calibrationKey(set.index, set.zeros),
+			Origins: origins,
+			Scores:  make([]float64, 0, origins),
+		}
+	}
+
+	sampler := &randomSampler{rng: s.jobRand(calibrationProc), center: s.ZLine.Origin, radius: s.Radius}
+	batch := make([]g.Vector2, kernelBatch)
+
+	for start := 0; start < origins; start += kernelBatch {
+		n := origins - start
+		if n > kernelBatch {
+			n = kernelBatch
+		}
+
+		drawBatch(sampler, batch[:n])
+
+		// the index of each origin in the batch
+		origin := make(map[g.Vector2]int, n)
+		for j, o := range batch[:n] {
+			origin[o] = j
+		}
+
+		for i := range sets {
+			scored, err := unrefined.scoreBatch(sets[i:i+1], calibrationProc, start, batch[:n])
+			if err != nil {
+				return nil, err
+			}
+
+			// every bucket tied for best has a result, and with scorers
+			// other than Ratio a score of its own, so each origin counts
+			// once with its best score
+			best := make([]float64, n)
+			seen := make([]bool, n)
+			for _, r := range scored {
+				j := origin[r.Origin]
+				if !seen[j] || r.Score > best[j] {
+					best[j], seen[j] = r.Score, true
+				}
+			}
+
+			for j := range best {
+				if seen[j] {
+					cals[i].add(best[j])
+				}
+			}
+		}
+	}
+
+	for _, c := range cals {
+		c.finish()
+	}
+
+	return cals, nil
+}
+
+// calibrate looks up the calibration of each of the session's zero sets in
+// Calibrations. A session with a Percentile calibrates the sets it couldn't
+// find and saves them.
+func (s *Session) calibrate() error {
+	s.calibrations = nil
+	keys := s.calibrationKeys()
+
+	// keyed by the index of the zero set, like a result's slug
+	cals := make(map[int]*Calibration)
+	if Calibrations != nil {
+		for i, key := range keys {
+			c, err := Calibrations.Load(key)
+			if err != nil {
+				return err
+			}
+			if c != nil {
+				cals[i] = c
+			}
+		}
+	}
+
+	if s.Percentile > 0 && len(cals) < len(keys) {
+		log.Println("[session] calibrating session", s.ID, "with", calibrationOrigins, "random origins")
+		made, err := Calibrate(s, calibrationOrigins)
+		if err != nil {
+			return err
+		}
+
+		for i, c := range made {
+			if cals[i] != nil {
+				continue
+			}
+			cals[i] = c
+
+			if Calibrations != nil {
+				if err := Calibrations.Save(c); err != nil {
+					log.Println("[session] failed to save calibration", c.Key, err)
+				}
+			}
+		}
+	}
+
+	if len(cals) > 0 {
+		s.calibrations = cals
+	}
+
+	return nil
+}
+
+// keeps reports whether a result is good enough to publish. Once calibrated,
+// a session with a Percentile keeps the results that score at least as well
+// as that percentile of random origins, otherwise results need MinScore.
+func (s *Session) keeps(r Result) bool {
+	if s.Percentile > 0 && r.PValue > 0 {
+		return r.PValue <= 1-s.Percentile/100
+	}
+	return r.Score >= s.MinScore
+}
+
+// calibrateCmd calibrates a session read from a file and stores the
+// calibrations
+func calibrateCmd(ctx *cli.Context) error {
+	body, err := ioutil.ReadFile(ctx.String("session"))
+	if err != nil {
+		return err
+	}
+
+	s := &Session{}
+	if err := json.Unmarshal(body, s); err != nil {
+		return err
+	}
+
+	if err := Restore(s); err != nil {
+		return err
+	}
+
+	cals, err := Calibrate(s, ctx.Int("origins"))
+	if err != nil {
+		return err
+	}
+
+	store := NewCalibrationFileStore(ctx.String("dir"))
+	for _, c := range cals {
+		if err := store.Save(c); err != nil {
+			return err
+		}
+
+		log.Println("[calibrate]", c.Key, "mean:", c.Mean, "stddev:", c.StdDev,
+			"p99:", c.Threshold(99), "p99.9:", c.Threshold(99.9))
+	}
+
+	return nil
+}
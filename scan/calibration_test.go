@@ -0,0 +1,193 @@
+package scan
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCalibrationStatistics(t *testing.T) {
+	c := &Calibration{}
+	for _, score := range []float64{.4, .1, .2, .3, .2} {
+		c.add(score)
+	}
+	c.finish()
+
+	if !sort.Float64sAreSorted(c.Scores) {
+		t.Log("expected sorted scores, got", c.Scores)
+		t.Fail()
+	}
+
+	tests := []struct {
+		score float64
+		want  float64
+	}{
+		{.5, 1.0 / 6}, // better than every origin
+		{.4, 2.0 / 6},
+		{.2, 5.0 / 6}, // ties count as at least as good
+		{0, 1},
+	}
+
+	for _, test := range tests {
+		if got := c.PValue(test.score); got != test.want {
+			t.Log("p-value of", test.score, "expected", test.want, "got", got)
+			t.Fail()
+		}
+	}
+
+	if c.ZScore(c.Mean) != 0 || c.ZScore(c.Mean+c.StdDev) < .999 {
+		t.Log("unexpected z-scores around mean", c.Mean, "stddev", c.StdDev)
+		t.Fail()
+	}
+
+	if got := c.Threshold(80); got != .3 {
+		t.Log("expected the 80th percentile to be .3, got", got)
+		t.Fail()
+	}
+
+	if got := c.Threshold(100); got != .4 {
+		t.Log("expected the 100th percentile to be .4, got", got)
+		t.Fail()
+	}
+}
+
+func TestCalibrateIsReproducible(t *testing.T) {
+	first, err := Calibrate(testSession(0), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := Calibrate(testSession(0), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first) != 1 || len(first[0].Scores) != 64 {
+		t.Fatal("expected one calibration of 64 scores")
+	}
+
+	if !reflect.DeepEqual(first[0].Scores, second[0].Scores) {
+		t.Log("calibrating the same session twice gave different scores")
+		t.Fail()
+	}
+}
+
+func TestCalibrateCountsEachOriginOnce(t *testing.T) {
+	for _, st := range []ScorerType{RatioScorer, WeightedScorer, ContrastScorer, SignificanceScorer} {
+		s := testSession(0)
+		s.Scorer = st
+
+		// a window ties neighboring buckets, which other scorers than Ratio
+		// score apart
+		s.Window = 5
+
+		cals, err := Calibrate(s, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(cals[0].Scores) != 64 {
+			t.Fatal(st, "calibrated", len(cals[0].Scores), "scores from 64 origins")
+		}
+	}
+}
+
+func TestCalibrationKeys(t *testing.T) {
+	s := testSession(0)
+	base := s.calibrationKeys()[0]
+
+	s.ZLine.Angle = 30
+	if s.calibrationKeys()[0] == base {
+		t.Log("expected sessions at another angle to have another key")
+		t.Fail()
+	}
+
+	s = testSession(0)
+	s.ZLine.Zeros[0].Negatives = true
+	if key := s.calibrationKeys()[0]; key == base || key.String() == base.String() {
+		t.Log("expected sessions with negative zeros to have another key")
+		t.Fail()
+	}
+
+	// refining doesn't change scores so sessions share calibrations
+	s = testSession(0)
+	s.Refine = true
+	if s.calibrationKeys()[0] != base {
+		t.Log("expected refined sessions to share the key")
+		t.Fail()
+	}
+}
+
+func TestCalibrationFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calibrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewCalibrationFileStore(dir)
+	s := testSession(0)
+	key := s.calibrationKeys()[0]
+
+	c, err := store.Load(key)
+	if err != nil || c != nil {
+		t.Fatal("expected no calibration before saving one, got", c, err)
+	}
+
+	saved := &Calibration{Key: key, Origins: 3, Scores: []float64{.1, .2, .3}}
+	saved.finish()
+	if err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = store.Load(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c == nil || !reflect.DeepEqual(c.Scores, saved.Scores) || c.Key != key {
+		t.Log("expected", saved, "got", c)
+		t.Fail()
+	}
+}
+
+func TestPercentileSession(t *testing.T) {
+	defer func(origins int) { calibrationOrigins = origins }(calibrationOrigins)
+	calibrationOrigins = 256
+
+	s := testSession(64)
+	s.MinScore = .01
+	s.Percentile = 50
+
+	results := collect(t, s)
+	if len(results) == 0 {
+		t.Fatal("expected some results above the median")
+	}
+
+	for _, r := range results {
+		if r.PValue == 0 || r.PValue > .5 {
+			t.Log(r.Slug, "has p-value", r.PValue, "below the median")
+			t.Fail()
+		}
+
+		if r.ZScore <= 0 {
+			t.Log(r.Slug, "has z-score", r.ZScore, "expected above the mean")
+			t.Fail()
+		}
+
+		if _, err := Verify(s, r); err != nil {
+			t.Log(r.Slug, err)
+			t.Fail()
+		}
+	}
+
+	// without a percentile every result that meets MinScore is kept
+	all := testSession(64)
+	all.MinScore = .01
+	if len(collect(t, all)) <= len(results) {
+		t.Log("expected the percentile to keep fewer results than MinScore")
+		t.Fail()
+	}
+}
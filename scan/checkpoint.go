@@ -0,0 +1,236 @@
+package scan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	g "github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// checkpointEvery is how many origins a scan job scans between checkpoints
+// when it has no results to publish
+const checkpointEvery = 64 * kernelBatch
+
+// Checkpoint is the progress of one scan job. Samplers are deterministic so
+// the number of origins completed is all it takes to put a job's sampler back
+// where it was, except for a Refiner, whose state is saved with it.
+type Checkpoint struct {
+	SessionID int64
+	ProcID    int
+	ProcCount int
+
+	// Completed is the number of origins whose results have all been
+	// published
+	Completed int
+
+	// Published are the slugs of results already published for the origins
+	// from Completed on, so they aren't published twice when the job resumes
+	Published []string
+
+	// Sampler is the state of a Refiner once it drew the origins before
+	// Completed and observed their results
+	Sampler *SamplerState `json:",omitempty"`
+
+	Updated time.Time
+}
+
+// CheckpointStore saves and loads scan job checkpoints
+type CheckpointStore interface {
+	// Save replaces the checkpoint of the job
+	Save(cp Checkpoint) error
+
+	// Load returns the checkpoints of every job of the session, ordered by
+	// ProcID. A session without any checkpoints is not an error.
+	Load(sessionID int64) ([]Checkpoint, error)
+
+	// Delete removes the checkpoints of the session
+	Delete(sessionID int64) error
+}
+
+// Checkpoints is where Run saves checkpoints and Restore looks for them. When
+// it is nil sessions are not checkpointed.
+var Checkpoints CheckpointStore
+
+// FileStore is a CheckpointStore that keeps each job's checkpoint in a JSON
+// file under a directory per session
+type FileStore struct {
+	Dir string
+}
+
+// NewFileStore returns a FileStore that keeps its checkpoints under dir
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{Dir: dir}
+}
+
+func (fs *FileStore) sessionDir(sessionID int64) string {
+	return filepath.Join(fs.Dir, strconv.FormatInt(sessionID, 10))
+}
+
+// Save writes the checkpoint to a temporary file and renames it over the old
+// one so a crash never leaves a partial checkpoint behind
+func (fs *FileStore) Save(cp Checkpoint) error {
+	dir := fs.sessionDir(cp.SessionID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "checkpoint-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, fmt.Sprintf("%d.json", cp.ProcID)))
+}
+
+// Load reads every job checkpoint of the session
+func (fs *FileStore) Load(sessionID int64) ([]Checkpoint, error) {
+	paths, err := filepath.Glob(filepath.Join(fs.sessionDir(sessionID), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	cps := make([]Checkpoint, 0, len(paths))
+	for _, p := range paths {
+		body, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		cp := Checkpoint{}
+		if err := json.Unmarshal(body, &cp); err != nil {
+			return nil, fmt.Errorf("checkpoint %s: %w", p, err)
+		}
+		cps = append(cps, cp)
+	}
+
+	sort.Slice(cps, func(a, b int) bool {
+		return cps[a].ProcID < cps[b].ProcID
+	})
+
+	return cps, nil
+}
+
+// Delete removes the session's checkpoint directory
+func (fs *FileStore) Delete(sessionID int64) error {
+	return os.RemoveAll(fs.sessionDir(sessionID))
+}
+
+// loadCheckpoints picks up the progress of an earlier run of the session so
+// Start resumes it. The job split has to match the checkpoints so ProcCount
+// is taken from them.
+func (s *Session) loadCheckpoints(store CheckpointStore) error {
+	cps, err := store.Load(s.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(cps) == 0 {
+		return nil
+	}
+
+	s.resume = make(map[int]Checkpoint)
+	completed := 0
+	for _, cp := range cps {
+		s.resume[cp.ProcID] = cp
+		completed += cp.Completed
+	}
+	s.ProcCount = cps[0].ProcCount
+
+	log.Println("[session] resuming session", s.ID, "with", completed, "of", s.ScansReq, "origins already scanned")
+	return nil
+}
+
+// checkpoint returns the checkpoint of job procid. state is the sampler's
+// state at completed, from samplerState.
+func (s *Session) checkpoint(procid, completed int, published []string, state *SamplerState) *Checkpoint {
+	return &Checkpoint{
+		SessionID: s.ID,
+		ProcID:    procid,
+		ProcCount: s.ProcCount,
+		Completed: completed,
+		Published: published,
+		Sampler:   state,
+		Updated:   time.Now(),
+	}
+}
+
+// samplerState returns the state of a Refiner to checkpoint, or nil for
+// samplers that the number of origins completed is enough to restore
+func samplerState(sampler Sampler) *SamplerState {
+	refiner, ok := sampler.(Refiner)
+	if !ok {
+		return nil
+	}
+
+	state := refiner.State()
+	return &state
+}
+
+// restore puts a job's sampler back where its checkpoint left it. A Refiner
+// picks up from the state saved with it, and is only given its results again
+// by skip when the checkpoint predates saving it.
+func (s *Session) restore(sampler Sampler, sets []zeroSet, procid int, cp Checkpoint) error {
+	if refiner, ok := sampler.(Refiner); ok && cp.Sampler != nil {
+		refiner.Resume(*cp.Sampler)
+		return nil
+	}
+
+	return s.skip(sampler, sets, procid, cp.Completed)
+}
+
+// skip advances a job's sampler past the first n origins. Samplers that
+// refine on results need to see the same results they did the first time, so
+// for them the origins are scored again in the batches scanJob used.
+func (s *Session) skip(sampler Sampler, sets []zeroSet, procid, n int) error {
+	_, refines := sampler.(Refiner)
+	batch := make([]g.Vector2, kernelBatch)
+
+	for start := 0; start < n; start += kernelBatch {
+		size := n - start
+		if size > kernelBatch {
+			size = kernelBatch
+		}
+
+		drawBatch(sampler, batch[:size])
+
+		if !refines {
+			continue
+		}
+
+		scored, err := s.scoreBatch(sets, procid, start, batch[:size])
+		if err != nil {
+			return err
+		}
+
+		for _, result := range scored {
+			if s.keeps(result) {
+				observe(sampler, result)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package scan
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+
+	cps, err := store.Load(1)
+	if err != nil || len(cps) != 0 {
+		t.Fatal("expected no checkpoints for a new session but got", cps, err)
+	}
+
+	for _, procid := range []int{2, 0, 1} {
+		cp := Checkpoint{SessionID: 1, ProcID: procid, ProcCount: 3, Completed: 16 * procid}
+		if err := store.Save(cp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// saving again replaces the job's checkpoint
+	if err := store.Save(Checkpoint{SessionID: 1, ProcID: 1, ProcCount: 3, Completed: 64, Published: []string{"1-10-1-64-0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cps, err = store.Load(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cps) != 3 {
+		t.Fatal("expected 3 checkpoints but got", len(cps))
+	}
+
+	for i, cp := range cps {
+		if cp.ProcID != i {
+			t.Fatal("expected checkpoints in proc id order but got", cp.ProcID, "at", i)
+		}
+	}
+
+	if cps[1].Completed != 64 || !reflect.DeepEqual(cps[1].Published, []string{"1-10-1-64-0"}) {
+		t.Log("expected the second save to replace the first but got", cps[1])
+		t.Fail()
+	}
+
+	if err := store.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if cps, _ := store.Load(1); len(cps) != 0 {
+		t.Fatal("expected no checkpoints after delete but got", cps)
+	}
+}
+
+// batchesByJob runs a session and returns the batches each job sent in order
+func batchesByJob(t *testing.T, s *Session) map[int][]Batch {
+	ch, err := s.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(map[int][]Batch)
+	for batch := range ch {
+		if batch.Err != nil {
+			t.Fatal(batch.Err)
+		}
+		if batch.Progress != nil {
+			continue
+		}
+		if batch.Checkpoint == nil {
+			t.Fatal("expected every batch to carry a checkpoint")
+		}
+
+		procid := batch.Checkpoint.ProcID
+		jobs[procid] = append(jobs[procid], batch)
+	}
+
+	return jobs
+}
+
+// resultKey identifies a result. Results tied at one origin share a slug.
+func resultKey(r Result) string {
+	return r.Slug + "/" + r.String()
+}
+
+// checkResume pretends the scanner died after each job published its
+// crashAt'th batch and checks that resuming publishes exactly what is missing
+func checkResume(t *testing.T, newSession func() *Session, crashAt int) {
+	full := batchesByJob(t, newSession())
+
+	expected := make(map[string]bool)
+	published := make(map[string]bool)
+
+	s := newSession()
+	s.resume = make(map[int]Checkpoint)
+
+	for procid, batches := range full {
+		for i, batch := range batches {
+			for _, r := range batch.Results {
+				expected[resultKey(r)] = true
+				if i <= crashAt {
+					published[resultKey(r)] = true
+				}
+			}
+		}
+
+		if crashAt < len(batches) {
+			s.resume[procid] = *batches[crashAt].Checkpoint
+		}
+	}
+
+	if len(published) == 0 || len(published) == len(expected) {
+		t.Fatal("expected the crash to happen part way through the session")
+	}
+
+	resumed := make(map[string]bool)
+	for _, batches := range batchesByJob(t, s) {
+		for _, batch := range batches {
+			for _, r := range batch.Results {
+				key := resultKey(r)
+				if published[key] {
+					t.Fatal("result published again after resuming:", r)
+				}
+				if resumed[key] {
+					t.Fatal("result published twice by the resumed session:", r)
+				}
+				resumed[key] = true
+			}
+		}
+	}
+
+	if len(published)+len(resumed) != len(expected) {
+		t.Log("expected", len(expected), "results but", len(published), "were published before the crash and",
+			len(resumed), "after")
+		t.Fail()
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	for _, crashAt := range []int{0, 2} {
+		checkResume(t, func() *Session { return testSession(256) }, crashAt)
+	}
+}
+
+func TestResumeAdaptiveSampler(t *testing.T) {
+	newSession := func() *Session {
+		s := testSession(256)
+		s.Sampler = AdaptiveSampler
+		return s
+	}
+	checkResume(t, newSession, 1)
+
+	// the sampler's state is saved so resuming doesn't score every
+	// completed origin again to rebuild it
+	for procid, batches := range batchesByJob(t, newSession()) {
+		for _, batch := range batches {
+			if batch.Checkpoint.Sampler == nil {
+				t.Fatal("job", procid, "checkpointed without its sampler state")
+			}
+		}
+	}
+}
+
+func TestRestoreLoadsCheckpoints(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	store.Save(Checkpoint{SessionID: 42, ProcID: 0, ProcCount: 3, Completed: 32})
+	store.Save(Checkpoint{SessionID: 42, ProcID: 2, ProcCount: 3, Completed: 48})
+
+	s := testSession(256)
+	if err := s.loadCheckpoints(store); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ProcCount != 3 {
+		t.Log("expected the proc count of the checkpoints but got", s.ProcCount)
+		t.Fail()
+	}
+
+	if s.resume[0].Completed != 32 || s.resume[1].Completed != 0 || s.resume[2].Completed != 48 {
+		t.Log("unexpected resume state", s.resume)
+		t.Fail()
+	}
+}
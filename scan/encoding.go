@@ -0,0 +1,143 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shamaton/msgpack"
+)
+
+// Encoding enumeration selects how results are encoded on the message bus
+type Encoding int
+
+const (
+	// JSONEncoding encodes results as a JSON array, which every consumer
+	// can read
+	JSONEncoding Encoding = iota
+
+	// MsgpackEncoding encodes results with MessagePack
+	MsgpackEncoding
+
+	// ProtobufEncoding encodes results as the ResultBatch message in
+	// result.proto
+	ProtobufEncoding
+)
+
+// ResultEncoding is how Run encodes the results it publishes. Consumers
+// built before content types only read JSON, so the binary encodings are
+// left for scanners to opt into once consumers are upgraded.
+var ResultEncoding = JSONEncoding
+
+// String returns the string representation of the Encoding enum
+func (e Encoding) String() string {
+	return [...]string{
+		"JSON", "Msgpack", "Protobuf",
+	}[e]
+}
+
+// GetEncoding returns an Encoding from its string representation
+func (e Encoding) GetEncoding(name string) (Encoding, error) {
+	switch strings.ToLower(name) {
+	case "json", "":
+		return JSONEncoding, nil
+	case "msgpack":
+		return MsgpackEncoding, nil
+	case "protobuf", "proto":
+		return ProtobufEncoding, nil
+	default:
+		return 0, errors.New("Unknown encoding")
+	}
+}
+
+// ContentType returns the MIME type of results in the encoding
+func (e Encoding) ContentType() string {
+	return [...]string{
+		"application/json", "application/msgpack", "application/x-protobuf",
+	}[e]
+}
+
+// encodingOf returns the Encoding of a content type
+func encodingOf(contentType string) (Encoding, error) {
+	for _, e := range []Encoding{JSONEncoding, MsgpackEncoding, ProtobufEncoding} {
+		if e.ContentType() == contentType {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown result content type %q", contentType)
+}
+
+// MarshalResults encodes the results, to be published with the encoding's
+// ContentType
+func MarshalResults(e Encoding, results []Result) ([]byte, error) {
+	switch e {
+	case JSONEncoding:
+		return json.Marshal(results)
+	case MsgpackEncoding:
+		return msgpack.Encode(results)
+	case ProtobufEncoding:
+		return marshalResultBatch(results)
+	default:
+		return nil, fmt.Errorf("unknown encoding %d", e)
+	}
+}
+
+// UnmarshalResults decodes results of the content type from the results
+// topic and returns the encoding they were in. Results published before
+// envelopes have no content type and are bare JSON, either an array or a
+// single result.
+func UnmarshalResults(contentType string, payload []byte) ([]Result, Encoding, error) {
+	if contentType == "" {
+		return decodeBareJSON(payload)
+	}
+
+	e, err := encodingOf(contentType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return unmarshalResults(e, payload)
+}
+
+// unmarshalResults decodes results in the encoding
+func unmarshalResults(e Encoding, payload []byte) ([]Result, Encoding, error) {
+	if e == JSONEncoding {
+		return decodeBareJSON(payload)
+	}
+
+	results := make([]Result, 0)
+
+	var err error
+	switch e {
+	case MsgpackEncoding:
+		err = msgpack.Decode(payload, &results)
+	case ProtobufEncoding:
+		results, err = unmarshalResultBatch(payload)
+	}
+
+	if err != nil {
+		return nil, e, fmt.Errorf("decoding %v results: %w", e, err)
+	}
+
+	return results, e, nil
+}
+
+// decodeBareJSON decodes results in bare JSON
+func decodeBareJSON(body []byte) ([]Result, Encoding, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		r := Result{}
+		if err := json.Unmarshal(trimmed, &r); err != nil {
+			return nil, JSONEncoding, err
+		}
+		return []Result{r}, JSONEncoding, nil
+	}
+
+	results := make([]Result, 0)
+	if err := json.Unmarshal(trimmed, &results); err != nil {
+		return nil, JSONEncoding, err
+	}
+	return results, JSONEncoding, nil
+}
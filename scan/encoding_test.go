@@ -0,0 +1,141 @@
+package scan
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+func encodingTestResults() []Result {
+	return []Result{
+		{
+			Slug:       "42-37-1-1234-0",
+			SessionID:  42,
+			Origin:     geom.Vector2{X: 1.5, Y: -2.25},
+			ZeroType:   geom.Zeta,
+			ZerosCount: 100,
+			ZerosHit:   37,
+			BestTheta:  12.5,
+			BestBucket: 12,
+			ZeroIDs:    []int{0, 3, 64, 99},
+			AvgParity:  .5,
+			Score:      .37,
+			Scorer:     "Ratio",
+			PValue:     .01,
+			ZScore:     2.5,
+			Window:     3,
+			Refined:    true,
+		},
+		{Slug: "42-10-0-1-1", SessionID: 42, Score: .1, Combined: true},
+	}
+}
+
+func TestEncodingsRoundTrip(t *testing.T) {
+	want := encodingTestResults()
+
+	for _, e := range []Encoding{JSONEncoding, MsgpackEncoding, ProtobufEncoding} {
+		body, err := MarshalResults(e, want)
+		if err != nil {
+			t.Fatal(e, err)
+		}
+
+		got, enc, err := UnmarshalResults(e.ContentType(), body)
+		if err != nil {
+			t.Fatal(e, err)
+		}
+
+		if enc != e {
+			t.Log("expected encoding", e, "got", enc)
+			t.Fail()
+		}
+
+		// encodings differ on whether an empty slice survives
+		for i := range got {
+			if len(got[i].ZeroIDs) == 0 {
+				got[i].ZeroIDs = nil
+			}
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Log(e, "expected", want, "got", got)
+			t.Fail()
+		}
+	}
+}
+
+func TestProtobufIsSmallerThanJSON(t *testing.T) {
+	results := encodingTestResults()
+
+	jsonBody, err := MarshalResults(JSONEncoding, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protoBody, err := MarshalResults(ProtobufEncoding, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(protoBody) >= len(jsonBody) {
+		t.Log("expected protobuf", len(protoBody), "bytes to be smaller than JSON", len(jsonBody))
+		t.Fail()
+	}
+}
+
+func TestUnmarshalBareJSON(t *testing.T) {
+	want := encodingTestResults()
+
+	batch, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// results published before envelopes have no content type
+	got, enc, err := UnmarshalResults("", batch)
+	if err != nil || enc != JSONEncoding || len(got) != len(want) || got[0].Slug != want[0].Slug {
+		t.Log("unexpected decoding of a bare JSON batch:", got, enc, err)
+		t.Fail()
+	}
+
+	single, err := json.Marshal(want[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err = UnmarshalResults("", single)
+	if err != nil || len(got) != 1 || got[0].Slug != want[0].Slug {
+		t.Log("unexpected decoding of a bare JSON result:", got, err)
+		t.Fail()
+	}
+}
+
+func TestDefaultEncodingIsBareJSON(t *testing.T) {
+	body, err := MarshalResults(ResultEncoding, encodingTestResults())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make([]Result, 0)
+	if err := json.Unmarshal(body, &results); err != nil || len(results) != 2 {
+		t.Fatal("expected the default encoding to be readable as plain JSON but got", err)
+	}
+}
+
+func TestUnmarshalRejectsBadResults(t *testing.T) {
+	body, err := MarshalResults(MsgpackEncoding, encodingTestResults())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := UnmarshalResults("application/x-unknown", body); err == nil {
+		t.Log("expected an error decoding an unknown content type")
+		t.Fail()
+	}
+
+	if _, _, err := UnmarshalResults(MsgpackEncoding.ContentType(), body[:len(body)-3]); err == nil {
+		t.Log("expected an error decoding truncated results")
+		t.Fail()
+	}
+}
@@ -0,0 +1,94 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	g "github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// The kinds of error a scan can fail with. Errors caused by a session or the
+// data it scans wrap one of them so callers can decide what to do with
+// errors.Is.
+var (
+	// ErrInvalidSession means the session can never be scanned, no matter
+	// how many times it is retried
+	ErrInvalidSession = errors.New("invalid session")
+
+	// ErrNumericFault means the scan math produced a value it can't use,
+	// like a NaN angle or a bucket out of range
+	ErrNumericFault = errors.New("numeric fault")
+
+	// ErrPublish means results could not be marshaled or published. These
+	// are usually transient so the session is worth retrying.
+	ErrPublish = errors.New("publish failure")
+
+	// ErrCancelled means the session was cancelled before it completed.
+	// Whatever results it found were published.
+	ErrCancelled = errors.New("session cancelled")
+)
+
+// InvalidSessionError lists the problems that make a session unscannable
+type InvalidSessionError struct {
+	SessionID int64
+	Problems  []string
+}
+
+func (e *InvalidSessionError) Error() string {
+	return fmt.Sprint("invalid session ", e.SessionID, ": ", strings.Join(e.Problems, "; "))
+}
+
+// Is makes errors.Is(err, ErrInvalidSession) true
+func (e *InvalidSessionError) Is(target error) bool {
+	return target == ErrInvalidSession
+}
+
+// NumericFaultError is returned when an angle can't be placed in a bucket
+type NumericFaultError struct {
+	SessionID   int64
+	Origin      g.Vector2
+	Zero        float64
+	Theta       float64
+	Bucket      int
+	BucketCount int
+}
+
+func (e *NumericFaultError) Error() string {
+	return fmt.Sprint("numeric fault in session ", e.SessionID, ": bucket ", e.Bucket,
+		" out of range [0, ", e.BucketCount, ") for theta ", e.Theta,
+		" at origin ", e.Origin, " zero ", e.Zero)
+}
+
+// Is makes errors.Is(err, ErrNumericFault) true
+func (e *NumericFaultError) Is(target error) bool {
+	return target == ErrNumericFault
+}
+
+// PublishError wraps the error from marshaling or publishing to a topic
+type PublishError struct {
+	SessionID int64
+	Topic     string
+	Err       error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprint("publishing session ", e.SessionID, " to ", e.Topic, ": ", e.Err)
+}
+
+// Is makes errors.Is(err, ErrPublish) true
+func (e *PublishError) Is(target error) bool {
+	return target == ErrPublish
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable returns true when a session that failed with err may succeed if
+// it is scanned again. Invalid sessions and numeric faults fail the same way
+// every time and cancelled sessions shouldn't be scanned again.
+func Retryable(err error) bool {
+	return !errors.Is(err, ErrInvalidSession) && !errors.Is(err, ErrNumericFault) &&
+		!errors.Is(err, ErrCancelled)
+}
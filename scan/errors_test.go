@@ -0,0 +1,90 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		err       error
+		kind      error
+		retryable bool
+	}{
+		{&InvalidSessionError{Problems: []string{"no zeros"}}, ErrInvalidSession, false},
+		{&NumericFaultError{Bucket: -1, BucketCount: 360}, ErrNumericFault, false},
+		{&PublishError{Topic: ResultTopic, Err: errors.New("connection refused")}, ErrPublish, true},
+		{fmt.Errorf("wrapped: %w", &NumericFaultError{}), ErrNumericFault, false},
+		{context.Canceled, nil, true},
+		{fmt.Errorf("session 1: %w", ErrCancelled), ErrCancelled, false},
+	}
+
+	for _, test := range tests {
+		if test.kind != nil && !errors.Is(test.err, test.kind) {
+			t.Log(test.err, "should be a", test.kind)
+			t.Fail()
+		}
+
+		if Retryable(test.err) != test.retryable {
+			t.Log(test.err, "expected retryable to be", test.retryable)
+			t.Fail()
+		}
+	}
+}
+
+func TestCalculateNaNAngle(t *testing.T) {
+	_, err := calculate(geom.Vector2{}, kernelTestLattice(100, 10), kernelTestPrimes, nil, 2, math.NaN(), 360)
+
+	var fault *NumericFaultError
+	if !errors.As(err, &fault) {
+		t.Fatal("expected a numeric fault but got", err)
+	}
+}
+
+func TestWrapDegreesInfinite(t *testing.T) {
+	for _, deg := range []float64{math.Inf(1), math.Inf(-1), math.NaN()} {
+		if w := wrapDegrees(deg); !math.IsNaN(w) {
+			t.Log("wrapDegrees(", deg, ") =", w, "expected NaN")
+			t.Fail()
+		}
+	}
+
+	if w := wrapDegrees(1e20); w < 0 || w >= 360 {
+		t.Log("wrapDegrees(1e20) =", w, "which is outside [0, 360)")
+		t.Fail()
+	}
+}
+
+func TestStartReportsNumericFault(t *testing.T) {
+	s := testSession(64)
+	s.ZLine.Angle = math.NaN()
+
+	ch, err := s.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faults := 0
+	for batch := range ch {
+		if batch.Err == nil {
+			continue
+		}
+
+		var fault *NumericFaultError
+		if !errors.As(batch.Err, &fault) || fault.SessionID != s.ID {
+			t.Fatal("expected a numeric fault for session", s.ID, "but got", batch.Err)
+		}
+		faults++
+	}
+
+	// every job fails on its first batch
+	if faults != s.ProcCount {
+		t.Log("expected", s.ProcCount, "faults but got", faults)
+		t.Fail()
+	}
+}
@@ -0,0 +1,192 @@
+package scan
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// kernelBatch is the number of origins a scanJob hands the kernel at once
+const kernelBatch = 16
+
+// kernel is the batched version of calculate. It scores many origins against
+// the same lattice points and zeros in one lattice-major pass so each lattice
+// point is loaded once per batch instead of once per origin.
+//
+// Lattice coordinates and zeros are kept in flat float64 slices and the hit
+// matrix is one reusable bitset per (origin, bucket), with one bit per zero.
+// The angle math is exactly the math in allAngles so the output of
+// bestBuckets is bit-identical to getBestBuckets(calculate(...)).
+type kernel struct {
+	lx, ly []float64 // lattice point coordinates
+	zeros  []float64 // zero values
+	zsq    []float64 // zero values squared
+
+	// zsqSorted is true when zsq is non-decreasing, which lets us binary
+	// search for the zeros that can possibly be within the distance limit
+	zsqSorted bool
+
+	limit        float64
+	limitSq      float64
+	angle        float64 // ZLine angle the bucket angles are measured from
+	bucketCount  int
+	degPerBucket float64
+
+	// window is the number of neighbouring buckets scored together, see
+	// countWindows. 0 and 1 score each bucket on its own.
+	window int
+
+	words  int      // uint64 words per bucket bitset
+	bits   []uint64 // [origin][bucket][word]
+	counts []int    // scratch for bestBuckets
+	n      int      // origins in the current batch
+}
+
+func newKernel(lattice []geom.Vector2, zeros []float64, limit, angle float64, bucketCount int) *kernel {
+	k := &kernel{
+		lx:           make([]float64, len(lattice)),
+		ly:           make([]float64, len(lattice)),
+		zeros:        zeros,
+		zsq:          make([]float64, len(zeros)),
+		zsqSorted:    true,
+		limit:        limit,
+		limitSq:      limit * limit,
+		angle:        angle,
+		bucketCount:  bucketCount,
+		degPerBucket: 360.0 / float64(bucketCount),
+		words:        (len(zeros) + 63) / 64,
+		counts:       make([]int, bucketCount),
+	}
+
+	for i, pt := range lattice {
+		k.lx[i] = pt.X
+		k.ly[i] = pt.Y
+	}
+
+	for i, zero := range zeros {
+		k.zsq[i] = zero * zero
+		if i > 0 && k.zsq[i] < k.zsq[i-1] {
+			k.zsqSorted = false
+		}
+	}
+
+	k.bits = make([]uint64, kernelBatch*bucketCount*k.words)
+
+	return k
+}
+
+// run scores up to kernelBatch origins. The results stay in the kernel until
+// the next call to run.
+func (k *kernel) run(origins []geom.Vector2) error {
+	if len(origins) > kernelBatch {
+		return fmt.Errorf("[kernel] batch of %d origins is larger than %d", len(origins), kernelBatch)
+	}
+
+	k.n = len(origins)
+	used := k.bits[:k.n*k.bucketCount*k.words]
+	for i := range used {
+		used[i] = 0
+	}
+
+	for p := range k.lx {
+		lx, ly := k.lx[p], k.ly[p]
+
+		for o, origin := range origins {
+			dx := lx - origin.X
+			dy := ly - origin.Y
+			rsq := dx*dx + dy*dy
+
+			// A zero only produces angles when rsq - zsq lands in
+			// [0, limit²]. Skip the zeros that are certainly too small
+			// (with a little slack for rounding) and stop at the first one
+			// that is too large. The exact test below decides the rest.
+			first := 0
+			if k.zsqSorted {
+				min := rsq - k.limitSq - 1e-9*(rsq+k.limitSq)
+				first = sort.SearchFloat64s(k.zsq, min)
+			}
+
+			row := used[o*k.bucketCount*k.words : (o+1)*k.bucketCount*k.words]
+
+			for i := first; i < len(k.zsq); i++ {
+				zsq := k.zsq[i]
+				if zsq > rsq {
+					if k.zsqSorted {
+						break
+					}
+					continue
+				}
+
+				distance := math.Sqrt(rsq - zsq)
+				if distance > k.limit {
+					continue
+				}
+
+				zero := k.zeros[i]
+				theta1 := wrapDegrees(lineAngle(dx, dy, zero, distance, 1) - k.angle)
+				theta2 := wrapDegrees(lineAngle(dx, dy, zero, distance, -1) - k.angle)
+
+				b1 := int(math.Floor(theta1 / k.degPerBucket))
+				b2 := int(math.Floor(theta2 / k.degPerBucket))
+
+				if err := checkBucket(b1, k.bucketCount, origin, zero, theta1); err != nil {
+					return err
+				}
+				if err := checkBucket(b2, k.bucketCount, origin, zero, theta2); err != nil {
+					return err
+				}
+
+				word, mask := i/64, uint64(1)<<uint(i%64)
+				row[b1*k.words+word] |= mask
+				row[b2*k.words+word] |= mask
+			}
+		}
+	}
+
+	return nil
+}
+
+// hits returns the number of zeros hit in bucket b for origin o of the last
+// batch
+func (k *kernel) hits(o, b int) int {
+	start := (o*k.bucketCount + b) * k.words
+	count := 0
+	for _, w := range k.bits[start : start+k.words] {
+		count += bits.OnesCount64(w)
+	}
+	return count
+}
+
+// zeroIDs returns the indices of the zeros hit in bucket b, or its window, for
+// origin o of the last batch in ascending order
+func (k *kernel) zeroIDs(o, b int) []int {
+	ids := make([]int, 0)
+	for word := 0; word < k.words; word++ {
+		for w := k.windowWord(o, b, word); w != 0; w &= w - 1 {
+			ids = append(ids, word*64+bits.TrailingZeros64(w))
+		}
+	}
+
+	return ids
+}
+
+// bestBuckets is getBestBuckets for origin o of the last batch. When the
+// kernel has a window the buckets are scored with countWindows and only the
+// middle of each run of tied buckets is kept.
+func (k *kernel) bestBuckets(o int) []bucketHits {
+	for b := range k.counts {
+		if k.window > 1 {
+			k.counts[b] = k.windowCount(o, b)
+		} else {
+			k.counts[b] = k.hits(o, b)
+		}
+	}
+
+	if k.window > 1 {
+		return centerRuns(bestOf(rankHits(k.counts)), k.bucketCount)
+	}
+	return bestOf(rankHits(k.counts))
+}
@@ -0,0 +1,194 @@
+package scan
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+func kernelTestLattice(n int, extent float64) []geom.Vector2 {
+	rnd := rand.New(rand.NewSource(7))
+	points := make([]geom.Vector2, n)
+	for i := range points {
+		points[i] = geom.Vector2{
+			X: (rnd.Float64()*2 - 1) * extent,
+			Y: (rnd.Float64()*2 - 1) * extent,
+		}
+	}
+	return points
+}
+
+func kernelTestOrigins(n int) []geom.Vector2 {
+	rnd := rand.New(rand.NewSource(11))
+	origins := make([]geom.Vector2, n)
+	for i := range origins {
+		origins[i] = geom.Vector2{X: rnd.Float64()*2 - 1, Y: rnd.Float64()*2 - 1}
+	}
+	return origins
+}
+
+var kernelTestPrimes = []float64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47,
+	53, 59, 61, 67, 71, 73, 79, 83, 89, 97}
+
+// mustCalculate is calculate for tests that don't expect it to fail
+func mustCalculate(tb testing.TB, origin geom.Vector2, lattice []geom.Vector2, zeros []float64, latticeParams interface{}, limit, angle float64, bucketCount int) [][]int {
+	buckets, err := calculate(origin, lattice, zeros, latticeParams, limit, angle, bucketCount)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return buckets
+}
+
+// checkKernel compares the kernel against calculate for every origin
+func checkKernel(t *testing.T, lattice, origins []geom.Vector2, zeros []float64, limit, angle float64, bucketCount int) {
+	k := newKernel(lattice, zeros, limit, angle, bucketCount)
+
+	for start := 0; start < len(origins); start += kernelBatch {
+		end := start + kernelBatch
+		if end > len(origins) {
+			end = len(origins)
+		}
+		batch := origins[start:end]
+		if err := k.run(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		for j, origin := range batch {
+			buckets := mustCalculate(t, origin, lattice, zeros, nil, limit, angle, bucketCount)
+
+			for b := range buckets {
+				count := 0
+				for _, hit := range buckets[b] {
+					count += hit
+				}
+				if count != k.hits(j, b) {
+					t.Fatal("origin", origin, "bucket", b, "expected", count, "hits but kernel had", k.hits(j, b))
+				}
+			}
+
+			expected := getBestBuckets(buckets)
+			actual := k.bestBuckets(j)
+			if !reflect.DeepEqual(expected, actual) {
+				t.Log("origin", origin, "limit", limit, "buckets", bucketCount)
+				t.Log("\texpected", expected)
+				t.Log("\tactual  ", actual)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestKernelMatchesCalculate(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origins := kernelTestOrigins(kernelBatch*2 + 3) // a partial batch at the end
+
+	for _, limit := range []float64{.5, 1, 8, math.MaxFloat64} {
+		for _, bucketCount := range []int{360, 3600} {
+			checkKernel(t, lattice, origins, kernelTestPrimes, limit, 0, bucketCount)
+		}
+	}
+}
+
+func TestKernelRotatedZLine(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origins := kernelTestOrigins(kernelBatch)
+
+	for _, angle := range []float64{7, 90, 233.5, -45} {
+		checkKernel(t, lattice, origins, kernelTestPrimes, 2, angle, 3600)
+	}
+}
+
+func TestKernelNegativeZeros(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origins := kernelTestOrigins(kernelBatch)
+
+	// the same layout LoadZeros uses when Negatives is set
+	zeros := make([]float64, 0, len(kernelTestPrimes)*2)
+	for _, p := range kernelTestPrimes {
+		zeros = append(zeros, p, -p)
+	}
+
+	checkKernel(t, lattice, origins, zeros, 2, 0, 3600)
+}
+
+func TestKernelUnsortedZeros(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origins := kernelTestOrigins(kernelBatch)
+
+	zeros := make([]float64, len(kernelTestPrimes))
+	for i, p := range kernelTestPrimes {
+		zeros[len(zeros)-1-i] = p
+	}
+
+	k := newKernel(lattice, zeros, 2, 0, 3600)
+	if k.zsqSorted {
+		t.Fatal("expected descending zeros to be detected as unsorted")
+	}
+
+	checkKernel(t, lattice, origins, zeros, 2, 0, 3600)
+}
+
+func TestKernelManyZeros(t *testing.T) {
+	lattice := kernelTestLattice(500, 100)
+	origins := kernelTestOrigins(4)
+
+	// more than 64 zeros so the bitsets span several words
+	zeros := make([]float64, 150)
+	for i := range zeros {
+		zeros[i] = float64(i) * .6
+	}
+
+	checkKernel(t, lattice, origins, zeros, 4, 0, 3600)
+}
+
+func TestKernelPinwheelGolden(t *testing.T) {
+	lattice, err := geom.NewLattice(geom.Pinwheel, geom.Vertices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zeros := geom.Zeros{
+		ZeroType:  geom.Primes,
+		Scalar:    1,
+		Negatives: false,
+	}
+	if err := geom.LoadZeros(&zeros, 100); err != nil {
+		t.Fatal("LoadZeros", err)
+	}
+
+	maxZero := zeros.Values[len(zeros.Values)-1]
+	points := lattice.Filter(geom.Vector2{}, 1, maxZero, 1)
+
+	checkKernel(t, points, kernelTestOrigins(kernelBatch), zeros.Values, 1, 0, 3600)
+}
+
+func BenchmarkCalculate(b *testing.B) {
+	lattice := kernelTestLattice(20000, 110)
+	origins := kernelTestOrigins(kernelBatch)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, origin := range origins {
+			getBestBuckets(mustCalculate(b, origin, lattice, kernelTestPrimes, nil, 1, 0, 3600))
+		}
+	}
+}
+
+func BenchmarkKernel(b *testing.B) {
+	lattice := kernelTestLattice(20000, 110)
+	origins := kernelTestOrigins(kernelBatch)
+	k := newKernel(lattice, kernelTestPrimes, 1, 0, 3600)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := k.run(origins); err != nil {
+			b.Fatal(err)
+		}
+		for j := range origins {
+			k.bestBuckets(j)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package scan
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/chriscow/cloud-scanner-go/util"
+	"github.com/nsqio/go-nsq"
+)
+
+// Schema versions of the payloads published to each topic. Bump one, and
+// register an upgrade from the old version below, whenever a change to its
+// struct would break consumers still running the old one.
+const (
+	SessionVersion  = 1 // Session on SessionTopic and CompleteTopic
+	ResultsVersion  = 1 // results from MarshalResults on ResultTopic
+	ProgressVersion = 1 // Progress on ProgressTopic
+	CancelVersion   = 1 // Cancel on CancelTopic
+)
+
+func init() {
+	util.RegisterType(SessionTopic, SessionVersion, fromBareJSON)
+	util.RegisterType(CompleteTopic, SessionVersion, fromBareJSON)
+	util.RegisterType(DeadLetterTopic, SessionVersion, fromBareJSON)
+	util.RegisterType(ResultTopic, ResultsVersion, fromBareJSON)
+	util.RegisterType(ProgressTopic, ProgressVersion, fromBareJSON)
+	util.RegisterType(CancelTopic, CancelVersion, fromBareJSON)
+}
+
+// fromBareJSON upgrades version 0, the bare JSON published before messages
+// had envelopes. Its structs are the same as version 1's so there is nothing
+// to change, and UnmarshalResults still reads bare JSON results.
+func fromBareJSON(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+// publishJSON marshals v and publishes it to the topic in an envelope
+func publishJSON(producer *nsq.Producer, topic string, v interface{}, traceID string) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return util.Publish(producer, topic, body, traceID)
+}
+
+// PublishSession publishes a session request, or a completed session, in an
+// envelope traced by the session's TraceID
+func PublishSession(producer *nsq.Producer, topic string, s Session) error {
+	if err := publishJSON(producer, topic, s, s.TraceID); err != nil {
+		return &PublishError{SessionID: s.ID, Topic: topic, Err: err}
+	}
+	return nil
+}
+
+// DecodeSession returns the session in an envelope. The session inherits the
+// envelope's TraceID if it doesn't have its own.
+func DecodeSession(env *util.Envelope) (Session, error) {
+	s := Session{}
+	if err := json.Unmarshal(env.Payload, &s); err != nil {
+		return s, err
+	}
+
+	if s.TraceID == "" {
+		s.TraceID = env.TraceID
+	}
+	return s, nil
+}
+
+// SessionHandler handles the sessions on SessionTopic or CompleteTopic
+type SessionHandler func(msg *nsq.Message, s Session) error
+
+// HandleEnvelope decodes the session and calls h. A session that can't be
+// decoded is dropped.
+func (h SessionHandler) HandleEnvelope(msg *nsq.Message, env *util.Envelope) error {
+	s, err := DecodeSession(env)
+	if err != nil {
+		log.Println("[scan] dropping", env.Type, "message from", env.Producer, err)
+		return nil
+	}
+	return h(msg, s)
+}
+
+// ResultsHandler handles the batches of results on ResultTopic along with
+// the encoding they were published in
+type ResultsHandler func(msg *nsq.Message, results []Result, e Encoding) error
+
+// HandleEnvelope decodes the results and calls h. Results that can't be
+// decoded are dropped.
+func (h ResultsHandler) HandleEnvelope(msg *nsq.Message, env *util.Envelope) error {
+	results, e, err := UnmarshalResults(env.ContentType, env.Payload)
+	if err != nil {
+		log.Println("[scan] dropping results from", env.Producer, err)
+		return nil
+	}
+	return h(msg, results, e)
+}
+
+// ProgressHandler handles the progress on ProgressTopic
+type ProgressHandler func(msg *nsq.Message, p Progress) error
+
+// HandleEnvelope decodes the progress and calls h. Progress that can't be
+// decoded is dropped.
+func (h ProgressHandler) HandleEnvelope(msg *nsq.Message, env *util.Envelope) error {
+	p := Progress{}
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		log.Println("[scan] dropping progress from", env.Producer, err)
+		return nil
+	}
+
+	if p.TraceID == "" {
+		p.TraceID = env.TraceID
+	}
+	return h(msg, p)
+}
+
+// CancelHandler handles the cancels on CancelTopic
+type CancelHandler func(msg *nsq.Message, c Cancel) error
+
+// HandleEnvelope decodes the cancel and calls h. A cancel that can't be
+// decoded is dropped.
+func (h CancelHandler) HandleEnvelope(msg *nsq.Message, env *util.Envelope) error {
+	c := Cancel{}
+	if err := json.Unmarshal(env.Payload, &c); err != nil {
+		log.Println("[scan] dropping cancel from", env.Producer, err)
+		return nil
+	}
+	return h(msg, c)
+}
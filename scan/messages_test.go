@@ -0,0 +1,75 @@
+package scan
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/chriscow/cloud-scanner-go/util"
+	"github.com/nsqio/go-nsq"
+)
+
+func TestSessionHandlerInheritsTraceID(t *testing.T) {
+	body, err := json.Marshal(Session{ID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := util.Wrap(SessionTopic, body, "request-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Session
+	router := util.NewRouter(nil).Handle(SessionTopic, SessionHandler(func(msg *nsq.Message, s Session) error {
+		got = s
+		return nil
+	}))
+
+	if err := router.ForTopic(SessionTopic).HandleMessage(nsq.NewMessage(nsq.MessageID{}, wrapped)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != 7 || got.TraceID != "request-1" {
+		t.Log("expected session 7 traced by request-1, got", got.ID, got.TraceID)
+		t.Fail()
+	}
+
+	// sessions published before envelopes are still handled
+	if err := router.ForTopic(SessionTopic).HandleMessage(nsq.NewMessage(nsq.MessageID{}, body)); err != nil || got.TraceID != "" {
+		t.Log("expected a bare session without a trace, got", got.TraceID, err)
+		t.Fail()
+	}
+}
+
+func TestResultsHandlerReadsContentTypes(t *testing.T) {
+	want := encodingTestResults()
+
+	for _, e := range []Encoding{JSONEncoding, MsgpackEncoding, ProtobufEncoding} {
+		payload, err := MarshalResults(e, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the envelope names the content type of the results
+		wrapped, err := util.WrapContent(ResultTopic, e.ContentType(), payload, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []Result
+		var enc Encoding
+		router := util.NewRouter(nil).Handle(ResultTopic, ResultsHandler(func(msg *nsq.Message, results []Result, e Encoding) error {
+			got, enc = results, e
+			return nil
+		}))
+
+		if err := router.ForTopic(ResultTopic).HandleMessage(nsq.NewMessage(nsq.MessageID{}, wrapped)); err != nil {
+			t.Fatal(err)
+		}
+
+		if enc != e || len(got) != len(want) || got[0].Slug != want[0].Slug {
+			t.Log(e, "results changed on the way through:", enc, got)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package scan
+
+import (
+	"context"
+	"runtime"
+)
+
+// procPool limits how many scan jobs score a kernel batch at once across
+// every session in the process. Jobs take turns at the pool a batch at a time
+// so sessions running side by side share the CPU fairly, whatever their
+// ProcCount.
+type procPool chan struct{}
+
+// procs is the pool every scan job in the process shares
+var procs = newProcPool(runtime.GOMAXPROCS(0))
+
+func newProcPool(size int) procPool {
+	if size < 1 {
+		size = 1
+	}
+	return make(procPool, size)
+}
+
+// SetProcs sizes the pool shared by every session's scan jobs. It must be
+// called before any session starts.
+func SetProcs(size int) {
+	procs = newProcPool(size)
+}
+
+// acquire waits for a turn at the pool. It returns false without a turn if
+// the context is done first.
+func (pp procPool) acquire(ctx context.Context) bool {
+	select {
+	case pp <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release ends a turn
+func (pp procPool) release() {
+	<-pp
+}
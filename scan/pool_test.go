@@ -0,0 +1,109 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcPoolLimitsTurns(t *testing.T) {
+	pool := newProcPool(2)
+	ctx := context.Background()
+
+	if !pool.acquire(ctx) || !pool.acquire(ctx) {
+		t.Fatal("expected two turns from a pool of two")
+	}
+
+	// a third turn waits until the context is done
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if pool.acquire(timeout) {
+		t.Fatal("expected the pool to be full")
+	}
+
+	pool.release()
+	if !pool.acquire(ctx) {
+		t.Fatal("expected a turn once one was released")
+	}
+}
+
+func TestMaxProcsCapsJobs(t *testing.T) {
+	s := testSession(100)
+	s.ProcCount = 0
+	s.MaxProcs = 1
+	if err := s.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ProcCount != 1 {
+		t.Fatal("expected MaxProcs to cap the jobs at 1 but got", s.ProcCount)
+	}
+
+	s.MaxProcs = -1
+	if err := s.Validate(); err == nil {
+		t.Fatal("expected negative max procs to be invalid")
+	}
+}
+
+// mixedSessions is a workload of a few large sessions and many small ones
+func mixedSessions() []*Session {
+	sessions := make([]*Session, 0)
+	for i := 0; i < 8; i++ {
+		scans := 64
+		if i%4 == 0 {
+			scans = 1024
+		}
+
+		s := testSession(scans)
+		s.ID = int64(i + 1)
+		s.ProcCount = 0
+		s.MaxProcs = 2
+		s.Normalize()
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// BenchmarkMixedWorkload scans a mix of session sizes with different numbers
+// of workers, each scanning one session at a time like the scanner's
+// concurrent handlers
+func BenchmarkMixedWorkload(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprint("workers-", workers), func(b *testing.B) {
+			scans := 0
+			start := time.Now()
+
+			for n := 0; n < b.N; n++ {
+				queue := make(chan *Session)
+				wg := &sync.WaitGroup{}
+				wg.Add(workers)
+
+				for w := 0; w < workers; w++ {
+					go func() {
+						defer wg.Done()
+						for s := range queue {
+							ch, err := s.Start(context.Background())
+							if err != nil {
+								b.Error(err)
+								continue
+							}
+							for range ch {
+							}
+						}
+					}()
+				}
+
+				for _, s := range mixedSessions() {
+					scans += s.ScansReq
+					queue <- s
+				}
+				close(queue)
+				wg.Wait()
+			}
+
+			b.ReportMetric(float64(scans)/time.Since(start).Seconds(), "scans/s")
+		})
+	}
+}
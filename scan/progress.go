@@ -0,0 +1,188 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// ProgressTopic is where scanners report what they are doing with a session
+const ProgressTopic = "session-progress"
+
+// SessionState enumeration is where a session is in its lifecycle. Sessions
+// move from queued to running to one of the final states.
+type SessionState int
+
+const (
+	// Queued sessions have been requested but no scanner has started them
+	Queued SessionState = iota
+
+	// Running sessions are being scanned
+	Running
+
+	// Completed sessions have published all their results
+	Completed
+
+	// Failed sessions could not be scanned
+	Failed
+
+	// Cancelled sessions were stopped before they completed
+	Cancelled
+)
+
+// String returns the string representation of the SessionState enum
+func (st SessionState) String() string {
+	return [...]string{
+		"Queued", "Running", "Completed", "Failed", "Cancelled",
+	}[st]
+}
+
+// GetSState returns a SessionState from its string representation
+func (st SessionState) GetSState(name string) (SessionState, error) {
+	switch strings.ToLower(name) {
+	case "queued":
+		return Queued, nil
+	case "running":
+		return Running, nil
+	case "completed":
+		return Completed, nil
+	case "failed":
+		return Failed, nil
+	case "cancelled", "canceled":
+		return Cancelled, nil
+	default:
+		return 0, errors.New("Unknown session state")
+	}
+}
+
+// Final returns true once the session can't change state again
+func (st SessionState) Final() bool {
+	return st >= Completed
+}
+
+// progressEvery is how often a running session reports its progress
+var progressEvery = 5 * time.Second
+
+// Progress is published to ProgressTopic when a scanner changes the state of
+// a session, and every so often while the session runs
+type Progress struct {
+	SessionID int64
+	ParentID  int64 `json:",omitempty"`
+	State     SessionState
+
+	// Worker identifies the scanner
+	Worker string `json:",omitempty"`
+
+	// Error is why the session failed
+	Error string `json:",omitempty"`
+
+	// Scanned is the number of origins scanned so far and Results the
+	// number of results that met MinScore
+	Scanned  int `json:",omitempty"`
+	ScansReq int `json:",omitempty"`
+	Results  int `json:",omitempty"`
+
+	// ScansPerSec is the rate since the last progress event and ETA how
+	// long the rest of the session will take at that rate
+	ScansPerSec float64       `json:",omitempty"`
+	ETA         time.Duration `json:",omitempty"`
+
+	// TraceID is the TraceID of the session
+	TraceID string `json:",omitempty"`
+
+	Updated time.Time
+}
+
+// counters are shared by the scan jobs of a session to report its progress
+// and stop once it reaches its target
+type counters struct {
+	scanned  int64 // origins scanned, not counting those resumed past
+	found    int64 // results that met MinScore
+	targeted int64 // results that met TargetScore
+
+	// stop stops every job
+	stop context.CancelFunc
+}
+
+// progressMeter turns the session's counters into Progress events
+type progressMeter struct {
+	s       *Session
+	counts  *counters
+	resumed int
+	start   time.Time
+
+	last     time.Time
+	lastScan int64
+}
+
+func newProgressMeter(s *Session, counts *counters, resumed int, start time.Time) *progressMeter {
+	return &progressMeter{s: s, counts: counts, resumed: resumed, start: start, last: start}
+}
+
+// read returns the progress of the session at now
+func (pm *progressMeter) read(now time.Time) Progress {
+	scanned := atomic.LoadInt64(&pm.counts.scanned)
+
+	p := Progress{
+		SessionID: pm.s.ID,
+		ParentID:  pm.s.ParentID,
+		State:     Running,
+		Scanned:   pm.resumed + int(scanned),
+		ScansReq:  pm.s.ScansReq,
+		Results:   int(atomic.LoadInt64(&pm.counts.found)),
+		TraceID:   pm.s.TraceID,
+		Updated:   now,
+	}
+
+	if elapsed := now.Sub(pm.last).Seconds(); elapsed > 0 {
+		p.ScansPerSec = float64(scanned-pm.lastScan) / elapsed
+	}
+
+	if p.ScansPerSec > 0 && p.ScansReq > 0 {
+		remaining := float64(p.ScansReq - p.Scanned)
+		p.ETA = time.Duration(remaining / p.ScansPerSec * float64(time.Second))
+	}
+
+	// a budget ends the session early if it runs out first
+	if pm.s.Budget > 0 {
+		left := pm.s.Budget - now.Sub(pm.start)
+		if left < 0 {
+			left = 0
+		}
+		if p.ETA == 0 || left < p.ETA {
+			p.ETA = left
+		}
+	}
+
+	pm.last = now
+	pm.lastScan = scanned
+	return p
+}
+
+// Cancel is published to CancelTopic to stop a session. Cancelling a session
+// that was split into work units cancels all of them.
+type Cancel struct {
+	SessionID int64
+}
+
+// Cancels returns true if c stops s, either directly or through its parent
+func (c Cancel) Cancels(s *Session) bool {
+	return c.SessionID == s.ID || (s.ParentID != 0 && c.SessionID == s.ParentID)
+}
+
+// PublishProgress publishes the progress of a session to ProgressTopic
+func PublishProgress(producer *nsq.Producer, p Progress) error {
+	if p.Updated.IsZero() {
+		p.Updated = time.Now()
+	}
+
+	if err := publishJSON(producer, ProgressTopic, p, p.TraceID); err != nil {
+		return &PublishError{SessionID: p.SessionID, Topic: ProgressTopic, Err: err}
+	}
+
+	return nil
+}
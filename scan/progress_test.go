@@ -0,0 +1,91 @@
+package scan
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionStateStrings(t *testing.T) {
+	for st := Queued; st <= Cancelled; st++ {
+		parsed, err := st.GetSState(st.String())
+		if err != nil || parsed != st {
+			t.Log("state", st, "did not round trip:", parsed, err)
+			t.Fail()
+		}
+	}
+
+	if Running.Final() || !Cancelled.Final() {
+		t.Fatal("only completed, failed and cancelled sessions are final")
+	}
+}
+
+func TestStartReportsProgress(t *testing.T) {
+	defer func(every time.Duration) { progressEvery = every }(progressEvery)
+	progressEvery = time.Millisecond
+
+	s := testSession(2000)
+	ch, err := s.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := 0
+	var last *Progress
+	for batch := range ch {
+		if batch.Err != nil {
+			t.Fatal(batch.Err)
+		}
+
+		results += len(batch.Results)
+		if batch.Progress == nil {
+			continue
+		}
+
+		if last != nil && batch.Progress.Scanned < last.Scanned {
+			t.Fatal("progress went backwards from", last.Scanned, "to", batch.Progress.Scanned)
+		}
+		last = batch.Progress
+	}
+
+	if last == nil {
+		t.Fatal("expected progress events")
+	}
+
+	if last.SessionID != s.ID || last.Scanned != s.ScansReq || last.ScansReq != s.ScansReq {
+		t.Log("the last progress event should show the session done but was", *last)
+		t.Fail()
+	}
+
+	if last.Results != results {
+		t.Log("progress counted", last.Results, "results but", results, "were sent")
+		t.Fail()
+	}
+}
+
+func TestProgressMeterETA(t *testing.T) {
+	s := testSession(1000)
+	counts := &counters{}
+	start := time.Now()
+	meter := newProgressMeter(s, counts, 100, start)
+
+	counts.scanned = 300
+	p := meter.read(start.Add(3 * time.Second))
+
+	if p.Scanned != 400 || p.ScansPerSec != 100 {
+		t.Fatal("expected 400 scanned at 100 scans/sec but got", p.Scanned, p.ScansPerSec)
+	}
+
+	if p.ETA != 6*time.Second {
+		t.Log("expected 600 origins to take 6s but the ETA is", p.ETA)
+		t.Fail()
+	}
+
+	// the rate is since the last reading
+	counts.scanned = 500
+	p = meter.read(start.Add(4 * time.Second))
+	if p.ScansPerSec != 200 {
+		t.Log("expected the current rate to be 200 scans/sec but was", p.ScansPerSec)
+		t.Fail()
+	}
+}
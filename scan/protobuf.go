@@ -0,0 +1,361 @@
+package scan
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	g "github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("protobuf message is truncated")
+
+// marshalResultBatch encodes the results as the ResultBatch message in
+// result.proto
+func marshalResultBatch(results []Result) ([]byte, error) {
+	w := &protoWriter{}
+	for _, r := range results {
+		body, err := marshalResult(r)
+		if err != nil {
+			return nil, err
+		}
+		w.message(1, body)
+	}
+	return w.buf, nil
+}
+
+// unmarshalResultBatch decodes a ResultBatch message
+func unmarshalResultBatch(b []byte) ([]Result, error) {
+	results := make([]Result, 0)
+	r := &protoReader{buf: b}
+
+	for len(r.buf) > 0 {
+		field, wire, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if field != 1 || wire != wireBytes {
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		body, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := unmarshalResult(body)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+func marshalResult(r Result) ([]byte, error) {
+	w := &protoWriter{}
+	w.bytes(1, []byte(r.Slug))
+	w.varint(2, r.SessionID)
+
+	origin := &protoWriter{}
+	origin.double(1, r.Origin.X)
+	origin.double(2, r.Origin.Y)
+	w.message(3, origin.buf)
+
+	w.varint(4, int64(r.ZeroType))
+	w.varint(5, int64(r.ZerosCount))
+	w.varint(6, int64(r.ZerosHit))
+	w.double(7, r.BestTheta)
+	w.varint(8, int64(r.BestBucket))
+
+	ids := &protoWriter{}
+	for _, id := range r.ZeroIDs {
+		ids.uvarint(uint64(int64(id)))
+	}
+	w.bytes(9, ids.buf)
+
+	w.double(10, r.AvgParity)
+
+	if r.LatticeParams != nil {
+		params, err := json.Marshal(r.LatticeParams)
+		if err != nil {
+			return nil, err
+		}
+		w.bytes(11, params)
+	}
+
+	w.double(12, r.Score)
+	w.bytes(13, []byte(r.Scorer))
+	w.double(14, r.PValue)
+	w.double(15, r.ZScore)
+	w.boolean(16, r.Combined)
+	w.varint(17, int64(r.Window))
+	w.boolean(18, r.Refined)
+
+	return w.buf, nil
+}
+
+func unmarshalResult(b []byte) (Result, error) {
+	res := Result{}
+	r := &protoReader{buf: b}
+
+	for len(r.buf) > 0 {
+		field, wire, err := r.next()
+		if err != nil {
+			return res, err
+		}
+
+		switch {
+		case wire == wireVarint:
+			v, err := r.uvarint()
+			if err != nil {
+				return res, err
+			}
+			setResultVarint(&res, field, int64(v))
+
+		case wire == wireFixed64:
+			v, err := r.fixed64()
+			if err != nil {
+				return res, err
+			}
+			setResultDouble(&res, field, math.Float64frombits(v))
+
+		case wire == wireBytes:
+			body, err := r.bytes()
+			if err != nil {
+				return res, err
+			}
+			if err := setResultBytes(&res, field, body); err != nil {
+				return res, err
+			}
+
+		default:
+			if err := r.skip(wire); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func setResultVarint(res *Result, field int, v int64) {
+	switch field {
+	case 2:
+		res.SessionID = v
+	case 4:
+		res.ZeroType = g.ZeroType(v)
+	case 5:
+		res.ZerosCount = int(v)
+	case 6:
+		res.ZerosHit = int(v)
+	case 8:
+		res.BestBucket = int(v)
+	case 9: // an unpacked zero id
+		res.ZeroIDs = append(res.ZeroIDs, int(v))
+	case 16:
+		res.Combined = v != 0
+	case 17:
+		res.Window = int(v)
+	case 18:
+		res.Refined = v != 0
+	}
+}
+
+func setResultDouble(res *Result, field int, v float64) {
+	switch field {
+	case 7:
+		res.BestTheta = v
+	case 10:
+		res.AvgParity = v
+	case 12:
+		res.Score = v
+	case 14:
+		res.PValue = v
+	case 15:
+		res.ZScore = v
+	}
+}
+
+func setResultBytes(res *Result, field int, b []byte) error {
+	switch field {
+	case 1:
+		res.Slug = string(b)
+	case 3:
+		origin := &protoReader{buf: b}
+		for len(origin.buf) > 0 {
+			field, wire, err := origin.next()
+			if err != nil {
+				return err
+			}
+			if wire != wireFixed64 {
+				if err := origin.skip(wire); err != nil {
+					return err
+				}
+				continue
+			}
+
+			v, err := origin.fixed64()
+			if err != nil {
+				return err
+			}
+			switch field {
+			case 1:
+				res.Origin.X = math.Float64frombits(v)
+			case 2:
+				res.Origin.Y = math.Float64frombits(v)
+			}
+		}
+	case 9: // packed zero ids
+		ids := &protoReader{buf: b}
+		for len(ids.buf) > 0 {
+			v, err := ids.uvarint()
+			if err != nil {
+				return err
+			}
+			res.ZeroIDs = append(res.ZeroIDs, int(int64(v)))
+		}
+	case 11:
+		return json.Unmarshal(b, &res.LatticeParams)
+	case 13:
+		res.Scorer = string(b)
+	}
+
+	return nil
+}
+
+// protoWriter appends protobuf fields to buf, leaving out zero values as
+// proto3 does
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field, wire int) {
+	w.uvarint(uint64(field<<3 | wire))
+}
+
+func (w *protoWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf = append(w.buf, b[:n]...)
+}
+
+func (w *protoWriter) varint(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, wireVarint)
+	w.uvarint(uint64(v))
+}
+
+func (w *protoWriter) boolean(field int, v bool) {
+	if v {
+		w.varint(field, 1)
+	}
+}
+
+func (w *protoWriter) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, wireFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *protoWriter) bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	w.message(field, b)
+}
+
+// message writes b even when it is empty, so a message field is present
+func (w *protoWriter) message(field int, b []byte) {
+	w.tag(field, wireBytes)
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// protoReader reads protobuf fields from the front of buf
+type protoReader struct {
+	buf []byte
+}
+
+func (r *protoReader) next() (field, wire int, err error) {
+	key, err := r.uvarint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (r *protoReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if len(r.buf) < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return v, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	size, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)) < size {
+		return nil, errTruncated
+	}
+	b := r.buf[:size]
+	r.buf = r.buf[size:]
+	return b, nil
+}
+
+// skip passes over a field this version doesn't know
+func (r *protoReader) skip(wire int) error {
+	switch wire {
+	case wireVarint:
+		_, err := r.uvarint()
+		return err
+	case wireFixed64:
+		_, err := r.fixed64()
+		return err
+	case wireBytes:
+		_, err := r.bytes()
+		return err
+	case wireFixed32:
+		if len(r.buf) < 4 {
+			return errTruncated
+		}
+		r.buf = r.buf[4:]
+		return nil
+	default:
+		return fmt.Errorf("unsupported protobuf wire type %d", wire)
+	}
+}
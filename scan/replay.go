@@ -0,0 +1,201 @@
+package scan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	g "github.com/chriscow/cloud-scanner-go/geom"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ReplayCommand recomputes a stored result from the session it came from and
+// verifies its score
+var ReplayCommand = &cli.Command{
+	Name:      "replay",
+	Usage:     "recompute a result from its session and slug and verify its score",
+	ArgsUsage: "<slug>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "session", Usage: "session JSON the result was produced by", Required: true},
+		&cli.StringFlag{Name: "result", Usage: "stored result JSON to verify against"},
+	},
+	Action: replayCmd,
+}
+
+// ParseSlug splits a result slug created by SetSlug into its parts. The score
+// is the whole percentage the slug was created with.
+func ParseSlug(slug string) (sessionID int64, score, procid, originid, zeroset int, err error) {
+	parts := strings.Split(slug, "-")
+	if len(parts) != 5 {
+		return 0, 0, 0, 0, 0, fmt.Errorf("invalid slug %q: expected 5 parts but found %d", slug, len(parts))
+	}
+
+	if sessionID, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, 0, 0, 0, fmt.Errorf("invalid slug %q: session id: %w", slug, err)
+	}
+
+	ids := make([]int, 4)
+	names := []string{"score", "proc id", "origin id", "zero set"}
+	for i := range ids {
+		if ids[i], err = strconv.Atoi(parts[i+1]); err != nil {
+			return 0, 0, 0, 0, 0, fmt.Errorf("invalid slug %q: %s: %w", slug, names[i], err)
+		}
+	}
+
+	return sessionID, ids[0], ids[1], ids[2], ids[3], nil
+}
+
+// Replay regenerates the origin identified by the slug and rescans it exactly
+// as the session's scan job did. The session must have been restored, and for
+// the grid sampler ProcCount must be the one the scanner ran with. There is
+// one result for every bucket tied for best at that origin.
+func Replay(s *Session, slug string) ([]Result, error) {
+	sessionID, _, procid, originid, zeroset, err := ParseSlug(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if sessionID != s.ID {
+		return nil, fmt.Errorf("slug %q belongs to session %d not %d", slug, sessionID, s.ID)
+	}
+
+	if procid < 0 || originid < 0 {
+		return nil, fmt.Errorf("slug %q has a negative proc or origin id", slug)
+	}
+
+	// results are kept and given p-values just as they were in the scan
+	if err := s.calibrate(); err != nil {
+		return nil, err
+	}
+
+	maxZero := s.ZLine.MaxZeroVal()
+	filtered := s.Lattice.Filter(s.ZLine.Origin, s.Radius, maxZero, s.DistanceLimit)
+	baselines, err := s.baselines(filtered)
+	if err != nil {
+		return nil, err
+	}
+	sets := s.zeroSets(filtered, baselines)
+
+	if zeroset < 0 || zeroset >= len(sets) {
+		return nil, fmt.Errorf("slug %q has zero set %d but the session has %d", slug, zeroset, len(sets))
+	}
+
+	// origins come out of the job's sampler in order so draw them in the
+	// same batches scanJob does. Refining samplers also need to see the same
+	// results scanJob gave them before the origin we want.
+	sampler := s.newSampler(procid)
+	start := originid / kernelBatch * kernelBatch
+	if err := s.skip(sampler, sets, procid, start); err != nil {
+		return nil, err
+	}
+
+	batch := make([]g.Vector2, kernelBatch)
+	drawBatch(sampler, batch)
+
+	origin := batch[originid-start]
+	return s.scoreBatch(sets[zeroset:zeroset+1], procid, originid, []g.Vector2{origin})
+}
+
+// Verify replays a stored result and checks the recomputed origin and score
+// match it
+func Verify(s *Session, stored Result) (Result, error) {
+	results, err := Replay(s, stored.Slug)
+	if err != nil {
+		return Result{}, err
+	}
+
+	for _, r := range results {
+		if r.BestBucket != stored.BestBucket || r.ZeroType != stored.ZeroType || r.Combined != stored.Combined {
+			continue
+		}
+
+		if r.Origin != stored.Origin {
+			return r, fmt.Errorf("origin mismatch: stored %v recomputed %v", stored.Origin, r.Origin)
+		}
+
+		if r.Score != stored.Score || r.ZerosHit != stored.ZerosHit {
+			return r, fmt.Errorf("score mismatch: stored %v (%d hits) recomputed %v (%d hits)",
+				stored.Score, stored.ZerosHit, r.Score, r.ZerosHit)
+		}
+
+		return r, nil
+	}
+
+	return Result{}, fmt.Errorf("bucket %d is not a best bucket at the replayed origin", stored.BestBucket)
+}
+
+// replayCmd loads a session and either verifies a stored result or checks the
+// score embedded in the slug
+func replayCmd(ctx *cli.Context) error {
+	if ctx.NArg() < 1 && ctx.String("result") == "" {
+		return errors.New("Expected a result slug")
+	}
+
+	body, err := ioutil.ReadFile(ctx.String("session"))
+	if err != nil {
+		return err
+	}
+
+	s := Session{}
+	if err := json.Unmarshal(body, &s); err != nil {
+		return err
+	}
+
+	// Restore sizes the session for this machine but the grid sampler
+	// splits its cells by the proc count of the scanner that ran it
+	procCount := s.ProcCount
+	if err := Restore(&s); err != nil {
+		return err
+	}
+	if procCount > 0 {
+		s.ProcCount = procCount
+	}
+
+	if path := ctx.String("result"); path != "" {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		stored := Result{}
+		if err := json.Unmarshal(body, &stored); err != nil {
+			return err
+		}
+
+		r, err := Verify(&s, stored)
+		if err != nil {
+			return err
+		}
+
+		log.Println("[replay] verified", r)
+		return nil
+	}
+
+	slug := ctx.Args().Get(0)
+	_, score, _, _, _, err := ParseSlug(slug)
+	if err != nil {
+		return err
+	}
+
+	results, err := Replay(&s, slug)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		log.Println("[replay]", r)
+	}
+
+	// the slug only carries the whole percentage so that is all we can check
+	if results[0].Slug != slug {
+		return fmt.Errorf("score mismatch: slug has %d%% but replay scored %v", score, results[0].Score)
+	}
+
+	log.Println("[replay] verified", slug)
+	return nil
+}
@@ -0,0 +1,62 @@
+package scan
+
+import "testing"
+
+func TestParseSlug(t *testing.T) {
+	r := Result{SessionID: 1607280000000000001, Score: .37}
+	SetSlug(3, 1234, 1, &r)
+
+	id, score, procid, originid, zeroset, err := ParseSlug(r.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != r.SessionID || score != 37 || procid != 3 || originid != 1234 || zeroset != 1 {
+		t.Log("unexpected parts from", r.Slug, ":", id, score, procid, originid, zeroset)
+		t.Fail()
+	}
+
+	for _, slug := range []string{"", "1-2-3-4", "1-2-3-4-x", "a-2-3-4-5"} {
+		if _, _, _, _, _, err := ParseSlug(slug); err == nil {
+			t.Log("expected an error parsing", slug)
+			t.Fail()
+		}
+	}
+}
+
+func TestReplayVerifiesScanResults(t *testing.T) {
+	s := testSession(64)
+	results := collect(t, s)
+
+	if len(results) == 0 {
+		t.Fatal("expected some results from the test session")
+	}
+
+	for _, stored := range results {
+		if _, err := Verify(s, stored); err != nil {
+			t.Log(stored.Slug, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	s := testSession(64)
+	results := collect(t, s)
+
+	if len(results) == 0 {
+		t.Fatal("expected some results from the test session")
+	}
+
+	stored := results[0]
+	stored.Score += .01
+	if _, err := Verify(s, stored); err == nil {
+		t.Log("expected a score mismatch for", stored.Slug)
+		t.Fail()
+	}
+
+	if _, err := Replay(s, "1-00-0-0-0"); err == nil {
+		t.Log("expected an error replaying a slug from another session")
+		t.Fail()
+	}
+}
@@ -2,27 +2,58 @@ package scan
 
 import (
 	"fmt"
+	"github.com/chriscow/cloud-scanner-go/geom"
 	"log"
 	"math"
-	"github.com/chriscow/cloud-scanner-go/geom"
 	"sort"
 	"strconv"
 )
 
 // Result holds the data from a single scan and is serialized with MessagePack
 type Result struct {
-	Slug          string
-	SessionID     int64
-	Origin        geom.Vector2
-	ZeroType      geom.ZeroType
-	ZerosCount    int
-	ZerosHit      int
-	BestTheta     float64
-	BestBucket    int
-	ZeroIDs       []int
-	AvgParity     float64
+	Slug       string
+	SessionID  int64
+	Origin     geom.Vector2
+	ZeroType   geom.ZeroType
+	ZerosCount int
+	ZerosHit   int
+	BestTheta  float64
+	BestBucket int
+
+	// ZeroIDs are the indices into the zero values, or the union of the
+	// session's zero values for a Combined result, of the zeros hit in the
+	// best bucket
+	ZeroIDs []int
+
+	// AvgParity is the share of the zeros hit that are odd numbered in their
+	// sequence (the first, third, ...), counting a zero and its negative as
+	// one number. See avgParity. It is left 0 for Combined results, whose
+	// ZeroIDs index the union of several sequences so have no numbering.
+	AvgParity float64
+
+	// LatticeParams are the Parameters of the lattice the session scanned
 	LatticeParams interface{}
-	Score         float64
+
+	Score float64
+
+	// Scorer is the name of the Scorer that scored the result
+	Scorer string
+
+	// PValue is the fraction of random origins that scored at least as well
+	// and ZScore how many standard deviations the score is above theirs.
+	// Both are 0 when the session wasn't calibrated.
+	PValue float64 `json:",omitempty"`
+	ZScore float64 `json:",omitempty"`
+
+	// Combined is true when the result was scored against the union of all
+	// the session's zero sets rather than just the set of ZeroType
+	Combined bool
+
+	// Window is the number of neighbouring buckets that were scored together
+	// and Refined is true when BestTheta was refined within them rather than
+	// being the start of BestBucket
+	Window  int
+	Refined bool
 }
 
 func (r Result) String() string {
@@ -35,10 +66,12 @@ func (r Result) String() string {
 		" origin:", r.Origin, r.ZeroType)
 }
 
-// SetSlug returns a partial unique identifier for a key-value store
-func SetSlug(procid, originid int, r *Result) {
+// SetSlug returns a partial unique identifier for a key-value store. zeroset
+// is the index of the zero set in the session's ZLine the result was scored
+// against.
+func SetSlug(procid, originid, zeroset int, r *Result) {
 	score := int(r.Score * 100)
-	r.Slug = fmt.Sprintf("%d-%02d-%d-%d", r.SessionID, score, procid, originid)
+	r.Slug = fmt.Sprintf("%d-%02d-%d-%d-%d", r.SessionID, score, procid, originid, zeroset)
 }
 
 // bucketHits holds the tally of hits from within a bucket
@@ -55,15 +88,13 @@ func (zh bucketHits) String() string {
 
 // CreateResult creates a regular `zeros hit` result and scores it on the
 // percentage of zeros hit to total zeros
-func CreateResult(sessionid int64, procid, originid, bucketCount int, origin geom.Vector2, ztype geom.ZeroType, zcount int, bh bucketHits) Result {
+func CreateResult(sessionid int64, procid, originid, zeroset, bucketCount int, origin geom.Vector2, ztype geom.ZeroType, zcount int, bh bucketHits) Result {
 	if origin.X == 0 && origin.Y == 0 {
 		msg := fmt.Sprint("[createResult] received 0,0 origin")
 		log.Println(msg)
 	}
 
-	// trim off extranious decimal places since theta's precision is
-	// dependent on the number of buckets.  x2 just in case
-	places := math.Pow10(len(strconv.Itoa(bucketCount)) * 2)
+	places := precision(bucketCount)
 	score := math.Round(float64(bh.Hits)/float64(zcount)*places) / places
 	theta := math.Round(bh.Theta*places) / places
 
@@ -78,23 +109,38 @@ func CreateResult(sessionid int64, procid, originid, bucketCount int, origin geo
 		Score:      score,
 	}
 
-	SetSlug(procid, originid, &r)
+	SetSlug(procid, originid, zeroset, &r)
 	return r
 }
 
+// precision is the power of ten scores and thetas are rounded to. It trims
+// off extranious decimal places since theta's precision is dependent on the
+// number of buckets.  x2 just in case
+func precision(bucketCount int) float64 {
+	return math.Pow10(len(strconv.Itoa(bucketCount)) * 2)
+}
+
 // countHits returns a sorted list of the count of hits in each bucket
 func countHits(buckets [][]int) []bucketHits {
-	hits := make([]bucketHits, len(buckets))
-	degPerBucket := 360.0 / float64(len(buckets))
+	counts := make([]int, len(buckets))
 
 	for i, bucket := range buckets {
-		var count int
-
 		// the value in a bucket is either zero or one
 		for _, hit := range bucket {
-			count += hit
+			counts[i] += hit
 		}
+	}
+
+	return rankHits(counts)
+}
 
+// rankHits turns per-bucket hit counts into bucketHits sorted by hits, most
+// hits first
+func rankHits(counts []int) []bucketHits {
+	hits := make([]bucketHits, len(counts))
+	degPerBucket := 360.0 / float64(len(counts))
+
+	for i, count := range counts {
 		hits[i] = bucketHits{Bucket: i, Hits: count, Theta: float64(i) * degPerBucket}
 	}
 
@@ -105,6 +151,7 @@ func countHits(buckets [][]int) []bucketHits {
 	return hits
 }
 
+// getZerosHit returns the values of the zeros hit in a bucket
 func getZerosHit(bucket []int, zeros []float64) []float64 {
 	hits := make([]float64, 0)
 
@@ -114,14 +161,58 @@ func getZerosHit(bucket []int, zeros []float64) []float64 {
 		}
 	}
 
-	return zeros
+	return hits
+}
+
+// getZeroIDs returns the indices of the zeros hit in a bucket
+func getZeroIDs(bucket []int) []int {
+	ids := make([]int, 0)
+
+	for i := range bucket {
+		if bucket[i] > 0 {
+			ids = append(ids, i)
+		}
+	}
+
+	return ids
+}
+
+// avgParity returns the average parity of the zeros hit. A zero's parity is 1
+// when it is an odd numbered zero in its sequence (the first, third, ...) and
+// 0 when it is even, so a result that hits zeros without any preference has
+// an average parity of about one half. When the zeros include negatives
+// both signs of a zero share its number. An empty hit list has a parity of 0.
+func avgParity(ids []int, negatives bool) float64 {
+	if len(ids) == 0 {
+		return 0
+	}
+
+	odd := 0
+	for _, id := range ids {
+		if negatives {
+			// LoadZeros stores every value followed by its negative
+			id /= 2
+		}
+
+		// ids count from zero so the first zero is at an even index
+		if id%2 == 0 {
+			odd++
+		}
+	}
+
+	return float64(odd) / float64(len(ids))
 }
 
 // getResults finds the bucket(s) with the most hits and returns an array of
 // bucketHits structs with the top hit counts
 func getBestBuckets(buckets [][]int) []bucketHits {
+	return bestOf(countHits(buckets))
+}
+
+// bestOf returns the first of the ranked hits along with every other bucket
+// tied with it
+func bestOf(hits []bucketHits) []bucketHits {
 	results := make([]bucketHits, 0)
-	hits := countHits(buckets)
 
 	best := hits[0]
 	results = append(results, best)
@@ -0,0 +1,105 @@
+package scan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetZerosHit(t *testing.T) {
+	bucket := []int{0, 1, 1, 0, 1}
+	zeros := []float64{2, 3, 5, 7, 11}
+
+	hits := getZerosHit(bucket, zeros)
+	if !reflect.DeepEqual(hits, []float64{3, 5, 11}) {
+		t.Log("expected the values of the zeros hit but got", hits)
+		t.Fail()
+	}
+
+	ids := getZeroIDs(bucket)
+	if !reflect.DeepEqual(ids, []int{1, 2, 4}) {
+		t.Log("expected the indices of the zeros hit but got", ids)
+		t.Fail()
+	}
+}
+
+func TestAvgParity(t *testing.T) {
+	tests := []struct {
+		ids       []int
+		negatives bool
+		expected  float64
+	}{
+		{nil, false, 0},
+		{[]int{0, 2, 4}, false, 1},
+		{[]int{1, 3}, false, 0},
+		{[]int{0, 1, 2, 3}, false, .5},
+		{[]int{0, 1}, true, 1},         // the first zero and its negative
+		{[]int{2, 3, 4}, true, 1. / 3}, // the second zero twice and the third once
+	}
+
+	for _, test := range tests {
+		if parity := avgParity(test.ids, test.negatives); parity != test.expected {
+			t.Log(test.ids, "negatives", test.negatives, "expected parity", test.expected, "but got", parity)
+			t.Fail()
+		}
+	}
+}
+
+func TestKernelZeroIDs(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origins := kernelTestOrigins(kernelBatch)
+
+	// more than 64 zeros so the ids span several words
+	zeros := make([]float64, 150)
+	for i := range zeros {
+		zeros[i] = float64(i) * .6
+	}
+
+	k := newKernel(lattice, zeros, 4, 0, 3600)
+	if err := k.run(origins); err != nil {
+		t.Fatal(err)
+	}
+
+	for j, origin := range origins {
+		buckets := mustCalculate(t, origin, lattice, zeros, nil, 4, 0, 3600)
+
+		for _, bh := range k.bestBuckets(j) {
+			expected := getZeroIDs(buckets[bh.Bucket])
+			actual := k.zeroIDs(j, bh.Bucket)
+			if !reflect.DeepEqual(expected, actual) {
+				t.Log("origin", origin, "bucket", bh.Bucket)
+				t.Log("\texpected", expected)
+				t.Log("\tactual  ", actual)
+				t.Fail()
+			}
+
+			if len(actual) != bh.Hits {
+				t.Log("expected", bh.Hits, "zero ids but got", len(actual))
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestResultsCarryZeroIDs(t *testing.T) {
+	s := testSession(64)
+	s.Lattice.Parameters = map[string]interface{}{"iterations": 7}
+
+	results := collect(t, s)
+	if len(results) == 0 {
+		t.Fatal("expected some results from the test session")
+	}
+
+	for _, r := range results {
+		if len(r.ZeroIDs) != r.ZerosHit {
+			t.Fatal(r, "has", len(r.ZeroIDs), "zero ids but hit", r.ZerosHit)
+		}
+
+		if r.AvgParity != avgParity(r.ZeroIDs, false) {
+			t.Fatal(r, "has parity", r.AvgParity)
+		}
+
+		if !reflect.DeepEqual(r.LatticeParams, s.Lattice.Parameters) {
+			t.Fatal(r, "has lattice params", r.LatticeParams)
+		}
+	}
+}
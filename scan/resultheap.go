@@ -1,29 +1,88 @@
 package scan
 
-type resultHeap []Result
+// resultHeap is a container/heap of results with the worst result at the
+// root, so a bounded buffer of the best results can drop the worst in
+// O(log n). It keeps the index of every result by Slug so duplicates can be
+// found.
+type resultHeap struct {
+	results []Result
+	index   map[string]int
+}
+
+func newResultHeap(capacity int) *resultHeap {
+	return &resultHeap{
+		results: make([]Result, 0, capacity),
+		index:   make(map[string]int, capacity),
+	}
+}
+
+// ranksBelow returns true if a is a worse result than b. Results are ranked
+// by Score, then by ZerosHit, then by Slug so the order is always the same.
+func ranksBelow(a, b Result) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
 
-func (r resultHeap) Len() int {
-	return len(r)
+	if a.ZerosHit != b.ZerosHit {
+		return a.ZerosHit < b.ZerosHit
+	}
+
+	return a.Slug > b.Slug
+}
+
+func (r *resultHeap) Len() int {
+	return len(r.results)
 }
 
-func (r resultHeap) Less(i, j int) bool {
-	// we want the highest score so we use greater-than
-	return r[i].Score > r[j].Score
+func (r *resultHeap) Less(i, j int) bool {
+	// the worst result is at the root
+	return ranksBelow(r.results[i], r.results[j])
 }
 
-func (r resultHeap) Swap(i, j int) {
-	r[i], r[j] = r[j], r[i]
+func (r *resultHeap) Swap(i, j int) {
+	r.results[i], r.results[j] = r.results[j], r.results[i]
+	r.setIndex(i)
+	r.setIndex(j)
 }
 
-func (r resultHeap) Push(x interface{}) {
-	item := x.(Result)
-	r = append(r, item)
+func (r *resultHeap) Push(x interface{}) {
+	r.results = append(r.results, x.(Result))
+	r.setIndex(len(r.results) - 1)
 }
 
-func (r resultHeap) Pop() interface{} {
-	old := r
+func (r *resultHeap) Pop() interface{} {
+	old := r.results
 	n := len(old)
 	item := old[n-1]
-	r = old[:n-1]
+	r.results = old[:n-1]
+
+	if item.Slug != "" {
+		delete(r.index, item.Slug)
+	}
 	return item
 }
+
+// find returns the index of the result with the slug
+func (r *resultHeap) find(slug string) (int, bool) {
+	if slug == "" {
+		return 0, false
+	}
+
+	i, ok := r.index[slug]
+	return i, ok
+}
+
+func (r *resultHeap) setIndex(i int) {
+	if slug := r.results[i].Slug; slug != "" {
+		r.index[slug] = i
+	}
+}
+
+// reset replaces the results and reindexes them. The caller has to heap.Init.
+func (r *resultHeap) reset(results []Result) {
+	r.results = results
+	r.index = make(map[string]int, cap(results))
+	for i := range r.results {
+		r.setIndex(i)
+	}
+}
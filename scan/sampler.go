@@ -0,0 +1,372 @@
+package scan
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strings"
+
+	g "github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// SamplerType enumeration selects how a session picks the origins it scans
+type SamplerType int
+
+const (
+	// RandomSampler picks uniformly random origins in the square of side
+	// 2*Radius around the ZLine origin
+	RandomSampler SamplerType = iota
+
+	// GridSampler walks a regular grid over the square, spread across the
+	// session's jobs
+	GridSampler
+
+	// HaltonSampler uses the base 2, 3 Halton sequence over the square
+	HaltonSampler
+
+	// SobolSampler uses the two dimensional Sobol sequence over the square
+	SobolSampler
+
+	// DiskSampler picks uniformly random origins within Radius of the ZLine
+	// origin rather than in the square
+	DiskSampler
+
+	// AdaptiveSampler starts out random and then spends most of its origins
+	// near origins that already scored at least MinScore
+	AdaptiveSampler
+)
+
+// String returns the string representation of the SamplerType enum
+func (st SamplerType) String() string {
+	return [...]string{
+		"Random", "Grid", "Halton", "Sobol", "Disk", "Adaptive",
+	}[st]
+}
+
+// GetSType returns a SamplerType from its string representation
+func (st SamplerType) GetSType(name string) (SamplerType, error) {
+	switch strings.ToLower(name) {
+	case "random", "":
+		return RandomSampler, nil
+	case "grid":
+		return GridSampler, nil
+	case "halton":
+		return HaltonSampler, nil
+	case "sobol":
+		return SobolSampler, nil
+	case "disk", "disc":
+		return DiskSampler, nil
+	case "adaptive":
+		return AdaptiveSampler, nil
+	default:
+		return 0, errors.New("Unknown sampler type")
+	}
+}
+
+// Sampler generates the origins a scan job scans. Each job gets its own
+// Sampler from Session.newSampler and all of its state is derived from the
+// session and the job's proc id, so the sequence can be regenerated.
+type Sampler interface {
+	// Next returns the next origin to scan
+	Next() g.Vector2
+}
+
+// Refiner is a Sampler that steers later origins using earlier results.
+// Observe is called with every result that meets the session's MinScore, in
+// the order the results were created.
+type Refiner interface {
+	Sampler
+	Observe(r Result)
+
+	// State returns what the sampler has drawn and learnt so far, and Resume
+	// puts a new sampler of the same job back where State was taken
+	State() SamplerState
+	Resume(state SamplerState)
+}
+
+// SamplerState is the progress of a Refiner, which depends on the results it
+// observed as well as the number of origins it drew
+type SamplerState struct {
+	// Draws is how many numbers it has drawn from its job's PRNG
+	Draws uint64
+
+	// Best are the results it refines around
+	Best []Result `json:",omitempty"`
+}
+
+// newSampler returns the Sampler scan job procid draws its origins from
+func (s *Session) newSampler(procid int) Sampler {
+	rng := s.jobRand(procid)
+	center := s.ZLine.Origin
+	radius := s.Radius
+
+	switch s.Sampler {
+	case GridSampler:
+		if s.plannedProcs() {
+			// the chunks of a split session interleave their cells over
+			// one grid the size of the whole session
+			jobs := s.ProcCount * s.Chunks
+			return newGridSampler(center, radius, s.GridScans, jobs, procid*s.Chunks+s.Chunk)
+		}
+		return newGridSampler(center, radius, s.ScansReq, s.ProcCount, procid)
+	case HaltonSampler:
+		return &haltonSampler{center: center, radius: radius, shiftX: rng.Float64(), shiftY: rng.Float64()}
+	case SobolSampler:
+		return &sobolSampler{center: center, radius: radius, shiftX: rng.Uint32(), shiftY: rng.Uint32()}
+	case DiskSampler:
+		return &diskSampler{rng: rng, center: center, radius: radius}
+	case AdaptiveSampler:
+		return newAdaptiveSampler(jobSeed(s.Seed, s.ID, procid), center, radius)
+	default:
+		return &randomSampler{rng: rng, center: center, radius: radius}
+	}
+}
+
+// toSquare maps u, v in [0, 1) to the square of side 2*radius around center
+func toSquare(center g.Vector2, radius, u, v float64) g.Vector2 {
+	return g.Vector2{
+		X: -radius + u*2*radius + center.X,
+		Y: -radius + v*2*radius + center.Y,
+	}
+}
+
+type randomSampler struct {
+	rng    *rand.Rand
+	center g.Vector2
+	radius float64
+}
+
+func (rs *randomSampler) Next() g.Vector2 {
+	min, max := -rs.radius, rs.radius
+	return g.Vector2{
+		X: min + rs.rng.Float64()*(max-min) + rs.center.X,
+		Y: min + rs.rng.Float64()*(max-min) + rs.center.Y,
+	}
+}
+
+// gridSampler visits the cells of a regular grid with roughly `total` cells.
+// Job procid takes cells procid, procid+jobs, procid+2*jobs... so together the
+// jobs cover the grid once before any cell repeats.
+type gridSampler struct {
+	center g.Vector2
+	radius float64
+	side   int
+	next   int
+	stride int
+}
+
+func newGridSampler(center g.Vector2, radius float64, total, jobs, procid int) *gridSampler {
+	side := int(math.Ceil(math.Sqrt(float64(total))))
+	if side < 1 {
+		side = 1
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	return &gridSampler{
+		center: center,
+		radius: radius,
+		side:   side,
+		next:   procid,
+		stride: jobs,
+	}
+}
+
+func (gs *gridSampler) Next() g.Vector2 {
+	cell := gs.next % (gs.side * gs.side)
+	gs.next += gs.stride
+
+	// sample the center of each cell
+	u := (float64(cell%gs.side) + .5) / float64(gs.side)
+	v := (float64(cell/gs.side) + .5) / float64(gs.side)
+	return toSquare(gs.center, gs.radius, u, v)
+}
+
+// haltonSampler uses the Halton sequence in bases 2 and 3. Every job uses the
+// same sequence with its own random toroidal shift so the jobs don't scan the
+// same origins.
+type haltonSampler struct {
+	center         g.Vector2
+	radius         float64
+	index          uint64
+	shiftX, shiftY float64
+}
+
+// radicalInverse mirrors the base b digits of i around the decimal point
+func radicalInverse(i uint64, base uint64) float64 {
+	inv := 1 / float64(base)
+	f := inv
+	r := 0.0
+	for i > 0 {
+		r += float64(i%base) * f
+		i /= base
+		f *= inv
+	}
+	return r
+}
+
+func (hs *haltonSampler) Next() g.Vector2 {
+	hs.index++ // skip index 0, which is the corner of the square
+
+	u := math.Mod(radicalInverse(hs.index, 2)+hs.shiftX, 1)
+	v := math.Mod(radicalInverse(hs.index, 3)+hs.shiftY, 1)
+	return toSquare(hs.center, hs.radius, u, v)
+}
+
+// sobolDirections are the direction numbers of the second Sobol dimension
+// (primitive polynomial x + 1). The first dimension is the van der Corput
+// sequence, which is just the bit reversal of the index.
+var sobolDirections = func() [32]uint32 {
+	var v [32]uint32
+	m := uint32(1)
+	for k := 0; k < 32; k++ {
+		v[k] = m << uint(31-k)
+		m = (m << 1) ^ m
+	}
+	return v
+}()
+
+// sobolSampler uses the two dimensional Sobol sequence. Every job XORs the
+// sequence with its own random digital shift, which keeps its net structure.
+type sobolSampler struct {
+	center         g.Vector2
+	radius         float64
+	index          uint32
+	shiftX, shiftY uint32
+}
+
+func (ss *sobolSampler) Next() g.Vector2 {
+	ss.index++
+
+	x := bits.Reverse32(ss.index)
+	var y uint32
+	for k, i := 0, ss.index; i > 0; k, i = k+1, i>>1 {
+		if i&1 == 1 {
+			y ^= sobolDirections[k]
+		}
+	}
+
+	u := float64(x^ss.shiftX) / (1 << 32)
+	v := float64(y^ss.shiftY) / (1 << 32)
+	return toSquare(ss.center, ss.radius, u, v)
+}
+
+// diskSampler picks origins uniformly over the disk instead of the square
+type diskSampler struct {
+	rng    *rand.Rand
+	center g.Vector2
+	radius float64
+}
+
+func (ds *diskSampler) Next() g.Vector2 {
+	// sqrt keeps the density uniform instead of bunching up at the center
+	r := ds.radius * math.Sqrt(ds.rng.Float64())
+	theta := 2 * math.Pi * ds.rng.Float64()
+	return g.Vector2{
+		X: ds.center.X + r*math.Cos(theta),
+		Y: ds.center.Y + r*math.Sin(theta),
+	}
+}
+
+const (
+	// adaptiveExplore is the share of origins the adaptive sampler still
+	// draws uniformly once it has somewhere better to look
+	adaptiveExplore = .25
+
+	// adaptiveKeep is how many of the best origins it refines around
+	adaptiveKeep = 32
+
+	// adaptiveSpread is the standard deviation of refined origins as a
+	// fraction of the session radius
+	adaptiveSpread = .02
+)
+
+// countingSource is a rand.Source that counts the numbers drawn from it, so a
+// sampler's place in its sequence can be saved and found again
+type countingSource struct {
+	src   rand.Source64
+	draws uint64
+}
+
+func (cs *countingSource) Int63() int64 {
+	cs.draws++
+	return cs.src.Int63()
+}
+
+func (cs *countingSource) Uint64() uint64 {
+	cs.draws++
+	return cs.src.Uint64()
+}
+
+func (cs *countingSource) Seed(seed int64) {
+	cs.src.Seed(seed)
+	cs.draws = 0
+}
+
+// adaptiveSampler draws uniform origins until results start to meet the
+// minimum score. After that most origins are drawn from a normal distribution
+// around one of the best origins seen so far.
+type adaptiveSampler struct {
+	random *randomSampler
+	src    *countingSource
+	rng    *rand.Rand
+	best   []Result
+}
+
+func newAdaptiveSampler(seed int64, center g.Vector2, radius float64) *adaptiveSampler {
+	src := &countingSource{src: rand.NewSource(seed).(rand.Source64)}
+	rng := rand.New(src)
+	return &adaptiveSampler{
+		random: &randomSampler{rng: rng, center: center, radius: radius},
+		src:    src,
+		rng:    rng,
+		best:   make([]Result, 0, adaptiveKeep+1),
+	}
+}
+
+func (as *adaptiveSampler) Next() g.Vector2 {
+	if len(as.best) == 0 || as.rng.Float64() < adaptiveExplore {
+		return as.random.Next()
+	}
+
+	seed := as.best[as.rng.Intn(len(as.best))].Origin
+	sigma := as.random.radius * adaptiveSpread
+	origin := g.Vector2{
+		X: seed.X + as.rng.NormFloat64()*sigma,
+		Y: seed.Y + as.rng.NormFloat64()*sigma,
+	}
+
+	// stay inside the session's square
+	center, r := as.random.center, as.random.radius
+	origin.X = math.Max(center.X-r, math.Min(center.X+r, origin.X))
+	origin.Y = math.Max(center.Y-r, math.Min(center.Y+r, origin.Y))
+	return origin
+}
+
+func (as *adaptiveSampler) Observe(r Result) {
+	as.best = append(as.best, r)
+	sort.SliceStable(as.best, func(a, b int) bool {
+		return as.best[a].Score > as.best[b].Score
+	})
+
+	if len(as.best) > adaptiveKeep {
+		as.best = as.best[:adaptiveKeep]
+	}
+}
+
+func (as *adaptiveSampler) State() SamplerState {
+	return SamplerState{
+		Draws: as.src.draws,
+		Best:  append([]Result(nil), as.best...),
+	}
+}
+
+func (as *adaptiveSampler) Resume(state SamplerState) {
+	for as.src.draws < state.Draws {
+		as.src.Uint64()
+	}
+	as.best = append(as.best[:0], state.Best...)
+}
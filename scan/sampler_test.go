@@ -0,0 +1,207 @@
+package scan
+
+import (
+	"math"
+	"testing"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+var samplerTypes = []SamplerType{RandomSampler, GridSampler, HaltonSampler, SobolSampler, DiskSampler, AdaptiveSampler}
+
+func TestSamplerTypesHaveStrings(t *testing.T) {
+	for _, st := range samplerTypes {
+		var parsed SamplerType
+		parsed, err := parsed.GetSType(st.String())
+		if err != nil {
+			t.Log("GetSType", st.String(), err)
+			t.Fail()
+		}
+
+		if parsed != st {
+			t.Log("expected", st, "from", st.String(), "but got", parsed)
+			t.Fail()
+		}
+	}
+}
+
+func TestSamplersStayInBounds(t *testing.T) {
+	center := geom.Vector2{X: 3, Y: -2}
+	radius := .5
+
+	for _, st := range samplerTypes {
+		s := testSession(1000)
+		s.ZLine.Origin = center
+		s.Radius = radius
+		s.Sampler = st
+
+		sampler := s.newSampler(1)
+		for i := 0; i < 1000; i++ {
+			origin := sampler.Next()
+
+			if st == DiskSampler {
+				if origin.Distance(center) > radius {
+					t.Fatal(st, "origin", origin, "outside the disk")
+				}
+				continue
+			}
+
+			if math.Abs(origin.X-center.X) > radius || math.Abs(origin.Y-center.Y) > radius {
+				t.Fatal(st, "origin", origin, "outside the square")
+			}
+		}
+	}
+}
+
+func TestSamplersAreDeterministic(t *testing.T) {
+	for _, st := range samplerTypes {
+		s := testSession(1000)
+		s.Sampler = st
+
+		a, b := s.newSampler(3), s.newSampler(3)
+		for i := 0; i < 100; i++ {
+			if a.Next() != b.Next() {
+				t.Fatal(st, "sampler differs at origin", i)
+			}
+		}
+	}
+}
+
+func TestGridSamplerCoversEveryCell(t *testing.T) {
+	s := testSession(100)
+	s.ProcCount = 3
+	s.Sampler = GridSampler
+
+	seen := make(map[geom.Vector2]bool)
+	for procid := 0; procid < s.ProcCount; procid++ {
+		sampler := s.newSampler(procid)
+		for i := procid; i < 100; i += s.ProcCount {
+			seen[sampler.Next()] = true
+		}
+	}
+
+	if len(seen) != 100 {
+		t.Log("expected the jobs to visit 100 distinct cells but visited", len(seen))
+		t.Fail()
+	}
+}
+
+func TestGridSamplerChunksDontOverlap(t *testing.T) {
+	// the planner gives the first chunks one more origin when the session
+	// doesn't divide evenly, and a perfect square leaves no spare cells
+	for _, total := range []int{200, 201, 203, 256} {
+		for _, chunks := range []int{3, 4} {
+			seen := make(map[geom.Vector2]bool)
+			for chunk := 0; chunk < chunks; chunk++ {
+				s := testSession(total / chunks)
+				if chunk < total%chunks {
+					s.ScansReq++
+				}
+				s.ProcCount = 3
+				s.Sampler = GridSampler
+				s.ParentID = 1
+				s.Chunk = chunk
+				s.Chunks = chunks
+				s.GridScans = total
+
+				for procid := 0; procid < s.ProcCount; procid++ {
+					sampler := s.newSampler(procid)
+					for i := 0; i < s.jobCount(procid); i++ {
+						seen[sampler.Next()] = true
+					}
+				}
+			}
+
+			if len(seen) != total {
+				t.Log(chunks, "chunks of", total, "visited", len(seen), "distinct cells")
+				t.Fail()
+			}
+		}
+	}
+}
+
+// TestLowDiscrepancy checks every cell of a coarse grid gets close to its
+// share of origins, which plain random sampling wouldn't guarantee
+func TestLowDiscrepancy(t *testing.T) {
+	const side, count = 8, 1024
+
+	for _, st := range []SamplerType{HaltonSampler, SobolSampler} {
+		s := testSession(count)
+		s.Radius = 1
+		s.Sampler = st
+
+		cells := make([]int, side*side)
+		sampler := s.newSampler(0)
+		for i := 0; i < count; i++ {
+			o := sampler.Next()
+			x := int((o.X + 1) / 2 * side)
+			y := int((o.Y + 1) / 2 * side)
+			cells[y*side+x]++
+		}
+
+		for i, n := range cells {
+			if n < count/(side*side)-4 || n > count/(side*side)+4 {
+				t.Fatal(st, "cell", i, "had", n, "origins, expected about", count/(side*side))
+			}
+		}
+	}
+}
+
+func TestAdaptiveSamplerRefines(t *testing.T) {
+	s := testSession(1000)
+	s.Radius = 1
+	s.Sampler = AdaptiveSampler
+
+	sampler := s.newSampler(0).(Refiner)
+	target := geom.Vector2{X: .5, Y: .5}
+	sampler.Observe(Result{Origin: target, Score: .5})
+
+	near := 0
+	for i := 0; i < 1000; i++ {
+		if sampler.Next().Distance(target) < .1 {
+			near++
+		}
+	}
+
+	// uniform sampling would put about 0.8% of origins that close
+	if near < 500 {
+		t.Log("expected most origins near the observed result but only", near, "were")
+		t.Fail()
+	}
+}
+
+func TestReplayWithEachSampler(t *testing.T) {
+	for _, st := range samplerTypes {
+		s := testSession(80)
+		s.Sampler = st
+		results := collect(t, s)
+
+		for _, stored := range results {
+			if _, err := Verify(s, stored); err != nil {
+				t.Log(st, stored.Slug, err)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestAdaptiveSamplerResumes(t *testing.T) {
+	s := testSession(1000)
+	s.Sampler = AdaptiveSampler
+
+	a := s.newSampler(0).(Refiner)
+	for i := 0; i < 100; i++ {
+		o := a.Next()
+		if i%10 == 0 {
+			a.Observe(Result{Origin: o, Score: float64(i) / 100})
+		}
+	}
+
+	b := s.newSampler(0).(Refiner)
+	b.Resume(a.State())
+	for i := 0; i < 100; i++ {
+		if a.Next() != b.Next() {
+			t.Fatal("a resumed sampler differs at origin", i)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package scan
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -13,6 +12,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/chriscow/cloud-scanner-go/util"
 	"github.com/nsqio/go-nsq"
 	"github.com/urfave/cli/v2"
 )
@@ -21,6 +21,9 @@ const (
 	SessionTopic  = "session-request"  // subscribe to this topic for scan requests
 	ResultTopic   = "results"          // publish results to this topic
 	CompleteTopic = "session-complete" // completed sessions topic
+
+	DeadLetterTopic = "session-dead-letter" // sessions that could not be scanned
+	CancelTopic     = "session-cancel"      // sessions to stop scanning
 )
 
 var (
@@ -28,71 +31,137 @@ var (
 )
 
 // Run starts a scan based on the Session parameters and publishes
-// the results to the NSQ message bus in the scan-radius-results topic
-func Run(parent context.Context, topic string, s *Session) (<-chan bool, error) {
+// the results to the NSQ message bus in the scan-radius-results topic. The
+// returned channel receives nil once the scan is complete and every result is
+// published, or the error that stopped it. Canceling parent cancels the
+// session: the scan jobs stop, the results they found are published and the
+// channel receives an error wrapping ErrCancelled.
+func Run(parent context.Context, topic string, s *Session) (<-chan error, error) {
+	// Instantiate a producer.
+	config := nsq.NewConfig()
+	producer, err := nsq.NewProducer("127.0.0.1:4150", config) // always produce to the local queue
+	if err != nil {
+		return nil, &PublishError{SessionID: s.ID, Topic: topic, Err: err}
+	}
+
 	cctx, cancel := context.WithCancel(parent)
 
 	ch, err := s.Start(cctx)
 	if err != nil {
+		cancel()
+		producer.Stop()
 		return nil, err
 	}
 
 	ccb := 0
 	msgCount := 0
 	resultCount := 0
-	running := true
 
-	// Instantiate a producer.
-	config := nsq.NewConfig()
-	producer, err := nsq.NewProducer("127.0.0.1:4150", config) // always produce to the local queue
-	if err != nil {
-		return nil, err
-	}
+	done := make(chan error, 1)
 
-	done := make(chan bool)
+	// cancelled is the parent's Done channel until the parent is done, then
+	// nil while the results the jobs flush are drained
+	cancelled := parent.Done()
+
+	// stop cancels the scan jobs and reports how the scan ended
+	stop := func(err error) {
+		cancel() // stop the child goroutines
+		producer.Stop()
+		done <- err
+	}
 
 	go func() {
-		for running {
+		for {
 			select {
-			case results, ok := <-ch:
+			case batch, ok := <-ch:
 				if !ok {
 					log.Println("[scan] result channel closed. stopping")
-					cancel() // stop the child goroutines
-					producer.Stop()
-					running = false
-					done <- true
-				} else {
-					resultCount += len(results)
-					body, err := json.Marshal(results)
-					ccb += len(body)
-					msgCount++
-					err = producer.Publish(topic, body)
-					if err != nil {
-						log.Println("[scan] publish error", err)
-						cancel()
-						producer.Stop()
-						done <- true
+					s.Cancelled = cancelled == nil && (s.ScansReq == 0 || s.ScansDone < s.ScansReq)
+					if Checkpoints != nil {
+						if err := Checkpoints.Delete(s.ID); err != nil {
+							log.Println("[scan] failed to delete checkpoints", err)
+						}
+					}
+					log.Println("[scan] Published", resultCount, "points with a score >", s.MinScore*100, "% at", s.ScansPerSec, "scans/sec in", s.TotalTime)
+					if msgCount > 0 {
+						log.Println("msgs published", msgCount, "avg msg size", ccb/msgCount, "bytes", ResultEncoding)
+					}
+					if s.Cancelled {
+						log.Println("[scan] session", s.ID, "cancelled after", s.ScansDone, "of", s.ScansReq, "scans")
+						stop(fmt.Errorf("session %d: %w", s.ID, ErrCancelled))
 						return
 					}
+					stop(nil)
+					return
 				}
 
-			case <-parent.Done():
-				log.Println("[scan] parent context complete")
-				cancel()
-				producer.Stop()
-				done <- true
-				return
-			default:
+				if batch.Err != nil {
+					log.Println("[scan] scan error", batch.Err)
+					stop(batch.Err)
+					return
+				}
+
+				// losing a progress event isn't worth stopping the scan for
+				if batch.Progress != nil {
+					if err := PublishProgress(producer, *batch.Progress); err != nil {
+						log.Println("[scan] failed to publish progress", err)
+					}
+					continue
+				}
+
+				size, err := publish(producer, topic, s, batch.Results)
+				if err != nil {
+					log.Println("[scan] publish error", err)
+					stop(err)
+					return
+				}
+
+				if len(batch.Results) > 0 {
+					resultCount += len(batch.Results)
+					ccb += size
+					msgCount++
+				}
+
+				// only once the results are published is it safe to skip
+				// them on a restart
+				if Checkpoints != nil && batch.Checkpoint != nil {
+					if err := Checkpoints.Save(*batch.Checkpoint); err != nil {
+						log.Println("[scan] failed to save checkpoint", err)
+					}
+				}
+
+			case <-cancelled:
+				// the jobs stop too and flush what they found before the
+				// result channel closes
+				log.Println("[scan] parent context complete, draining results")
+				cancelled = nil
 			}
 		}
-
-		log.Println("[scan] Published", resultCount, "points with a score >", s.MinScore*100, "% at", s.ScansPerSec, "scans/sec in", s.TotalTime)
-		log.Println("msgs published", msgCount, "avg msg size", ccb/msgCount, "bytes")
 	}()
 
 	return done, nil
 }
 
+// publish encodes the results with ResultEncoding and publishes them to the
+// topic in an envelope of their content type, returning the size of the
+// message. Checkpoint only batches have no results to publish.
+func publish(producer *nsq.Producer, topic string, s *Session, results []Result) (int, error) {
+	if len(results) == 0 {
+		return 0, nil
+	}
+
+	body, err := MarshalResults(ResultEncoding, results)
+	if err != nil {
+		return 0, &PublishError{SessionID: s.ID, Topic: topic, Err: err}
+	}
+
+	if err := util.PublishContent(producer, topic, ResultEncoding.ContentType(), body, s.TraceID); err != nil {
+		return 0, &PublishError{SessionID: s.ID, Topic: topic, Err: err}
+	}
+
+	return len(body), nil
+}
+
 // scanLatticeCmd generates scan-radius sessions and publishes them to the
 // channel returned.  Each session contains a different origin such that all the
 // scan sessions will completely cover the lattice.
@@ -110,15 +179,17 @@ func scanLatticeCmd(ctx *cli.Context) error {
 	config := nsq.NewConfig()
 	producer, err := nsq.NewProducer("127.0.0.1:4150", config)
 	if err != nil {
-		log.Fatal(err)
+		return &PublishError{Topic: topic, Err: err}
 	}
+	defer producer.Stop()
 
 	// We create one session, thus only loading the lattice and zeros once
 	// then just modify its ID and zline origin in the loop below
-	cctx, _ := context.WithCancel(context.Background()) // actually unused
+	cctx, cancel := context.WithCancel(context.Background()) // actually unused
+	defer cancel()
 	s, err := sessionFromCLI(cctx, ctx)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	start := time.Now()
@@ -127,36 +198,49 @@ func scanLatticeCmd(ctx *cli.Context) error {
 	log.Println("Lattice partitioned in", elapsed.Seconds())
 
 	wg := &sync.WaitGroup{}
-	wg.Add(len(origins))
+	errCh := make(chan error, len(origins))
 
 	start = time.Now()
 	for id, origin := range origins {
 		select {
 		case <-sigChan:
-			msg := fmt.Sprint("\nCanceled by user")
-			log.Fatal(msg)
+			wg.Wait()
+			return errors.New("Canceled by user")
 		default:
-			go func() {
+		}
 
-				s.ID = start.UnixNano() + int64(id)
-				s.ZLine.Origin = origin
+		// each goroutine publishes its own copy of the session
+		sess := *s
+		sess.ID = start.UnixNano() + int64(id)
+		sess.ZLine.Origin = origin
 
-				body, err := json.Marshal(s)
-				if err != nil {
-					log.Fatal(err)
-				}
+		wg.Add(1)
+		go func(sess Session) {
+			defer wg.Done()
 
-				err = producer.Publish(topic, body)
-				if err != nil {
-					log.Fatal(err)
-				}
+			if err := PublishSession(producer, topic, sess); err != nil {
+				errCh <- err
+			}
+		}(sess)
+	}
 
-				wg.Done()
-			}()
+	wg.Wait()
+	close(errCh)
+
+	failed := 0
+	var firstErr error
+	for err := range errCh {
+		log.Println("[scan]", err)
+		if firstErr == nil {
+			firstErr = err
 		}
+		failed++
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d sessions failed to publish: %w", failed, len(origins), firstErr)
 	}
 
-	wg.Wait()
 	elapsed = time.Since(start)
 	log.Println("Published", len(origins), "sessions in", elapsed.Seconds())
 
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"github.com/chriscow/cloud-scanner-go/geom"
 	"testing"
 
@@ -64,7 +65,7 @@ func compareTest(t *testing.T) {
 
 	for line, arg := range testargs {
 		origin := geom.Vector2{X: arg.X, Y: arg.Y}
-		buckets := calculate(origin, points, zeros.Values, nil, arg.Limit, arg.NumBuckets)
+		buckets := mustCalculate(t, origin, points, zeros.Values, nil, arg.Limit, 0, arg.NumBuckets)
 		best := getBestBuckets(buckets)
 		if len(best) > 1 {
 			log.Println("multiple results:", len(best))
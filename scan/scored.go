@@ -1,56 +1,75 @@
 package scan
 
 import (
+	"container/heap"
 	"context"
 	"log"
+	"sort"
+	"sync"
 	"time"
 )
 
-// ScoredResults keeps a sorted list of results ordered by score. Once the buffer
-// contains `depth` results, we start popping the top results off and sent over
-// the a channel given to us.
+// ScoredResults buffers the best `depth` results by score, ties going to the
+// result with more zeros hit. Once the buffer is full a result only gets in by
+// beating the worst one, which is dropped. A result with the Slug of one
+// already buffered replaces it if it ranks higher and is dropped otherwise.
+// Every `every` the best `flushCount` results are removed from the buffer and
+// sent over the publish channel, best first. It is safe to use from many
+// goroutines.
 type ScoredResults struct {
-	results resultHeap
-	ctx     context.Context
-	depth   int
-	pub     chan<- []Result
-	res     chan Result
+	mut        sync.Mutex
+	results    *resultHeap
+	ctx        context.Context
+	depth      int
+	flushCount int
+	pub        chan<- []Result
 }
 
-// NewScoredResults creates and returns a ScoredResults instance
-func NewScoredResults(ctx context.Context, depth int, publish chan<- []Result) *ScoredResults {
+// NewScoredResults creates and returns a ScoredResults instance. With every
+// 0 nothing is flushed until Flush is called.
+func NewScoredResults(ctx context.Context, depth, flushCount int, every time.Duration, publish chan<- []Result) *ScoredResults {
+	if depth < 1 {
+		depth = 1
+	}
+
+	if flushCount < 1 || flushCount > depth {
+		flushCount = depth
+	}
+
 	sr := &ScoredResults{
-		results: make([]Result, 0),
-		pub:     publish,
-		res:     make(chan Result),
-		ctx:     ctx,
+		results:    newResultHeap(depth),
+		pub:        publish,
+		ctx:        ctx,
+		depth:      depth,
+		flushCount: flushCount,
 	}
 
-	sr.start()
+	if every > 0 {
+		sr.start(every)
+	}
 
 	return sr
 }
 
-func (sr *ScoredResults) start() {
+func (sr *ScoredResults) start(every time.Duration) {
 	go func() {
-		ticker := time.NewTicker(time.Second)
-		running := true
-		for running {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		for {
 			select {
 			case <-ticker.C:
-				// every second, calc how many results are over our `depth`
-				// value, make a slice, pop them off and publish them
-				n := sr.results.Len()
-				count := sr.depth - n
-				if count > 0 {
-					res := make([]Result, 0, count)
-					for count > 0 {
-						res = append(res, sr.results.Pop().(Result))
-					}
-					sr.pub <- res
+				res := sr.Flush(sr.flushCount)
+				if len(res) == 0 {
+					continue
+				}
+
+				select {
+				case sr.pub <- res:
+				case <-sr.ctx.Done():
+					log.Println("[ScoredResults] Canceled: exiting")
+					return
 				}
-			case res := <-sr.res:
-				sr.results.Push(res)
 			case <-sr.ctx.Done():
 				log.Println("[ScoredResults] Canceled: exiting")
 				return
@@ -59,7 +78,71 @@ func (sr *ScoredResults) start() {
 	}()
 }
 
-// Add adds the given result to our heap by sending through an internal channel
-func (sr *ScoredResults) Add(res Result) {
-	sr.res <- res
+// Add offers the result to the buffer and returns true if it was kept
+func (sr *ScoredResults) Add(res Result) bool {
+	sr.mut.Lock()
+	defer sr.mut.Unlock()
+
+	h := sr.results
+	if i, ok := h.find(res.Slug); ok {
+		if !ranksBelow(h.results[i], res) {
+			return false
+		}
+
+		h.results[i] = res
+		heap.Fix(h, i)
+		return true
+	}
+
+	if h.Len() < sr.depth {
+		heap.Push(h, res)
+		return true
+	}
+
+	// replace the worst result if this one beats it
+	if !ranksBelow(h.results[0], res) {
+		return false
+	}
+
+	heap.Pop(h)
+	heap.Push(h, res)
+	return true
+}
+
+// Len returns the number of results buffered
+func (sr *ScoredResults) Len() int {
+	sr.mut.Lock()
+	defer sr.mut.Unlock()
+
+	return sr.results.Len()
+}
+
+// Flush removes the best n results from the buffer and returns them, best
+// first
+func (sr *ScoredResults) Flush(n int) []Result {
+	sr.mut.Lock()
+	defer sr.mut.Unlock()
+
+	h := sr.results
+	if n > h.Len() {
+		n = h.Len()
+	}
+
+	if n <= 0 {
+		return nil
+	}
+
+	sorted := append([]Result(nil), h.results...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return ranksBelow(sorted[j], sorted[i])
+	})
+
+	best := sorted[:n:n]
+	rest := make([]Result, len(sorted)-n, sr.depth)
+	copy(rest, sorted[n:])
+
+	h.reset(rest)
+	heap.Init(h)
+
+	return best
 }
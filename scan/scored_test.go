@@ -0,0 +1,166 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func scoredResult(slug string, score float64, hits int) Result {
+	return Result{Slug: slug, Score: score, ZerosHit: hits}
+}
+
+func TestScoredResultsTopK(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+		adds  []Result
+		best  []string // slugs best first
+	}{
+		{
+			name:  "keeps everything under depth",
+			depth: 5,
+			adds:  []Result{scoredResult("a", .1, 1), scoredResult("b", .3, 3), scoredResult("c", .2, 2)},
+			best:  []string{"b", "c", "a"},
+		},
+		{
+			name:  "drops the worst when full",
+			depth: 2,
+			adds:  []Result{scoredResult("a", .1, 1), scoredResult("b", .3, 3), scoredResult("c", .2, 2), scoredResult("d", .05, 1)},
+			best:  []string{"b", "c"},
+		},
+		{
+			name:  "breaks ties on zeros hit",
+			depth: 2,
+			adds:  []Result{scoredResult("a", .5, 5), scoredResult("b", .5, 7), scoredResult("c", .5, 6)},
+			best:  []string{"b", "c"},
+		},
+		{
+			name:  "dedupes by slug keeping the best",
+			depth: 3,
+			adds:  []Result{scoredResult("a", .2, 2), scoredResult("a", .4, 4), scoredResult("b", .3, 3), scoredResult("a", .1, 1)},
+			best:  []string{"a", "b"},
+		},
+		{
+			name:  "results without a slug are never duplicates",
+			depth: 3,
+			adds:  []Result{scoredResult("", .2, 2), scoredResult("", .4, 4)},
+			best:  []string{"", ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sr := NewScoredResults(context.Background(), test.depth, 0, 0, nil)
+			for _, r := range test.adds {
+				sr.Add(r)
+			}
+
+			best := sr.Flush(test.depth)
+			if len(best) != len(test.best) {
+				t.Fatal("expected", len(test.best), "results but got", len(best))
+			}
+
+			for i, r := range best {
+				if r.Slug != test.best[i] {
+					t.Log("result", i, "expected", test.best[i], "but got", r.Slug, r.Score, r.ZerosHit)
+					t.Fail()
+				}
+
+				if i > 0 && ranksBelow(best[i-1], r) {
+					t.Log("results are not ordered best first at", i)
+					t.Fail()
+				}
+			}
+
+			if sr.Len() != 0 {
+				t.Log("expected flushing everything to empty the buffer but", sr.Len(), "are left")
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestScoredResultsFlushLeavesTheRest(t *testing.T) {
+	sr := NewScoredResults(context.Background(), 10, 0, 0, nil)
+	for i := 0; i < 10; i++ {
+		sr.Add(scoredResult(fmt.Sprint(i), float64(i)/10, i))
+	}
+
+	best := sr.Flush(3)
+	if len(best) != 3 || best[0].Slug != "9" || best[2].Slug != "7" {
+		t.Fatal("expected results 9, 8 and 7 but got", best)
+	}
+
+	// the rest are still a valid heap
+	if sr.Add(scoredResult("x", .65, 1)) != true || sr.Len() != 8 {
+		t.Fatal("expected room for another result after the flush")
+	}
+
+	next := sr.Flush(2)
+	if next[0].Slug != "x" || next[1].Slug != "6" {
+		t.Fatal("expected results x and 6 but got", next)
+	}
+}
+
+func TestScoredResultsConcurrentAdds(t *testing.T) {
+	const writers, each, depth = 8, 200, 50
+
+	sr := NewScoredResults(context.Background(), depth, 0, 0, nil)
+	wg := &sync.WaitGroup{}
+	wg.Add(writers)
+
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				// every writer adds the same slugs so most are duplicates
+				sr.Add(scoredResult(fmt.Sprint(i), float64(i)/each, w))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	best := sr.Flush(depth)
+	if len(best) != depth {
+		t.Fatal("expected", depth, "results but got", len(best))
+	}
+
+	for i, r := range best {
+		if r.Slug != fmt.Sprint(each-1-i) || r.ZerosHit != writers-1 {
+			t.Fatal("result", i, "is not the best copy of the best slug:", r.Slug, r.ZerosHit)
+		}
+	}
+}
+
+func TestScoredResultsPeriodicFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pub := make(chan []Result)
+	sr := NewScoredResults(ctx, 10, 2, time.Millisecond, pub)
+	for i := 0; i < 5; i++ {
+		sr.Add(scoredResult(fmt.Sprint(i), float64(i)/10, i))
+	}
+
+	flushed := make([]Result, 0)
+	for len(flushed) < 5 {
+		select {
+		case res := <-pub:
+			if len(res) > 2 {
+				t.Fatal("expected at most 2 results a flush but got", len(res))
+			}
+			flushed = append(flushed, res...)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the results to be flushed")
+		}
+	}
+
+	for i, r := range flushed {
+		if r.Slug != fmt.Sprint(4-i) {
+			t.Fatal("expected the results flushed best first but got", r.Slug, "at", i)
+		}
+	}
+}
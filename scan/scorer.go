@@ -0,0 +1,202 @@
+package scan
+
+import (
+	"errors"
+	"math"
+	"strings"
+
+	g "github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// baselineOrigins is how many random origins the significance scorer scans
+// to learn what an unremarkable best bucket looks like
+const baselineOrigins = 8 * kernelBatch
+
+// ScorerType enumeration selects how a session scores the best bucket of an
+// origin
+type ScorerType int
+
+const (
+	// RatioScorer scores the fraction of the zeros hit
+	RatioScorer ScorerType = iota
+
+	// WeightedScorer scores the zeros hit weighted by 1/n for the nth zero,
+	// so hitting the first zeros counts for more than hitting later ones
+	WeightedScorer
+
+	// ContrastScorer scores how far the best bucket stands out from the
+	// mean bucket, as a fraction of the zeros
+	ContrastScorer
+
+	// SignificanceScorer scores the best bucket against the best buckets of
+	// random origins around the session's origin, as the normal CDF of its
+	// z-score
+	SignificanceScorer
+)
+
+// String returns the string representation of the ScorerType enum
+func (st ScorerType) String() string {
+	return [...]string{
+		"Ratio", "Weighted", "Contrast", "Significance",
+	}[st]
+}
+
+// GetScType returns a ScorerType from its string representation
+func (st ScorerType) GetScType(name string) (ScorerType, error) {
+	switch strings.ToLower(name) {
+	case "ratio", "":
+		return RatioScorer, nil
+	case "weighted":
+		return WeightedScorer, nil
+	case "contrast":
+		return ContrastScorer, nil
+	case "significance":
+		return SignificanceScorer, nil
+	default:
+		return 0, errors.New("Unknown scorer type")
+	}
+}
+
+// ScoreInput is what a Scorer knows about the best bucket of an origin
+type ScoreInput struct {
+	// Hits is the number of zeros hit in the best bucket, out of Zeros
+	Hits  int
+	Zeros int
+
+	// ZeroIDs are the indices of the zeros hit in the best bucket
+	ZeroIDs []int
+
+	// Counts are the hits in every bucket of the origin
+	Counts []int
+
+	// Baseline is the distribution of best bucket hits of random origins.
+	// Only the significance scorer needs it.
+	Baseline Baseline
+}
+
+// Baseline is the mean and standard deviation of the best bucket hits of
+// random origins
+type Baseline struct {
+	Mean   float64
+	StdDev float64
+}
+
+// Scorer scores the best bucket of an origin. Scores are between 0 and 1 so a
+// session's MinScore means the same thing whichever scorer it uses.
+type Scorer interface {
+	Name() string
+	Score(in ScoreInput) float64
+}
+
+// newScorer returns the Scorer of the type
+func newScorer(st ScorerType) Scorer {
+	switch st {
+	case WeightedScorer:
+		return weightedScorer{}
+	case ContrastScorer:
+		return contrastScorer{}
+	case SignificanceScorer:
+		return significanceScorer{}
+	default:
+		return ratioScorer{}
+	}
+}
+
+type ratioScorer struct{}
+
+func (ratioScorer) Name() string { return RatioScorer.String() }
+
+func (ratioScorer) Score(in ScoreInput) float64 {
+	if in.Zeros == 0 {
+		return 0
+	}
+	return float64(in.Hits) / float64(in.Zeros)
+}
+
+type weightedScorer struct{}
+
+func (weightedScorer) Name() string { return WeightedScorer.String() }
+
+// Score is the harmonic weight of the zeros hit over the weight of all of
+// them
+func (weightedScorer) Score(in ScoreInput) float64 {
+	total := 0.0
+	for i := 0; i < in.Zeros; i++ {
+		total += 1 / float64(i+1)
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	hit := 0.0
+	for _, id := range in.ZeroIDs {
+		hit += 1 / float64(id+1)
+	}
+
+	return hit / total
+}
+
+type contrastScorer struct{}
+
+func (contrastScorer) Name() string { return ContrastScorer.String() }
+
+func (contrastScorer) Score(in ScoreInput) float64 {
+	if in.Zeros == 0 || len(in.Counts) == 0 {
+		return 0
+	}
+
+	sum := 0
+	for _, count := range in.Counts {
+		sum += count
+	}
+	mean := float64(sum) / float64(len(in.Counts))
+
+	return math.Max(0, float64(in.Hits)-mean) / float64(in.Zeros)
+}
+
+type significanceScorer struct{}
+
+func (significanceScorer) Name() string { return SignificanceScorer.String() }
+
+func (significanceScorer) Score(in ScoreInput) float64 {
+	diff := float64(in.Hits) - in.Baseline.Mean
+	if in.Baseline.StdDev == 0 {
+		// every random origin did the same, so anything better is
+		// significant
+		if diff > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	z := diff / in.Baseline.StdDev
+	return 0.5 * math.Erfc(-z/math.Sqrt2)
+}
+
+// baseline scans baselineOrigins random origins around the session's origin
+// with the kernel and returns the distribution of their best bucket hits. The
+// origins are drawn from a stream of their own so every job and every replay
+// gets the same baseline.
+func (s *Session) baseline(k *kernel) (Baseline, error) {
+	sampler := &randomSampler{rng: s.jobRand(-1), center: s.ZLine.Origin, radius: s.Radius}
+	batch := make([]g.Vector2, kernelBatch)
+
+	sum, sumSq := 0.0, 0.0
+	for n := 0; n < baselineOrigins; n += kernelBatch {
+		drawBatch(sampler, batch)
+		if err := k.run(batch); err != nil {
+			return Baseline{}, err
+		}
+
+		for j := range batch {
+			hits := float64(k.bestBuckets(j)[0].Hits)
+			sum += hits
+			sumSq += hits * hits
+		}
+	}
+
+	mean := sum / baselineOrigins
+	variance := math.Max(0, sumSq/baselineOrigins-mean*mean)
+	return Baseline{Mean: mean, StdDev: math.Sqrt(variance)}, nil
+}
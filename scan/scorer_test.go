@@ -0,0 +1,89 @@
+package scan
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScorers(t *testing.T) {
+	tests := []struct {
+		name   string
+		scorer Scorer
+		in     ScoreInput
+		want   float64
+	}{
+		{"ratio", ratioScorer{}, ScoreInput{Hits: 3, Zeros: 4}, .75},
+		{"ratio no zeros", ratioScorer{}, ScoreInput{}, 0},
+		{"weighted all", weightedScorer{}, ScoreInput{Hits: 3, Zeros: 3, ZeroIDs: []int{0, 1, 2}}, 1},
+		{"weighted first", weightedScorer{}, ScoreInput{Hits: 1, Zeros: 3, ZeroIDs: []int{0}}, 1 / (1 + .5 + 1.0/3)},
+		{"contrast", contrastScorer{}, ScoreInput{Hits: 4, Zeros: 8, Counts: []int{4, 0, 2, 2}}, .25},
+		{"contrast flat", contrastScorer{}, ScoreInput{Hits: 2, Zeros: 8, Counts: []int{2, 2}}, 0},
+		{"significance mean", significanceScorer{}, ScoreInput{Hits: 5, Baseline: Baseline{Mean: 5, StdDev: 2}}, .5},
+		{"significance flat", significanceScorer{}, ScoreInput{Hits: 6, Baseline: Baseline{Mean: 5}}, 1},
+	}
+
+	for _, test := range tests {
+		got := test.scorer.Score(test.in)
+		if math.Abs(got-test.want) > 1e-12 {
+			t.Log(test.name, "expected", test.want, "got", got)
+			t.Fail()
+		}
+	}
+}
+
+func TestWeightedFavoursEarlyZeros(t *testing.T) {
+	early := weightedScorer{}.Score(ScoreInput{Hits: 2, Zeros: 10, ZeroIDs: []int{0, 1}})
+	late := weightedScorer{}.Score(ScoreInput{Hits: 2, Zeros: 10, ZeroIDs: []int{8, 9}})
+
+	if early <= late {
+		t.Log("expected early zeros", early, "to outscore late zeros", late)
+		t.Fail()
+	}
+}
+
+func TestGetScType(t *testing.T) {
+	var st ScorerType
+	for _, want := range []ScorerType{RatioScorer, WeightedScorer, ContrastScorer, SignificanceScorer} {
+		got, err := st.GetScType(want.String())
+		if err != nil || got != want {
+			t.Log("expected", want, "got", got, err)
+			t.Fail()
+		}
+	}
+
+	if _, err := st.GetScType("bogus"); err == nil {
+		t.Log("expected an error for an unknown scorer")
+		t.Fail()
+	}
+}
+
+func TestSessionScorerIsRecorded(t *testing.T) {
+	for _, st := range []ScorerType{RatioScorer, WeightedScorer, ContrastScorer, SignificanceScorer} {
+		s := testSession(64)
+		s.Scorer = st
+		s.MinScore = .01
+
+		results := collect(t, s)
+		if len(results) == 0 {
+			t.Fatal("expected some results scored by", st)
+		}
+
+		for _, r := range results {
+			if r.Scorer != st.String() {
+				t.Log("expected scorer", st, "got", r.Scorer)
+				t.Fail()
+			}
+
+			if r.Score < 0 || r.Score > 1 {
+				t.Log(st, "score", r.Score, "is out of range")
+				t.Fail()
+			}
+
+			// replay has to score the same way for the slug to verify
+			if _, err := Verify(s, r); err != nil {
+				t.Log(st, r.Slug, err)
+				t.Fail()
+			}
+		}
+	}
+}
@@ -2,10 +2,14 @@ package scan
 
 import (
 	"context"
+	"errors"
 	"log"
 	"math"
+	"math/rand"
 	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	g "github.com/chriscow/cloud-scanner-go/geom"
@@ -27,9 +31,79 @@ type Session struct {
 	ProcCount     int
 	ScansReq      int
 	MinScore      float64
+
+	// MaxProcs caps the number of scan jobs the session is split into. 0
+	// leaves it to the scanner. The planner gives every work unit of a grid
+	// session MaxProcs jobs, see GridScans.
+	MaxProcs int `json:",omitempty"`
+
+	// Seed drives the origins each scan job generates. Together with the
+	// session ID and a result's slug it is enough to regenerate the origin
+	// of any result.
+	Seed int64
+
+	// Sampler selects how origins are picked around the ZLine origin
+	Sampler SamplerType
+
+	// Combined also scores every origin against the union of all the
+	// ZLine's zero sets when there is more than one
+	Combined bool
+
+	// Window scores each bucket on the zeros hit in the Window neighbouring
+	// buckets centered on it, wrapping at 360 degrees. 0 or 1 scores every
+	// bucket on its own.
+	Window int
+
+	// Refine bisects the best window of results that meet MinScore to find a
+	// continuous BestTheta instead of the start of the best bucket
+	Refine bool
+
+	// Scorer selects how the best bucket of an origin is scored
+	Scorer ScorerType `json:",omitempty"`
+
+	// Percentile keeps the results that score at least as well as that
+	// percentile of random origins, see Calibrate, instead of MinScore
+	Percentile float64 `json:",omitempty"`
+
+	// Budget stops the session once it has scanned for that long and Target
+	// once it has found that many results scoring at least TargetScore,
+	// which defaults to MinScore. With either set ScansReq is only an upper
+	// limit and may be 0 for no limit.
+	Budget      time.Duration `json:",omitempty"`
+	Target      int           `json:",omitempty"`
+	TargetScore float64       `json:",omitempty"`
+
+	// ParentID is the session a planner split this one from, in which case
+	// it is work unit Chunk of Chunks. Chunks is 0 for a session that wasn't
+	// split.
+	ParentID int64
+	Chunk    int
+	Chunks   int
+
+	// GridScans is the ScansReq of the grid session a work unit was split
+	// from. The units interleave their jobs over one grid that size, so
+	// they all run the same ProcCount. It is 0 for other sessions.
+	GridScans int `json:",omitempty"`
+
+	// ScansDone is the number of origins scanned when the session stopped.
+	// It is less than ScansReq when the session was Cancelled.
+	ScansDone int
+	Cancelled bool `json:",omitempty"`
+
+	// TraceID follows the session through every message it causes
+	TraceID string `json:",omitempty"`
+
+	// resume holds the checkpoint of every job when Restore found the
+	// session part way through, keyed by proc id
+	resume map[int]Checkpoint
+
+	// calibrations are the score distributions of the zero sets, keyed by
+	// their index, that results are given a PValue and ZScore from
+	calibrations map[int]*Calibration
 }
 
-// NewSession creates and initializes a new Session
+// NewSession creates and initializes a new Session. Call Normalize to fill
+// in defaults and validate it.
 func NewSession(id int64, zline g.ZLine, lattice g.Lattice, radius, distanceLimit, minScore float64, scansReq, bucketCount int) *Session {
 	if id == 0 {
 		id = time.Now().UnixNano()
@@ -38,14 +112,14 @@ func NewSession(id int64, zline g.ZLine, lattice g.Lattice, radius, distanceLimi
 	if minScore == 0 {
 		// if minScore is zero, we will publish every bucket so set a minimum
 		// of 1 hit
-		minScore = float64(1) / float64(zline.Zeros[0].Count)
+		minScore = defaultMinScore(zline, RatioScorer)
 	}
 
 	s := &Session{
 		ID:            id,
 		ZLine:         zline,
 		Lattice:       lattice,
-		Radius:        1,
+		Radius:        radius,
 		DistanceLimit: distanceLimit,
 		BucketCount:   bucketCount,
 		ProcCount:     runtime.GOMAXPROCS(0),
@@ -59,10 +133,17 @@ func NewSession(id int64, zline g.ZLine, lattice g.Lattice, radius, distanceLimi
 // Restore rebuilds a Session from a deserialized Session from the message
 // bus (basically the zeros values and lattice points are not there when
 // serialized to the message bus). Essentially this is reloading the lattice
-// and zeros values in the ZLine
+// and zeros values in the ZLine. The session is normalized before anything
+// is loaded and again once the zeros are known. If Checkpoints has progress
+// from an earlier run of the session, Start resumes from it.
 func Restore(s *Session) error {
 
-	s.ProcCount = runtime.GOMAXPROCS(0)
+	if !s.plannedProcs() {
+		s.ProcCount = runtime.GOMAXPROCS(0)
+	}
+	if err := s.Normalize(); err != nil {
+		return err
+	}
 
 	lattice, err := g.NewLattice(s.Lattice.LatticeType, s.Lattice.VertexType)
 	if err != nil {
@@ -77,102 +158,447 @@ func Restore(s *Session) error {
 		}
 	}
 
+	if err := s.Normalize(); err != nil {
+		return err
+	}
+
+	if Checkpoints != nil {
+		return s.loadCheckpoints(Checkpoints)
+	}
+
 	return nil
 }
 
-// Start starts scanning using the session's parameters
-func (s *Session) Start(ctx context.Context) (<-chan []Result, error) {
+// Batch is a set of results published by a scan job, or the error that
+// stopped the job. Once the results are published the job's progress can be
+// saved as Checkpoint. Batches with Progress carry nothing else.
+type Batch struct {
+	Results    []Result
+	Err        error
+	Checkpoint *Checkpoint
+	Progress   *Progress
+}
+
+// Start starts scanning using the session's parameters. A job that fails
+// sends a Batch with the error and stops; the other jobs carry on until the
+// context is canceled. Canceled jobs stop at the end of their current kernel
+// batch and send the results they have, and so do all the jobs once the
+// session's Budget or Target is met. The progress of the session is sent
+// every progressEvery while it runs, and once more when the jobs are done.
+func (s *Session) Start(ctx context.Context) (<-chan Batch, error) {
+	if err := s.calibrate(); err != nil {
+		return nil, err
+	}
 
-	resCh := make(chan []Result, s.ScansReq)
+	buffer := s.ScansReq
+	if buffer == 0 || buffer > maxBuffer {
+		buffer = maxBuffer
+	}
+	resCh := make(chan Batch, buffer)
 
 	maxZero := s.ZLine.MaxZeroVal()
 	filtered := s.Lattice.Filter(s.ZLine.Origin, s.Radius, maxZero, s.DistanceLimit)
+	baselines, err := s.baselines(filtered)
+	if err != nil {
+		return nil, err
+	}
 
 	start := time.Now()
 
+	// the budget stops the jobs when it runs out, and they share a context
+	// so the first to meet the target stops them all
+	budget, stopBudget := ctx, context.CancelFunc(func() {})
+	if s.Budget > 0 {
+		budget, stopBudget = context.WithTimeout(ctx, s.Budget)
+	}
+	ctx, stopJobs := context.WithCancel(budget)
+
 	go func() {
 		defer close(resCh)
+		defer stopBudget()
+		defer stopJobs()
 
 		log.Println("[session] starting", s.ProcCount, "scan jobs")
 		wg := &sync.WaitGroup{}
 		wg.Add(s.ProcCount)
 
+		counts := &counters{stop: stopJobs}
+		resumed := 0
+		for _, cp := range s.resume {
+			resumed += cp.Completed
+		}
+
+		meter := newProgressMeter(s, counts, resumed, start)
+		stopMeter := make(chan struct{})
+		meterDone := make(chan struct{})
+		go s.reportProgress(meter, resCh, stopMeter, meterDone)
+
 		for i := 0; i < s.ProcCount; i++ {
-			go s.scanJob(ctx, wg, i, filtered, resCh)
+			go s.scanJob(ctx, wg, i, filtered, baselines, resCh, counts)
 		}
 
 		wg.Wait()
+		close(stopMeter)
+		<-meterDone
 
 		elapsed := time.Since(start)
+		scanned := atomic.LoadInt64(&counts.scanned)
 		s.TotalTime = elapsed
-		s.ScansPerSec = int(math.Round(float64(s.ScansReq) / elapsed.Seconds()))
+		s.ScansDone = resumed + int(scanned)
+		s.ScansPerSec = int(math.Round(float64(scanned) / elapsed.Seconds()))
 	}()
 
 	return resCh, nil
 }
 
-// scanJob generates random origins and scans them, publishing the results that
-// meet the minimum score criteria. The number of random origins generated is
-// determined by dividing the scans requested by the processor count, assuming
-// scanJob will be called once per processor.
-func (s *Session) scanJob(ctx context.Context, wg *sync.WaitGroup, procid int, filtered []g.Vector2, resCh chan<- []Result) {
+// reportProgress sends the meter's reading every progressEvery until stop is
+// closed, then sends a last one and closes done. Progress is only
+// informational so it is dropped rather than hold up the scan when the
+// channel is full.
+func (s *Session) reportProgress(meter *progressMeter, resCh chan<- Batch, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(progressEvery)
+	defer ticker.Stop()
+
+	send := func(now time.Time) {
+		p := meter.read(now)
+		select {
+		case resCh <- Batch{Progress: &p}:
+		default:
+		}
+	}
 
-	count := s.ScansReq / s.ProcCount
-	origins := randOrigins(-s.Radius, s.Radius, s.ZLine.Origin, count)
-	log.Println("[session] job", procid, " started scanning", count, "origins")
+	for {
+		select {
+		case now := <-ticker.C:
+			send(now)
+		case <-stop:
+			send(time.Now())
+			return
+		}
+	}
+}
+
+// scanJob draws origins from the session's Sampler and scans them, publishing
+// the results that meet the minimum score criteria. The number of origins is
+// the job's share of the scans requested, see jobCount, assuming scanJob will
+// be called once per processor. A job resuming from a checkpoint skips the
+// origins it already scanned and the results it already published.
+func (s *Session) scanJob(ctx context.Context, wg *sync.WaitGroup, procid int, filtered []g.Vector2, baselines []Baseline, resCh chan<- Batch, counts *counters) {
+
+	count := s.jobCount(procid)
+	sampler := s.newSampler(procid)
+	batch := make([]g.Vector2, kernelBatch)
+	resume := s.resume[procid]
+	log.Println("[session] job", procid, " started scanning", count-resume.Completed, "origins")
 	results := make([]Result, 0)
 
+	// completed is the number of origins the job has finished scanning and
+	// checkpointed is the Completed of the last checkpoint it sent
+	completed := resume.Completed
+	checkpointed := completed
+
+	// state is the sampler's state at completed
+	var state *SamplerState
+
+	// deferred first so it runs last: the remaining results have to be sent
+	// before Start sees the job finish and closes the channel
+	defer wg.Done()
 	defer func() {
-		if len(results) > 0 {
-			resCh <- results
+		if len(results) > 0 || completed > checkpointed {
+			resCh <- Batch{Results: results, Checkpoint: s.checkpoint(procid, completed, nil, state)}
 		}
 	}()
 
+	sets := s.zeroSets(filtered, baselines)
+	if err := s.restore(sampler, sets, procid, resume); err != nil {
+		resCh <- Batch{Err: err}
+		return
+	}
+	state = samplerState(sampler)
+
+	suppress := make(map[string]bool)
+	for _, slug := range resume.Published {
+		suppress[slug] = true
+	}
+
 	// need the same origin for all zeros in the zline so we
 	// can do a diff result
-	for i, origin := range origins {
+	for start := completed; start < count; start += kernelBatch {
+		n := count - start
+		if n > kernelBatch {
+			n = kernelBatch
+		}
 
-		zero := s.ZLine.Zeros[0]
+		drawBatch(sampler, batch[:n])
 
-		buckets := calculate(origin, filtered, zero.Values, s.Lattice.Parameters,
-			s.DistanceLimit, s.BucketCount)
+		// wait for a turn at the CPU alongside every other session
+		if !procs.acquire(ctx) {
+			return
+		}
+		scored, err := s.scoreBatch(sets, procid, start, batch[:n])
+		procs.release()
+		if err != nil {
+			log.Println("[session] job", procid, "failed:", err)
+			resCh <- Batch{Err: err}
+			return
+		}
+
+		// published are the slugs of this batch's results that have been
+		// sent. Sending part way through the batch checkpoints at its start
+		// so they are needed to not publish them again.
+		published := make([]string, 0)
+		fromBatch := 0 // the last fromBatch results came from this batch
+
+		for _, result := range scored {
+			if !s.keeps(result) {
+				continue
+			}
 
-		best := getBestBuckets(buckets)
-		for _, hits := range best {
-			result := CreateResult(s.ID, procid, i, s.BucketCount, origin, zero.ZeroType, zero.Count, hits)
-			if result.Score >= s.MinScore {
-				results = append(results, result)
+			observe(sampler, result)
+			if suppress[result.Slug] {
+				continue
+			}
 
-				if len(results) >= 10 {
-					resCh <- results
-					results = results[:0] // keep array allocated
+			// send between origins so results tied at one origin, which
+			// share a slug, are always published together
+			if len(results) >= 10 && results[len(results)-1].Slug != result.Slug {
+				for _, r := range results[len(results)-fromBatch:] {
+					published = append(published, r.Slug)
 				}
+
+				cp := s.checkpoint(procid, start, append([]string(nil), published...), state)
+				resCh <- Batch{Results: results, Checkpoint: cp}
+				checkpointed = start
+				// the receiver owns the sent slice so start a new one
+				results = make([]Result, 0, 10)
+				fromBatch = 0
+			}
+
+			results = append(results, result)
+			fromBatch++
+			atomic.AddInt64(&counts.found, 1)
+			if s.Target > 0 && result.Score >= s.TargetScore &&
+				atomic.AddInt64(&counts.targeted, 1) >= int64(s.Target) {
+				counts.stop()
 			}
 		}
 
+		completed = start + n
+		state = samplerState(sampler)
+		atomic.AddInt64(&counts.scanned, int64(n))
+		if completed-checkpointed >= checkpointEvery {
+			resCh <- Batch{Results: results, Checkpoint: s.checkpoint(procid, completed, nil, state)}
+			checkpointed = completed
+			results = make([]Result, 0, 10)
+		}
+
 		// if len(s.ZLine.Zeros) == 2 {
 		// 	// TODO: create a diff result
 		// 	}
 		// }
 
-		// TODO: handle more zeros if there are any
-		// if len(s.ZLine.Zeros) > 2 {
-		// 	log.Fatal("TODO: handle remaining zeros or reject request")
-		// }
-
 		// check if we have been canceled
 		select {
 		case <-ctx.Done():
-			wg.Done()
 			return
 		default:
 		}
 	}
 
-	wg.Done()
 	// log.Println("[Job:", id, "] done")
 }
 
+// zeroSet is one set of zeros origins are scored against, along with the
+// kernel that scores them
+type zeroSet struct {
+	index  int // index into ZLine.Zeros, len(ZLine.Zeros) for the union
+	zeros  g.Zeros
+	kernel *kernel
+	scorer Scorer
+
+	// baseline is only scanned for scorers that compare against it
+	baseline Baseline
+}
+
+// zeroSets returns a zeroSet for every set of zeros on the ZLine, plus their
+// union if the session is Combined, each compared against its baseline when
+// there are baselines. Kernels hold scratch buffers so every job needs its
+// own.
+func (s *Session) zeroSets(filtered []g.Vector2, baselines []Baseline) []zeroSet {
+	sets := make([]zeroSet, 0, len(s.ZLine.Zeros)+1)
+	for i, zeros := range s.ZLine.Zeros {
+		sets = append(sets, zeroSet{
+			index:  i,
+			zeros:  zeros,
+			kernel: s.newKernel(filtered, zeros),
+			scorer: newScorer(s.Scorer),
+		})
+	}
+
+	if s.Combined && len(s.ZLine.Zeros) > 1 {
+		union := unionZeros(s.ZLine.Zeros)
+		sets = append(sets, zeroSet{
+			index:  len(s.ZLine.Zeros),
+			zeros:  union,
+			kernel: s.newKernel(filtered, union),
+			scorer: newScorer(s.Scorer),
+		})
+	}
+
+	for i := range baselines {
+		sets[i].baseline = baselines[i]
+	}
+
+	return sets
+}
+
+// baselines scans the baseline of every zero set once so the jobs can share
+// them. There are none unless the session's scorer compares against them.
+func (s *Session) baselines(filtered []g.Vector2) ([]Baseline, error) {
+	if s.Scorer != SignificanceScorer {
+		return nil, nil
+	}
+
+	sets := s.zeroSets(filtered, nil)
+	baselines := make([]Baseline, len(sets))
+	for i := range sets {
+		var err error
+		if baselines[i], err = s.baseline(sets[i].kernel); err != nil {
+			return nil, err
+		}
+	}
+
+	return baselines, nil
+}
+
+// newKernel returns a kernel that scores origins against zeros with the
+// session's settings
+func (s *Session) newKernel(filtered []g.Vector2, zeros g.Zeros) *kernel {
+	k := newKernel(filtered, zeros.Values, s.DistanceLimit, s.ZLine.Angle, s.BucketCount)
+	k.window = s.Window
+	return k
+}
+
+// unionZeros merges the values of every set, dropping values that appear in
+// more than one. The values are ordered by magnitude so the kernel can skip
+// zeros outside the distance limit. The ZeroType is the first set's.
+func unionZeros(sets []g.Zeros) g.Zeros {
+	seen := make(map[float64]bool)
+	values := make([]float64, 0)
+
+	for _, zeros := range sets {
+		for _, value := range zeros.Values {
+			if !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+	}
+
+	sort.SliceStable(values, func(a, b int) bool {
+		return math.Abs(values[a]) < math.Abs(values[b])
+	})
+
+	return g.Zeros{
+		ZeroType: sets[0].ZeroType,
+		Scalar:   sets[0].Scalar,
+		Count:    len(values),
+		Values:   values,
+	}
+}
+
+// scoreBatch scores a batch of origins against each zero set and returns a
+// result for every best bucket of every origin, regardless of score. start is
+// the index of the first origin in the batch within the job.
+func (s *Session) scoreBatch(sets []zeroSet, procid, start int, batch []g.Vector2) ([]Result, error) {
+	results := make([]Result, 0, len(batch)*len(sets))
+
+	for _, set := range sets {
+		if err := set.kernel.run(batch); err != nil {
+			var fault *NumericFaultError
+			if errors.As(err, &fault) {
+				fault.SessionID = s.ID
+			}
+			return nil, err
+		}
+
+		for j, origin := range batch {
+			for _, hits := range set.kernel.bestBuckets(j) {
+				r := CreateResult(s.ID, procid, start+j, set.index, s.BucketCount, origin, set.zeros.ZeroType, set.zeros.Count, hits)
+				r.Combined = set.index == len(s.ZLine.Zeros)
+				r.ZeroIDs = set.kernel.zeroIDs(j, hits.Bucket)
+				r.Scorer = set.scorer.Name()
+				if s.Scorer != RatioScorer {
+					s.rescore(&r, set, procid, start+j, hits)
+				}
+				if c := s.calibrations[set.index]; c != nil {
+					r.PValue = c.PValue(r.Score)
+					r.ZScore = c.ZScore(r.Score)
+				}
+				if !r.Combined {
+					r.AvgParity = avgParity(r.ZeroIDs, set.zeros.Negatives)
+				}
+				r.LatticeParams = s.Lattice.Parameters
+				r.Window = set.kernel.window
+				if r.Window < 1 {
+					r.Window = 1
+				}
+
+				// refining rescans the origin so only bother for results
+				// that will be kept
+				if s.Refine && s.keeps(r) {
+					places := precision(s.BucketCount)
+					r.BestTheta = math.Round(set.kernel.refine(origin, hits)*places) / places
+					r.Refined = true
+				}
+				results = append(results, r)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// rescore replaces the hit ratio CreateResult scored r on with the set's
+// scorer. The slug embeds the score so it is set again.
+func (s *Session) rescore(r *Result, set zeroSet, procid, originid int, hits bucketHits) {
+	in := ScoreInput{
+		Hits:     hits.Hits,
+		Zeros:    set.zeros.Count,
+		ZeroIDs:  r.ZeroIDs,
+		Counts:   set.kernel.counts,
+		Baseline: set.baseline,
+	}
+
+	places := precision(s.BucketCount)
+	r.Score = math.Round(set.scorer.Score(in)*places) / places
+	SetSlug(procid, originid, set.index, r)
+}
+
+// drawBatch fills batch with the sampler's next origins
+func drawBatch(sampler Sampler, batch []g.Vector2) {
+	for i := range batch {
+		batch[i] = sampler.Next()
+	}
+}
+
+// observe passes a result that met the minimum score back to the sampler if
+// it wants it
+func observe(sampler Sampler, r Result) {
+	if refiner, ok := sampler.(Refiner); ok {
+		refiner.Observe(r)
+	}
+}
+
+// jobRand returns the PRNG scan job procid draws its origins from. It only
+// depends on the session's Seed and ID so every scanner given the same
+// session generates the same origins.
+func (s *Session) jobRand(procid int) *rand.Rand {
+	return rand.New(rand.NewSource(jobSeed(s.Seed, s.ID, procid)))
+}
+
 // sessionFromCLI creates a session from CLI arguments and flags
 func sessionFromCLI(cctx context.Context, ctx *cli.Context) (*Session, error) {
 
@@ -211,10 +637,48 @@ func sessionFromCLI(cctx context.Context, ctx *cli.Context) (*Session, error) {
 
 	minScore := ctx.Float64("min-score")
 
-	zline, err := g.NewZLine(origin, zeros, maxValue, 1, false, 0)
+	scalar := ctx.Float64("scalar")
+	if scalar == 0 {
+		scalar = 1
+	}
+
+	zline, err := g.NewZLine(origin, zeros, maxValue, scalar, ctx.Bool("negatives"), ctx.Float64("angle"))
+	if err != nil {
+		return nil, err
+	}
+
+	var st SamplerType
+	st, err = st.GetSType(ctx.String("sampler"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewSession(0, zline, lattice, radius, distanceLimit, minScore, scanCount, buckets)
+	s.Seed = ctx.Int64("seed")
+	s.Sampler = st
+	s.Combined = ctx.Bool("combined")
+	s.Window = ctx.Int("window")
+	s.Refine = ctx.Bool("refine")
+	s.Budget = ctx.Duration("budget")
+	s.Target = ctx.Int("target")
+	s.TargetScore = ctx.Float64("target-score")
+	s.Percentile = ctx.Float64("percentile")
+
+	var sc ScorerType
+	s.Scorer, err = sc.GetScType(ctx.String("scorer"))
 	if err != nil {
 		return nil, err
 	}
 
-	return NewSession(0, zline, lattice, radius, distanceLimit, minScore, scanCount, buckets), nil
+	// NewSession defaults MinScore for the ratio scorer so leave it to
+	// Normalize to default it for the scorer chosen
+	if minScore == 0 {
+		s.MinScore = 0
+	}
+
+	if err := s.Normalize(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
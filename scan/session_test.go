@@ -0,0 +1,306 @@
+package scan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// testSession builds a small session over a synthetic lattice that doesn't
+// need anything from APP_DATA
+func testSession(scansReq int) *Session {
+	lattice := geom.Lattice{
+		LatticeType: geom.Pinwheel,
+		VertexType:  geom.Vertices,
+		Points:      kernelTestLattice(5000, 110),
+	}
+
+	zline := geom.ZLine{
+		Limit: 100,
+		Zeros: []geom.Zeros{
+			{
+				ZeroType: geom.Primes,
+				Scalar:   1,
+				Count:    len(kernelTestPrimes),
+				Values:   kernelTestPrimes,
+			},
+		},
+	}
+
+	s := NewSession(42, zline, lattice, 1, 1, .04, scansReq, 360)
+	s.ProcCount = 2
+	s.Seed = 7
+	return s
+}
+
+// collect runs a session to completion and returns every published result
+func collect(t *testing.T, s *Session) []Result {
+	ch, err := s.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make([]Result, 0)
+	for batch := range ch {
+		if batch.Err != nil {
+			t.Fatal(batch.Err)
+		}
+		results = append(results, batch.Results...)
+	}
+
+	return results
+}
+
+func TestSessionIsReproducible(t *testing.T) {
+	first := collect(t, testSession(64))
+	second := collect(t, testSession(64))
+
+	if len(first) == 0 {
+		t.Fatal("expected some results from the test session")
+	}
+
+	bySlug := make(map[string]Result)
+	for _, r := range first {
+		bySlug[r.Slug+"/"+r.String()] = r
+	}
+
+	if len(first) != len(second) {
+		t.Fatal("expected", len(first), "results from the second run but got", len(second))
+	}
+
+	for _, r := range second {
+		if _, ok := bySlug[r.Slug+"/"+r.String()]; !ok {
+			t.Log("result from the second run not found in the first:", r)
+			t.Fail()
+		}
+	}
+}
+
+func TestJobRandDiffersByJob(t *testing.T) {
+	s := testSession(0)
+
+	a := s.jobRand(0).Int63()
+	b := s.jobRand(1).Int63()
+	if a == b {
+		t.Log("expected different streams for different jobs")
+		t.Fail()
+	}
+
+	s.Seed++
+	if s.jobRand(0).Int63() == a {
+		t.Log("expected a different stream for a different seed")
+		t.Fail()
+	}
+}
+
+// multiSession is testSession with a second set of zeros
+func multiSession(scansReq int, combined bool) *Session {
+	s := testSession(scansReq)
+	s.ZLine.Zeros = append(s.ZLine.Zeros, geom.Zeros{
+		ZeroType: geom.SixN,
+		Scalar:   1,
+		Count:    8,
+		Values:   []float64{25, 35, 49, 55, 65, 77, 85, 91},
+	})
+	s.Combined = combined
+	s.MinScore = 0
+	return s
+}
+
+func TestEveryZeroSetIsScanned(t *testing.T) {
+	s := multiSession(32, false)
+	results := collect(t, s)
+
+	counts := make(map[geom.ZeroType]int)
+	for _, r := range results {
+		if r.Combined {
+			t.Fatal("unexpected combined result when Combined is false")
+		}
+		counts[r.ZeroType]++
+
+		if r.ZeroType == geom.SixN && r.ZerosCount != 8 {
+			t.Log("expected SixN results to be out of 8 zeros but was", r.ZerosCount)
+			t.Fail()
+		}
+	}
+
+	if counts[geom.Primes] == 0 || counts[geom.SixN] == 0 {
+		t.Log("expected results for both zero sets but got", counts)
+		t.Fail()
+	}
+}
+
+func TestCombinedScoresTheUnion(t *testing.T) {
+	s := multiSession(32, true)
+	results := collect(t, s)
+
+	combined := 0
+	for _, r := range results {
+		if !r.Combined {
+			continue
+		}
+		combined++
+
+		if r.ZerosCount != len(kernelTestPrimes)+8 {
+			t.Log("expected the union to have", len(kernelTestPrimes)+8, "zeros but had", r.ZerosCount)
+			t.Fail()
+		}
+
+		// the union's zero ids have no numbering to take the parity of
+		if r.AvgParity != 0 {
+			t.Log("expected no parity for a combined result but got", r.AvgParity)
+			t.Fail()
+		}
+	}
+
+	if combined == 0 {
+		t.Fatal("expected combined results")
+	}
+
+	for _, stored := range results {
+		if _, err := Verify(s, stored); err != nil {
+			t.Log(stored.Slug, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestUnionZerosDropsDuplicates(t *testing.T) {
+	union := unionZeros([]geom.Zeros{
+		{ZeroType: geom.Comp1, Values: []float64{4, -4, 6, -6, 8, -8}},
+		{ZeroType: geom.Comp2, Values: []float64{5, -5, 6, -6}},
+	})
+
+	if union.Count != 8 || len(union.Values) != 8 {
+		t.Fatal("expected 8 distinct zeros but got", union.Values)
+	}
+
+	for i := 1; i < len(union.Values); i++ {
+		if union.Values[i]*union.Values[i] < union.Values[i-1]*union.Values[i-1] {
+			t.Fatal("expected the union ordered by magnitude but got", union.Values)
+		}
+	}
+}
+
+func TestStartStopsWhenCanceled(t *testing.T) {
+	s := testSession(100000)
+	s.MinScore = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	completed := make(map[int]int)
+	for batch := range ch {
+		if batch.Err != nil {
+			t.Fatal(batch.Err)
+		}
+
+		// cancel as soon as the first results arrive
+		cancel()
+
+		if batch.Checkpoint != nil {
+			completed[batch.Checkpoint.ProcID] = batch.Checkpoint.Completed
+		}
+	}
+
+	if s.ScansDone == 0 || s.ScansDone >= s.ScansReq {
+		t.Fatal("expected the session to stop part way but it scanned", s.ScansDone, "of", s.ScansReq)
+	}
+
+	// the jobs flush a checkpoint for everything they scanned
+	total := 0
+	for _, c := range completed {
+		total += c
+	}
+
+	if total != s.ScansDone {
+		t.Log("the jobs checkpointed", total, "origins but scanned", s.ScansDone)
+		t.Fail()
+	}
+}
+
+func TestBudgetStopsSession(t *testing.T) {
+	s := testSession(0)
+	s.Budget = 50 * time.Millisecond
+	if err := s.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	collect(t, s)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("the budget should have stopped the session but it ran for", elapsed)
+	}
+
+	if s.ScansDone == 0 || s.Cancelled {
+		t.Fatal("expected the session to scan until its budget ran out but it scanned", s.ScansDone)
+	}
+}
+
+func TestTargetStopsSession(t *testing.T) {
+	s := testSession(0)
+	s.Target = 5
+	s.TargetScore = .05
+	if err := s.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	results := collect(t, s)
+
+	targeted := 0
+	for _, r := range results {
+		if r.Score >= s.TargetScore {
+			targeted++
+		}
+	}
+
+	if targeted < s.Target {
+		t.Fatal("expected at least", s.Target, "results scoring", s.TargetScore, "but got", targeted)
+	}
+
+	// each job stops at the end of the batch it is scanning
+	if s.ScansDone > 1000000 {
+		t.Log("the target should have stopped the session but it scanned", s.ScansDone)
+		t.Fail()
+	}
+}
+
+func TestValidateStoppingModes(t *testing.T) {
+	s := testSession(0)
+	s.Target = 3
+	if err := s.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.TargetScore != s.MinScore {
+		t.Log("expected the target score to default to the min score but was", s.TargetScore)
+		t.Fail()
+	}
+
+	if s.jobCount(0) != maxJobScans {
+		t.Log("expected jobs of a session without scans requested to be unbounded")
+		t.Fail()
+	}
+
+	s.TargetScore = s.MinScore / 2
+	if err := s.Validate(); err == nil {
+		t.Log("expected a target score below the min score to be invalid")
+		t.Fail()
+	}
+
+	s = testSession(0)
+	s.Budget = time.Minute
+	s.Sampler = GridSampler
+	if err := s.Validate(); err == nil {
+		t.Log("expected a grid without scans requested to be invalid")
+		t.Fail()
+	}
+}
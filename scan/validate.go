@@ -0,0 +1,304 @@
+package scan
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"time"
+
+	g "github.com/chriscow/cloud-scanner-go/geom"
+)
+
+const (
+	// defaultBucketCount divides the circle into tenths of a degree
+	defaultBucketCount = 3600
+
+	// defaultRadius and defaultDistanceLimit are what the gateway offers by
+	// default too
+	defaultRadius        = 1
+	defaultDistanceLimit = 1
+
+	// maxJobScans is how many origins a job scans when the session has a
+	// budget or target but no ScansReq. It is big enough that one of them
+	// stops the job first.
+	maxJobScans = math.MaxInt32
+
+	// maxBuffer is the most batches Start buffers for the caller
+	maxBuffer = 1 << 16
+)
+
+// Normalize fills in defaults for the fields a request may leave out and
+// sizes the session for this machine, then validates it. ProcCount is
+// capped at MaxProcs, and at ScansReq so every scan job has at least one
+// origin to scan, except in the work units of a grid session, which keep the
+// ProcCount the planner gave them.
+func (s *Session) Normalize() error {
+	if s.ID == 0 {
+		s.ID = time.Now().UnixNano()
+	}
+
+	if s.Radius == 0 {
+		s.Radius = defaultRadius
+	}
+
+	if s.DistanceLimit == 0 {
+		s.DistanceLimit = defaultDistanceLimit
+	}
+
+	if s.BucketCount == 0 {
+		s.BucketCount = defaultBucketCount
+	}
+
+	for i := range s.ZLine.Zeros {
+		if s.ZLine.Zeros[i].Scalar == 0 {
+			s.ZLine.Zeros[i].Scalar = 1
+		}
+	}
+
+	if s.MinScore == 0 {
+		s.MinScore = defaultMinScore(s.ZLine, s.Scorer)
+	}
+
+	if s.Target > 0 && s.TargetScore == 0 {
+		s.TargetScore = s.MinScore
+	}
+
+	if s.plannedProcs() {
+		return s.Validate()
+	}
+
+	if s.ProcCount < 1 {
+		s.ProcCount = runtime.GOMAXPROCS(0)
+	}
+
+	if s.MaxProcs > 0 && s.ProcCount > s.MaxProcs {
+		s.ProcCount = s.MaxProcs
+	}
+
+	if s.ScansReq > 0 && s.ProcCount > s.ScansReq {
+		s.ProcCount = s.ScansReq
+	}
+
+	return s.Validate()
+}
+
+// Validate checks every field of the session and returns an
+// *InvalidSessionError listing all of the problems it found, or nil if the
+// session can be scanned. Zero values are only valid where Normalize would
+// have replaced them.
+func (s *Session) Validate() error {
+	problems := make([]string, 0)
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if s.ID < 0 {
+		problem("id %d is negative", s.ID)
+	}
+
+	if !isLatticeType(s.Lattice.LatticeType) {
+		problem("unknown lattice type %d", s.Lattice.LatticeType)
+	}
+
+	if !isVertexType(s.Lattice.VertexType) {
+		problem("unknown vertex type %d", s.Lattice.VertexType)
+	}
+
+	if !finite(s.ZLine.Origin.X) || !finite(s.ZLine.Origin.Y) {
+		problem("origin %v is not finite", s.ZLine.Origin)
+	}
+
+	if !finite(s.ZLine.Angle) {
+		problem("angle %v is not finite", s.ZLine.Angle)
+	}
+
+	if !(s.ZLine.Limit > 0) {
+		problem("zero limit %v must be positive", s.ZLine.Limit)
+	}
+
+	if len(s.ZLine.Zeros) == 0 {
+		problem("no zeros")
+	}
+
+	for i, zeros := range s.ZLine.Zeros {
+		if !isZeroType(zeros.ZeroType) {
+			problem("zeros %d: unknown zero type %d", i, zeros.ZeroType)
+		}
+
+		if zeros.Scalar == 0 || !finite(zeros.Scalar) {
+			problem("zeros %d: scalar %v must be finite and not zero", i, zeros.Scalar)
+		}
+
+		// zeros aren't loaded until the session is restored
+		if zeros.Values != nil && len(zeros.Values) == 0 {
+			problem("zeros %d: no %v zeros up to %v", i, zeros.ZeroType, s.ZLine.Limit)
+		}
+	}
+
+	if !(s.Radius > 0) || math.IsInf(s.Radius, 1) {
+		problem("radius %v must be positive and finite", s.Radius)
+	}
+
+	if !(s.DistanceLimit > 0) {
+		problem("distance limit %v must be positive", s.DistanceLimit)
+	}
+
+	if s.BucketCount < 1 {
+		problem("bucket count %d must be at least 1", s.BucketCount)
+	}
+
+	if !(s.MinScore >= 0 && s.MinScore <= 1) {
+		problem("min score %v must be between 0 and 1", s.MinScore)
+	}
+
+	if s.ScansReq < 0 || (s.ScansReq == 0 && !s.bounded()) {
+		problem("scans requested %d must be at least 1 without a budget or target", s.ScansReq)
+	}
+
+	if s.Budget < 0 {
+		problem("budget %v is negative", s.Budget)
+	}
+
+	if s.Target < 0 {
+		problem("target %d is negative", s.Target)
+	}
+
+	// only results that meet MinScore are counted towards the target
+	if s.Target > 0 && !(s.TargetScore >= s.MinScore && s.TargetScore <= 1) {
+		problem("target score %v must be between the min score %v and 1", s.TargetScore, s.MinScore)
+	}
+
+	if s.Sampler == GridSampler && s.ScansReq == 0 {
+		problem("the grid sampler needs scans requested to size its grid")
+	}
+
+	if s.ProcCount < 0 {
+		problem("proc count %d is negative", s.ProcCount)
+	}
+
+	if s.MaxProcs < 0 {
+		problem("max procs %d is negative", s.MaxProcs)
+	}
+
+	if s.Sampler < RandomSampler || s.Sampler > AdaptiveSampler {
+		problem("unknown sampler %d", s.Sampler)
+	}
+
+	if s.Percentile < 0 || s.Percentile >= 100 {
+		problem("percentile %v must be at least 0 and less than 100", s.Percentile)
+	}
+
+	if s.Scorer < RatioScorer || s.Scorer > SignificanceScorer {
+		problem("unknown scorer %d", s.Scorer)
+	}
+
+	if s.Window < 0 || (s.BucketCount > 0 && s.Window > s.BucketCount) {
+		problem("window %d must be between 0 and the bucket count %d", s.Window, s.BucketCount)
+	}
+
+	if s.Chunks < 0 || (s.Chunks > 0 && (s.Chunk < 0 || s.Chunk >= s.Chunks)) {
+		problem("chunk %d of %d is out of range", s.Chunk, s.Chunks)
+	}
+
+	if s.Chunks > 0 && s.ParentID == 0 {
+		problem("chunk %d of %d has no parent session", s.Chunk, s.Chunks)
+	}
+
+	if s.GridScans < 0 || (s.GridScans > 0 && s.GridScans < s.ScansReq) {
+		problem("grid scans %d must cover the %d scans requested", s.GridScans, s.ScansReq)
+	}
+
+	if s.plannedProcs() && s.ProcCount < 1 {
+		problem("chunk %d of %d of a grid session has no proc count", s.Chunk, s.Chunks)
+	}
+
+	if len(problems) > 0 {
+		return &InvalidSessionError{SessionID: s.ID, Problems: problems}
+	}
+
+	return nil
+}
+
+// significantMinScore is the default MinScore of the significance scorer,
+// which keeps origins that do better than 95% of random ones
+const significantMinScore = .95
+
+// defaultMinScore is the score of a single hit on the first set of zeros, so
+// every bucket with any hits is published, or a hit above the mean with the
+// contrast scorer. The weighted scorer scores a single hit on the last zero.
+// The significance scorer uses significantMinScore instead, since an
+// unremarkable origin already scores about .5 with it. It is 0 until the
+// zeros are loaded.
+func defaultMinScore(zline g.ZLine, scorer ScorerType) float64 {
+	if scorer == SignificanceScorer {
+		return significantMinScore
+	}
+
+	if len(zline.Zeros) == 0 || len(zline.Zeros[0].Values) == 0 {
+		return 0
+	}
+
+	n := len(zline.Zeros[0].Values)
+	if scorer == WeightedScorer {
+		return weightedScorer{}.Score(ScoreInput{Zeros: n, ZeroIDs: []int{n - 1}})
+	}
+
+	return float64(1) / float64(n)
+}
+
+// bounded returns true if the session has a budget or target to stop it
+func (s *Session) bounded() bool {
+	return s.Budget > 0 || s.Target > 0
+}
+
+// plannedProcs is true for grid work units, which run the planner's ProcCount
+func (s *Session) plannedProcs() bool {
+	return s.Sampler == GridSampler && s.GridScans > 0
+}
+
+// jobCount returns the number of origins scan job procid scans. The remainder
+// of ScansReq / ProcCount is spread over the first jobs so the jobs scan
+// exactly ScansReq origins between them. Without ScansReq the jobs scan until
+// the session's budget or target stops them.
+func (s *Session) jobCount(procid int) int {
+	if s.ScansReq == 0 {
+		return maxJobScans
+	}
+
+	count := s.ScansReq / s.ProcCount
+	if procid < s.ScansReq%s.ProcCount {
+		count++
+	}
+	return count
+}
+
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func isLatticeType(lt g.LatticeType) bool {
+	for _, t := range g.LatticeTypes {
+		if lt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func isVertexType(vt g.VertexType) bool {
+	for _, t := range g.VertexTypes {
+		if vt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func isZeroType(zt g.ZeroType) bool {
+	for _, t := range g.ZeroTypes {
+		if zt == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package scan
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	s := testSession(0)
+	s.Lattice.LatticeType = 42
+	s.ZLine.Angle = math.NaN()
+	s.Radius = -1
+	s.BucketCount = 0
+	s.MinScore = 1.5
+	s.ZLine.Zeros = nil
+
+	err := s.Validate()
+
+	var invalid *InvalidSessionError
+	if !errors.As(err, &invalid) {
+		t.Fatal("expected an invalid session error but got", err)
+	}
+
+	// lattice type, angle, no zeros, radius, bucket count, min score and
+	// scans requested
+	if len(invalid.Problems) != 7 {
+		t.Log("expected 7 problems but got", len(invalid.Problems))
+		for _, p := range invalid.Problems {
+			t.Log("\t", p)
+		}
+		t.Fail()
+	}
+
+	if !errors.Is(err, ErrInvalidSession) || Retryable(err) {
+		t.Fatal("an invalid session should not be retried")
+	}
+}
+
+func TestValidateTestSession(t *testing.T) {
+	if err := testSession(64).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateEmptyZeros(t *testing.T) {
+	s := testSession(64)
+	s.ZLine.Zeros[0].Values = []float64{}
+
+	if err := s.Validate(); err == nil {
+		t.Fatal("expected zeros without any values to be invalid")
+	}
+}
+
+func TestValidateChunks(t *testing.T) {
+	s := testSession(64)
+	s.ParentID = 1
+	s.Chunk = 2
+	s.Chunks = 3
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Chunk = 3
+	if err := s.Validate(); err == nil {
+		t.Fatal("expected a chunk out of range to be invalid")
+	}
+
+	s.Chunk = 0
+	s.ParentID = 0
+	if err := s.Validate(); err == nil {
+		t.Fatal("expected a chunk without a parent to be invalid")
+	}
+}
+
+func TestNormalizeDefaults(t *testing.T) {
+	s := &Session{
+		ZLine: geom.ZLine{
+			Limit: 100,
+			Zeros: []geom.Zeros{{ZeroType: geom.Primes, Values: kernelTestPrimes}},
+		},
+		ScansReq: 3,
+	}
+
+	if err := s.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ID == 0 || s.Radius != 1 || s.DistanceLimit != 1 || s.BucketCount != 3600 {
+		t.Log("expected defaults but got", s.ID, s.Radius, s.DistanceLimit, s.BucketCount)
+		t.Fail()
+	}
+
+	if s.ZLine.Zeros[0].Scalar != 1 {
+		t.Log("expected a scalar of 1 but got", s.ZLine.Zeros[0].Scalar)
+		t.Fail()
+	}
+
+	if s.MinScore != 1/float64(len(kernelTestPrimes)) {
+		t.Log("expected the min score of a single hit but got", s.MinScore)
+		t.Fail()
+	}
+
+	// more jobs than scans would leave jobs with nothing to do
+	if s.ProcCount < 1 || s.ProcCount > 3 {
+		t.Log("expected between 1 and 3 jobs but got", s.ProcCount)
+		t.Fail()
+	}
+}
+
+func TestNormalizeKeepsPlannedProcs(t *testing.T) {
+	s := testSession(4)
+	s.Sampler = GridSampler
+	s.ParentID = 1
+	s.Chunks = 3
+	s.GridScans = 12
+	s.ProcCount = 8
+	s.MaxProcs = 2
+
+	// every scanner must split a grid work unit the same way
+	if err := s.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ProcCount != 8 {
+		t.Fatal("expected a grid work unit to keep the planned proc count but got", s.ProcCount)
+	}
+
+	s.ProcCount = 0
+	if err := s.Normalize(); err == nil {
+		t.Fatal("expected a grid work unit without a proc count to be invalid")
+	}
+
+	// other sessions are sized for the scanner
+	s.Sampler = RandomSampler
+	s.ProcCount = 8
+	if err := s.Normalize(); err != nil || s.ProcCount != 2 {
+		t.Fatal("expected max procs to cap the proc count but got", s.ProcCount, err)
+	}
+}
+
+func TestDefaultMinScoreFollowsScorer(t *testing.T) {
+	zline := geom.ZLine{Zeros: []geom.Zeros{{ZeroType: geom.Primes, Values: kernelTestPrimes}}}
+	n := len(kernelTestPrimes)
+
+	single := weightedScorer{}.Score(ScoreInput{Hits: 1, Zeros: n, ZeroIDs: []int{n - 1}})
+	if got := defaultMinScore(zline, WeightedScorer); got != single || got >= 1/float64(n) {
+		t.Log("expected the weighted default to be a single hit on the last zero but got", got)
+		t.Fail()
+	}
+
+	// random origins score about .5 so the default has to keep far fewer
+	s := testSession(10)
+	s.Scorer = SignificanceScorer
+	s.MinScore = 0
+	if err := s.Normalize(); err != nil || s.MinScore != significantMinScore {
+		t.Fatal("expected the significance scorer to default to", significantMinScore, "but got", s.MinScore, err)
+	}
+}
+
+func TestJobCountCoversScansReq(t *testing.T) {
+	s := testSession(0)
+
+	for _, scansReq := range []int{1, 7, 64, 1001} {
+		for _, procs := range []int{1, 2, 3, 8} {
+			s.ScansReq, s.ProcCount = scansReq, procs
+
+			total := 0
+			for procid := 0; procid < procs; procid++ {
+				total += s.jobCount(procid)
+			}
+
+			if total != scansReq {
+				t.Log(procs, "jobs scan", total, "origins but", scansReq, "were requested")
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestNewSessionKeepsRadius(t *testing.T) {
+	s := NewSession(1, testSession(0).ZLine, geom.Lattice{}, 2.5, 1, .1, 10, 360)
+	if s.Radius != 2.5 {
+		t.Fatal("expected a radius of 2.5 but got", s.Radius)
+	}
+
+	// zeros that aren't loaded yet don't divide by zero
+	zline := geom.ZLine{Zeros: []geom.Zeros{{ZeroType: geom.Primes}}}
+	if s := NewSession(1, zline, geom.Lattice{}, 1, 1, 0, 10, 360); s.MinScore != 0 {
+		t.Fatal("expected no min score before the zeros are loaded but got", s.MinScore)
+	}
+}
@@ -0,0 +1,191 @@
+package scan
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/chriscow/cloud-scanner-go/geom"
+)
+
+// refineSteps is the number of times refinement halves the winning window,
+// which narrows a 0.1 degree bucket down to about 1e-7 degrees
+const refineSteps = 20
+
+// windowStart returns the first bucket of the window of the given size
+// centered on bucket b. Windows wrap around at 360 degrees.
+func windowStart(b, window, bucketCount int) int {
+	return ((b-(window-1)/2)%bucketCount + bucketCount) % bucketCount
+}
+
+// countWindows scores every bucket on the distinct zeros hit anywhere in the
+// window of neighbouring buckets centered on it, so a peak that straddles a
+// bucket edge is not split in two. A window of 1 is the same as countHits.
+func countWindows(buckets [][]int, window int) []bucketHits {
+	if window <= 1 {
+		return countHits(buckets)
+	}
+
+	counts := make([]int, len(buckets))
+	for b := range buckets {
+		first := windowStart(b, window, len(buckets))
+
+		for i := range buckets[b] {
+			for w := 0; w < window; w++ {
+				if buckets[(first+w)%len(buckets)][i] > 0 {
+					counts[b]++
+					break
+				}
+			}
+		}
+	}
+
+	return rankHits(counts)
+}
+
+// centerRuns keeps one of each run of neighbouring buckets tied for best:
+// the one in the middle of the run. Neighbouring windows share most of their
+// buckets so a single peak ties across a run of them and would otherwise be
+// reported once for every bucket in the run. Runs wrap around at 360 degrees
+// and are returned in bucket order.
+func centerRuns(best []bucketHits, bucketCount int) []bucketHits {
+	tied := make(map[int]bucketHits, len(best))
+	for _, bh := range best {
+		tied[bh.Bucket] = bh
+	}
+
+	// every bucket tied is one run with no middle
+	if len(tied) == bucketCount {
+		return []bucketHits{tied[0]}
+	}
+
+	centers := make([]bucketHits, 0, 1)
+	for b := 0; b < bucketCount; b++ {
+		if _, ok := tied[b]; !ok {
+			continue
+		}
+		if _, ok := tied[(b-1+bucketCount)%bucketCount]; ok {
+			continue // not the start of a run
+		}
+
+		length := 1
+		for {
+			if _, ok := tied[(b+length)%bucketCount]; !ok {
+				break
+			}
+			length++
+		}
+
+		centers = append(centers, tied[(b+(length-1)/2)%bucketCount])
+	}
+
+	sort.Slice(centers, func(i, j int) bool { return centers[i].Bucket < centers[j].Bucket })
+	return centers
+}
+
+// windowCount is countWindows for bucket b of origin o of the kernel's last
+// batch
+func (k *kernel) windowCount(o, b int) int {
+	count := 0
+	for word := 0; word < k.words; word++ {
+		count += bits.OnesCount64(k.windowWord(o, b, word))
+	}
+
+	return count
+}
+
+// windowWord is the union of the given word of the bitsets of every bucket in
+// the window centered on bucket b
+func (k *kernel) windowWord(o, b, word int) uint64 {
+	window := k.window
+	if window < 1 {
+		window = 1
+	}
+	first := windowStart(b, window, k.bucketCount)
+
+	var union uint64
+	for w := 0; w < window; w++ {
+		bucket := (first + w) % k.bucketCount
+		union |= k.bits[(o*k.bucketCount+bucket)*k.words+word]
+	}
+
+	return union
+}
+
+// zeroAngle is the angle of a hit measured from the start of the window it
+// is in, along with the index of the zero it hit
+type zeroAngle struct {
+	offset float64
+	zero   int
+}
+
+// refine finds a continuous best theta within the window of the best bucket
+// bh at origin. It collects every hit in the window and bisects the window
+// towards the half that hits more distinct zeros.
+func (k *kernel) refine(origin geom.Vector2, bh bucketHits) float64 {
+	window := k.window
+	if window < 1 {
+		window = 1
+	}
+
+	lo := float64(windowStart(bh.Bucket, window, k.bucketCount)) * k.degPerBucket
+	width := float64(window) * k.degPerBucket
+
+	angles := make([]zeroAngle, 0, bh.Hits*2)
+	for p := range k.lx {
+		dx := k.lx[p] - origin.X
+		dy := k.ly[p] - origin.Y
+		rsq := dx*dx + dy*dy
+
+		for i, zsq := range k.zsq {
+			if zsq > rsq {
+				continue
+			}
+
+			distance := math.Sqrt(rsq - zsq)
+			if distance > k.limit {
+				continue
+			}
+
+			for _, sign := range []float64{1, -1} {
+				theta := wrapDegrees(lineAngle(dx, dy, k.zeros[i], distance, sign) - k.angle)
+				if offset := wrapDegrees(theta - lo); offset < width {
+					angles = append(angles, zeroAngle{offset: offset, zero: i})
+				}
+			}
+		}
+	}
+
+	return wrapDegrees(lo + bisectAngles(angles, width))
+}
+
+// bisectAngles repeatedly halves [0, width) keeping the half that hits more
+// distinct zeros and returns the middle of what is left. It stops early when
+// both halves hit the same number of zeros since the peak is then in the
+// middle.
+func bisectAngles(angles []zeroAngle, width float64) float64 {
+	lo, hi := 0.0, width
+
+	for step := 0; step < refineSteps; step++ {
+		mid := (lo + hi) / 2
+
+		left, right := make(map[int]bool), make(map[int]bool)
+		for _, a := range angles {
+			if a.offset >= lo && a.offset < mid {
+				left[a.zero] = true
+			} else if a.offset >= mid && a.offset < hi {
+				right[a.zero] = true
+			}
+		}
+
+		if len(left) > len(right) {
+			hi = mid
+		} else if len(right) > len(left) {
+			lo = mid
+		} else {
+			break
+		}
+	}
+
+	return (lo + hi) / 2
+}
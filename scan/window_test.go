@@ -0,0 +1,191 @@
+package scan
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCountWindowsWraps(t *testing.T) {
+	buckets := make([][]int, 10)
+	for i := range buckets {
+		buckets[i] = make([]int, 3)
+	}
+
+	buckets[9][0] = 1
+	buckets[0][1] = 1
+	buckets[1][1] = 1 // the same zero again only counts once
+	buckets[1][2] = 1
+
+	counts := make([]int, 10)
+	for _, bh := range countWindows(buckets, 3) {
+		counts[bh.Bucket] = bh.Hits
+	}
+
+	expected := []int{3, 2, 2, 0, 0, 0, 0, 0, 1, 2}
+	if !reflect.DeepEqual(expected, counts) {
+		t.Log("expected window counts", expected, "but got", counts)
+		t.Fail()
+	}
+}
+
+func TestCountWindowsOfOne(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origin := kernelTestOrigins(1)[0]
+
+	buckets := mustCalculate(t, origin, lattice, kernelTestPrimes, nil, 2, 0, 3600)
+	if !reflect.DeepEqual(countHits(buckets), countWindows(buckets, 1)) {
+		t.Fatal("a window of one bucket should score the same as countHits")
+	}
+}
+
+func TestKernelWindowMatchesCountWindows(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origins := kernelTestOrigins(kernelBatch)
+
+	for _, window := range []int{2, 3, 9} {
+		k := newKernel(lattice, kernelTestPrimes, 2, 30, 3600)
+		k.window = window
+		if err := k.run(origins); err != nil {
+			t.Fatal(err)
+		}
+
+		for j, origin := range origins {
+			expected := centerRuns(bestOf(countWindows(mustCalculate(t, origin, lattice, kernelTestPrimes, nil, 2, 30, 3600), window)), 3600)
+			actual := k.bestBuckets(j)
+			if !reflect.DeepEqual(expected, actual) {
+				t.Log("origin", origin, "window", window)
+				t.Log("\texpected", expected)
+				t.Log("\tactual  ", actual)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestCenterRuns(t *testing.T) {
+	best := make([]bucketHits, 0)
+	for _, b := range []int{10, 11, 0, 1, 2, 4, 6, 7} {
+		best = append(best, bucketHits{Bucket: b, Hits: 5})
+	}
+
+	// runs 10-2 across the wrap, 4 alone and 6-7
+	centers := make([]int, 0)
+	for _, bh := range centerRuns(best, 12) {
+		centers = append(centers, bh.Bucket)
+	}
+
+	if expected := []int{0, 4, 6}; !reflect.DeepEqual(expected, centers) {
+		t.Log("expected run centers", expected, "but got", centers)
+		t.Fail()
+	}
+
+	all := make([]bucketHits, 4)
+	for i := range all {
+		all[i] = bucketHits{Bucket: 3 - i, Hits: 1}
+	}
+	if centers := centerRuns(all, 4); len(centers) != 1 {
+		t.Log("expected one result when every bucket ties but got", centers)
+		t.Fail()
+	}
+}
+
+func TestWindowedOriginHasOneResultPerPeak(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origins := kernelTestOrigins(kernelBatch)
+
+	k := newKernel(lattice, kernelTestPrimes, 2, 0, 3600)
+	k.window = 9
+	if err := k.run(origins); err != nil {
+		t.Fatal(err)
+	}
+
+	for j := range origins {
+		best := k.bestBuckets(j)
+		for i := 1; i < len(best); i++ {
+			if gap := best[i].Bucket - best[i-1].Bucket; gap < 2 {
+				t.Log("origin", j, "has results for neighbouring buckets", best[i-1].Bucket, best[i].Bucket)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestBisectAngles(t *testing.T) {
+	angles := []zeroAngle{
+		{offset: .012, zero: 0},
+		{offset: .0701, zero: 1},
+		{offset: .0702, zero: 2},
+		{offset: .0703, zero: 3},
+		{offset: .0703, zero: 3}, // a second hit on the same zero
+		{offset: .095, zero: 4},
+	}
+
+	theta := bisectAngles(angles, .1)
+	if math.Abs(theta-.0702) > .0002 {
+		t.Log("expected refined angle near .0702 but got", theta)
+		t.Fail()
+	}
+
+	// an even split can't be narrowed down
+	if theta := bisectAngles([]zeroAngle{{.01, 0}, {.09, 1}}, .1); theta != .05 {
+		t.Log("expected the middle of the window but got", theta)
+		t.Fail()
+	}
+}
+
+func TestRefineWithinWindow(t *testing.T) {
+	lattice := kernelTestLattice(2000, 100)
+	origins := kernelTestOrigins(kernelBatch)
+
+	for _, window := range []int{1, 3} {
+		k := newKernel(lattice, kernelTestPrimes, 2, 0, 3600)
+		k.window = window
+		if err := k.run(origins); err != nil {
+			t.Fatal(err)
+		}
+
+		for j, origin := range origins {
+			for _, bh := range k.bestBuckets(j) {
+				lo := float64(windowStart(bh.Bucket, window, 3600)) * k.degPerBucket
+				theta := k.refine(origin, bh)
+
+				if offset := wrapDegrees(theta - lo); offset >= float64(window)*k.degPerBucket {
+					t.Log("origin", origin, "bucket", bh.Bucket, "refined to", theta, "outside its window")
+					t.Fail()
+				}
+			}
+		}
+	}
+}
+
+func TestSessionRecordsWindowAndRefinement(t *testing.T) {
+	s := testSession(64)
+	s.Window = 3
+	s.Refine = true
+
+	results := collect(t, s)
+	if len(results) == 0 {
+		t.Fatal("expected some results from the test session")
+	}
+
+	degPerBucket := 360 / float64(s.BucketCount)
+	for i, r := range results {
+		if r.Window != 3 || !r.Refined {
+			t.Fatal("expected a refined result over a window of 3 but got", r.Window, r.Refined)
+		}
+
+		lo := float64(windowStart(r.BestBucket, 3, s.BucketCount)) * degPerBucket
+		if offset := wrapDegrees(r.BestTheta - lo); offset > 3*degPerBucket {
+			t.Log(r, "has a refined theta outside its window")
+			t.Fail()
+		}
+
+		// refining doesn't change the score so the result still verifies
+		if i < 4 {
+			if _, err := Verify(s, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Envelope wraps every message published to NSQ so consumers know what the
+// payload is and which version of it they were sent. A JSON payload is
+// embedded in the envelope as is. Any other payload follows the envelope in a
+// binary frame:
+//
+//	magic (2 bytes) | envelope length (4 bytes, big endian) |
+//	JSON envelope without the payload | payload
+type Envelope struct {
+	// Version is the schema version of the payload. Messages published
+	// before envelopes existed are version 0.
+	Version int
+
+	// Type is the kind of payload, which is the topic it is published to
+	Type string
+
+	// Producer identifies the process that published the message
+	Producer  string
+	Timestamp time.Time
+
+	// TraceID follows one request through every message it causes
+	TraceID string `json:",omitempty"`
+
+	// ContentType is the MIME type of the payload. Empty is JSON.
+	ContentType string `json:",omitempty"`
+
+	Payload []byte `json:"-"`
+}
+
+// envelopeJSON is an Envelope with its JSON payload embedded
+type envelopeJSON struct {
+	Envelope
+	Payload json.RawMessage `json:",omitempty"`
+}
+
+// frameMagic starts an envelope framed in front of a payload that isn't JSON.
+// JSON never starts with these bytes.
+var frameMagic = []byte{0xca, 0x5e}
+
+// frameHeader is the size of the magic and envelope length of a frame
+const frameHeader = 6
+
+// isJSON reports whether the payload of the content type is JSON
+func isJSON(contentType string) bool {
+	return contentType == "" || contentType == "application/json"
+}
+
+// IsJSON reports whether the payload is JSON
+func (env *Envelope) IsJSON() bool {
+	return isJSON(env.ContentType)
+}
+
+// marshal encodes the envelope, embedding a JSON payload and framing any
+// other
+func (env *Envelope) marshal() ([]byte, error) {
+	if isJSON(env.ContentType) && json.Valid(env.Payload) {
+		return json.Marshal(envelopeJSON{Envelope: *env, Payload: env.Payload})
+	}
+
+	header, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, frameHeader, frameHeader+len(header)+len(env.Payload))
+	copy(body, frameMagic)
+	binary.BigEndian.PutUint32(body[len(frameMagic):], uint32(len(header)))
+	body = append(body, header...)
+	return append(body, env.Payload...), nil
+}
+
+// unmarshal decodes an envelope and returns false if body isn't one
+func unmarshal(body []byte) (*Envelope, bool, error) {
+	if bytes.HasPrefix(body, frameMagic) {
+		if len(body) < frameHeader {
+			return nil, true, errors.New("envelope frame is truncated")
+		}
+
+		end := frameHeader + int(binary.BigEndian.Uint32(body[len(frameMagic):]))
+		if end > len(body) {
+			return nil, true, errors.New("envelope frame is truncated")
+		}
+
+		env := &Envelope{}
+		if err := json.Unmarshal(body[frameHeader:end], env); err != nil {
+			return nil, true, fmt.Errorf("envelope frame: %w", err)
+		}
+		env.Payload = body[end:]
+		return env, true, nil
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return nil, false, nil
+	}
+
+	wire := envelopeJSON{}
+	if json.Unmarshal(body, &wire) != nil || wire.Type == "" || wire.Payload == nil {
+		return nil, false, nil
+	}
+
+	env := &wire.Envelope
+	env.Payload = wire.Payload
+
+	// envelopes used to carry every payload base64 encoded
+	if bytes.HasPrefix(wire.Payload, []byte(`"`)) {
+		if err := json.Unmarshal(wire.Payload, &env.Payload); err != nil {
+			return nil, true, err
+		}
+	}
+
+	return env, true, nil
+}
+
+// Upgrade turns the payload of one version of a message type into the next
+type Upgrade func(payload []byte) ([]byte, error)
+
+// messageType is the current version of a message type along with the
+// upgrades from each older version
+type messageType struct {
+	version  int
+	upgrades []Upgrade
+}
+
+var (
+	typesMut sync.RWMutex
+	types    = make(map[string]messageType)
+)
+
+// ProducerID identifies this process in the envelopes it publishes
+var ProducerID = producerID()
+
+// producerID is the program name, host name and process ID
+func producerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprint(filepath.Base(os.Args[0]), "@", host, ":", os.Getpid())
+}
+
+// RegisterType sets the current version of a message type. upgrades[v]
+// upgrades version v of the payload to version v+1 so there must be one for
+// every older version, starting with 0.
+func RegisterType(msgType string, version int, upgrades ...Upgrade) {
+	if len(upgrades) != version {
+		panic(fmt.Sprintf("message type %s version %d needs %d upgrades but has %d", msgType, version, version, len(upgrades)))
+	}
+
+	typesMut.Lock()
+	defer typesMut.Unlock()
+	types[msgType] = messageType{version: version, upgrades: upgrades}
+}
+
+// lookupType returns the registration of the message type. Unregistered
+// types are version 0 and never upgraded.
+func lookupType(msgType string) messageType {
+	typesMut.RLock()
+	defer typesMut.RUnlock()
+	return types[msgType]
+}
+
+// Wrap returns the JSON payload in an envelope of the current version of the
+// message type
+func Wrap(msgType string, payload []byte, traceID string) ([]byte, error) {
+	return WrapContent(msgType, "", payload, traceID)
+}
+
+// WrapContent returns the payload of the content type in an envelope of the
+// current version of the message type
+func WrapContent(msgType, contentType string, payload []byte, traceID string) ([]byte, error) {
+	env := &Envelope{
+		Version:     lookupType(msgType).version,
+		Type:        msgType,
+		Producer:    ProducerID,
+		Timestamp:   time.Now(),
+		TraceID:     traceID,
+		ContentType: contentType,
+		Payload:     payload,
+	}
+	return env.marshal()
+}
+
+// Publish wraps the JSON payload in an envelope typed by the topic and
+// publishes it
+func Publish(producer *nsq.Producer, topic string, payload []byte, traceID string) error {
+	return PublishContent(producer, topic, "", payload, traceID)
+}
+
+// PublishContent wraps the payload of the content type in an envelope typed
+// by the topic and publishes it
+func PublishContent(producer *nsq.Producer, topic, contentType string, payload []byte, traceID string) error {
+	body, err := WrapContent(topic, contentType, payload, traceID)
+	if err != nil {
+		return err
+	}
+	return producer.Publish(topic, body)
+}
+
+// Open unwraps a message and upgrades its payload to the current version of
+// its type. A message without an envelope is taken to be version 0 of
+// legacyType.
+func Open(body []byte, legacyType string) (*Envelope, error) {
+	env, ok, err := unmarshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		env = &Envelope{Type: legacyType, Payload: body}
+	}
+
+	mt := lookupType(env.Type)
+	if env.Version > mt.version {
+		return env, fmt.Errorf("%s message version %d is newer than version %d", env.Type, env.Version, mt.version)
+	}
+
+	for env.Version < mt.version {
+		payload, err := mt.upgrades[env.Version](env.Payload)
+		if err != nil {
+			return env, fmt.Errorf("upgrading %s message from version %d: %w", env.Type, env.Version, err)
+		}
+		env.Payload = payload
+		env.Version++
+	}
+
+	return env, nil
+}
+
+// EnvelopeHandler handles the unwrapped messages of one type
+type EnvelopeHandler interface {
+	HandleEnvelope(msg *nsq.Message, env *Envelope) error
+}
+
+// EnvelopeHandlerFunc is a function that handles envelopes
+type EnvelopeHandlerFunc func(msg *nsq.Message, env *Envelope) error
+
+// HandleEnvelope calls f
+func (f EnvelopeHandlerFunc) HandleEnvelope(msg *nsq.Message, env *Envelope) error {
+	return f(msg, env)
+}
+
+// FailedEnvelopeLogger is told about the messages NSQ gave up on
+type FailedEnvelopeLogger interface {
+	LogFailedEnvelope(msg *nsq.Message, env *Envelope)
+}
+
+// Router sends each envelope to the handler of its type. Envelopes of types
+// without a handler go to the fallback, which sees the upgraded payload as
+// the message body, so plain nsq.Handlers keep working.
+type Router struct {
+	handlers map[string]EnvelopeHandler
+	fallback nsq.Handler
+}
+
+// NewRouter returns a Router with no typed handlers. fallback may be nil.
+func NewRouter(fallback nsq.Handler) *Router {
+	return &Router{handlers: make(map[string]EnvelopeHandler), fallback: fallback}
+}
+
+// Handle routes envelopes of the message type to h
+func (r *Router) Handle(msgType string, h EnvelopeHandler) *Router {
+	r.handlers[msgType] = h
+	return r
+}
+
+// HandleMessage unwraps and routes a message. Messages without an envelope
+// go to the fallback.
+func (r *Router) HandleMessage(msg *nsq.Message) error {
+	return r.handle(msg, "")
+}
+
+// LogFailedMessage tells the handler of the message that NSQ gave up on it
+func (r *Router) LogFailedMessage(msg *nsq.Message) {
+	r.logFailed(msg, "")
+}
+
+func (r *Router) handle(msg *nsq.Message, legacyType string) error {
+	if len(msg.Body) == 0 {
+		return nil
+	}
+
+	env, err := Open(msg.Body, legacyType)
+	if err != nil {
+		// a newer producer is out there so leave it for a newer consumer
+		log.Println("[router]", err)
+		return err
+	}
+
+	if h, ok := r.handlers[env.Type]; ok {
+		return h.HandleEnvelope(msg, env)
+	}
+
+	if r.fallback == nil {
+		log.Println("[router] dropping", env.Type, "message from", env.Producer, "without a handler")
+		return nil
+	}
+
+	msg.Body = env.Payload
+	return r.fallback.HandleMessage(msg)
+}
+
+func (r *Router) logFailed(msg *nsq.Message, legacyType string) {
+	env, err := Open(msg.Body, legacyType)
+	if err != nil {
+		log.Println("[router] giving up on message:", err)
+		return
+	}
+
+	if h, ok := r.handlers[env.Type]; ok {
+		if logger, ok := h.(FailedEnvelopeLogger); ok {
+			logger.LogFailedEnvelope(msg, env)
+		}
+		return
+	}
+
+	if logger, ok := r.fallback.(nsq.FailedMessageLogger); ok {
+		msg.Body = env.Payload
+		logger.LogFailedMessage(msg)
+	}
+}
+
+// ForTopic returns a handler that routes the messages of the topic, taking
+// messages without an envelope to be of the topic's type
+func (r *Router) ForTopic(topic string) nsq.Handler {
+	return topicRouter{topic: topic, router: r}
+}
+
+// topicRouter routes the messages of one topic, where messages without an
+// envelope are of the topic's type
+type topicRouter struct {
+	topic  string
+	router *Router
+}
+
+func (tr topicRouter) HandleMessage(msg *nsq.Message) error {
+	return tr.router.handle(msg, tr.topic)
+}
+
+func (tr topicRouter) LogFailedMessage(msg *nsq.Message) {
+	tr.router.logFailed(msg, tr.topic)
+}
+
+// routerFor returns handler if it is a Router, otherwise a Router that
+// unwraps every message for it
+func routerFor(handler nsq.Handler) *Router {
+	if r, ok := handler.(*Router); ok {
+		return r
+	}
+	return NewRouter(handler)
+}
@@ -0,0 +1,160 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func testMessage(body []byte) *nsq.Message {
+	return nsq.NewMessage(nsq.MessageID{}, body)
+}
+
+func TestOpenUpgradesOldVersions(t *testing.T) {
+	RegisterType("test-upgrade", 2,
+		func(p []byte) ([]byte, error) { return append(p, '1'), nil },
+		func(p []byte) ([]byte, error) { return append(p, '2'), nil },
+	)
+
+	// a message from before envelopes goes through every upgrade
+	env, err := Open([]byte("{}"), "test-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env.Version != 2 || string(env.Payload) != "{}12" {
+		t.Log("expected version 2 payload {}12, got version", env.Version, string(env.Payload))
+		t.Fail()
+	}
+
+	body, err := Wrap("test-upgrade", []byte("x"), "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err = Open(body, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env.Version != 2 || string(env.Payload) != "x" || env.TraceID != "trace" || env.Producer != ProducerID {
+		t.Log("a current envelope changed on the way through:", env)
+		t.Fail()
+	}
+}
+
+func TestOpenRejectsNewerVersions(t *testing.T) {
+	RegisterType("test-newer", 0)
+
+	RegisterType("test-newer", 1, func(p []byte) ([]byte, error) { return p, nil })
+	body, err := Wrap("test-newer", []byte("x"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// this consumer only knows version 0
+	RegisterType("test-newer", 0)
+	if _, err := Open(body, ""); err == nil {
+		t.Log("expected an error opening a newer version")
+		t.Fail()
+	}
+}
+
+func TestRouter(t *testing.T) {
+	RegisterType("test-route", 0)
+
+	typed := 0
+	trace := ""
+	var fallback []byte
+
+	router := NewRouter(nsq.HandlerFunc(func(msg *nsq.Message) error {
+		fallback = msg.Body
+		return nil
+	}))
+	router.Handle("test-route", EnvelopeHandlerFunc(func(msg *nsq.Message, env *Envelope) error {
+		typed++
+		trace = env.TraceID
+		return nil
+	}))
+
+	body, err := Wrap("test-route", []byte("typed"), "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := router.ForTopic("test-route").HandleMessage(testMessage(body)); err != nil || typed != 1 || trace != "trace" {
+		t.Log("expected the typed handler to get the envelope:", err)
+		t.Fail()
+	}
+
+	// other types, and messages without an envelope, go to the fallback
+	// with the payload as the body
+	other, err := Wrap("test-other", []byte("other"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := router.ForTopic("test-route").HandleMessage(testMessage(other)); err != nil || !bytes.Equal(fallback, []byte("other")) {
+		t.Log("expected the fallback to get the payload, got", string(fallback), err)
+		t.Fail()
+	}
+
+	if err := router.HandleMessage(testMessage([]byte("[1,2]"))); err != nil || !bytes.Equal(fallback, []byte("[1,2]")) {
+		t.Log("expected the fallback to get the bare message, got", string(fallback), err)
+		t.Fail()
+	}
+
+	// a bare message on the topic is the topic's type
+	if err := router.ForTopic("test-route").HandleMessage(testMessage([]byte("{}"))); err != nil || typed != 2 {
+		t.Log("expected a bare message on the topic to be routed by the topic:", err)
+		t.Fail()
+	}
+}
+
+func TestEnvelopePayloads(t *testing.T) {
+	RegisterType("test-payload", 0)
+
+	// JSON is embedded as is, so the envelope is readable JSON
+	body, err := Wrap("test-payload", []byte(`[1,2]`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(body, []byte(`"Payload":[1,2]`)) {
+		t.Fatal("expected the JSON payload to be embedded but got", string(body))
+	}
+
+	// anything else follows the envelope in a frame
+	binary := []byte{0, 0xff, '{', 1}
+	body, err = WrapContent("test-payload", "application/msgpack", binary, "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(body, frameMagic) || !bytes.HasSuffix(body, binary) {
+		t.Fatal("expected the binary payload to be framed")
+	}
+
+	env, err := Open(body, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env.IsJSON() || env.ContentType != "application/msgpack" || !bytes.Equal(env.Payload, binary) || env.TraceID != "trace" {
+		t.Log("a framed envelope changed on the way through:", env)
+		t.Fail()
+	}
+
+	if _, err := Open(body[:frameHeader+3], ""); err == nil {
+		t.Log("expected an error opening a truncated frame")
+		t.Fail()
+	}
+
+	// envelopes used to carry payloads base64 encoded
+	env, err = Open([]byte(`{"Type":"test-payload","Payload":"WzEsMl0="}`), "")
+	if err != nil || string(env.Payload) != "[1,2]" {
+		t.Log("expected the base64 payload [1,2] but got", string(env.Payload), err)
+		t.Fail()
+	}
+}
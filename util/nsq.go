@@ -9,18 +9,32 @@ import (
 
 // StartConsumer is a helper function that starts consuming a topic from NSQ. It
 // will block until the context.Done() channel closes / receives a value at which
-// point it gracefully shuts down the consumer.
+// point it gracefully shuts down the consumer. Messages are unwrapped from
+// their Envelope and routed by type when handler is a Router; any other
+// handler gets the upgraded payload as the message body.
 func StartConsumer(ctx context.Context, topic, channel string, handler nsq.Handler) error {
+	return StartConcurrentConsumer(ctx, topic, channel, handler, 1)
+}
+
+// StartConcurrentConsumer is StartConsumer with up to concurrency messages
+// handled at once
+func StartConcurrentConsumer(ctx context.Context, topic, channel string, handler nsq.Handler, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
 	// Instantiate a consumer that will subscribe to the provided channel.
+	// NSQ only sends as many messages as are in flight so there has to be
+	// one for every handler.
 	config := nsq.NewConfig()
+	config.MaxInFlight = concurrency
 	consumer, err := nsq.NewConsumer(topic, channel, config)
 	if err != nil {
 		return err
 	}
 
-	// Set the Handler for messages received by this Consumer. Can be called multiple times.
-	// See also AddConcurrentHandlers.
-	consumer.AddHandler(handler)
+	// Set the Handler for messages received by this Consumer.
+	consumer.AddConcurrentHandlers(routerFor(handler).ForTopic(topic), concurrency)
 
 	// Use nsqlookupd to discover nsqd instances.
 	// See also ConnectToNSQD, ConnectToNSQDs, ConnectToNSQLookupds.